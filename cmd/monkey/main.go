@@ -0,0 +1,37 @@
+// Command monkey is a JavaScript shell of Monkey.
+//
+// Without arguments it starts an interactive REPL,
+// "monkey run script.js" runs a script.
+package main
+
+import (
+	"fmt"
+	"os"
+
+	js "github.com/kirillDanshin/monkey"
+)
+
+const usage = `Usage:
+  monkey                            start the REPL
+  monkey run [flags] script.js ...  run a script, see "monkey run -h"
+`
+
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "run":
+			os.Exit(runCommand(os.Args[2:]))
+		case "-h", "-help", "--help", "help":
+			fmt.Print(usage)
+			os.Exit(0)
+		}
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	runtime := js.NewRuntime(8 * 1024 * 1024)
+	context := runtime.NewContext()
+	context.InitConsole(nil)
+
+	os.Exit(newRepl(context).run())
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/peterh/liner"
+
+	js "github.com/kirillDanshin/monkey"
+)
+
+const replHelp = `.load FILE   evaluate a file
+.save FILE   save the evaluated input of this session
+.globals     list the global variables
+.help        show this help
+.exit        exit, same as Ctrl-D
+`
+
+// Format objects and arrays as JSON, the cycles are printed as "[Circular]".
+// The stack holds the objects from the root to the holder of the current value.
+const inspectBody = `var stack = [];
+return JSON.stringify(x, function(key, value) {
+	if (typeof value == 'object' && value !== null) {
+		while (stack.length > 0 && stack[stack.length - 1] !== this) stack.pop();
+		if (stack.indexOf(value) >= 0) return '[Circular]';
+		stack.push(value);
+	}
+	return value;
+}, 2);`
+
+type repl struct {
+	cx      *js.Context
+	format  *js.Function
+	line    *liner.State
+	session []string
+}
+
+func newRepl(cx *js.Context) *repl {
+	format, _ := cx.CompileFunction("inspect", []string{"x"}, inspectBody, "inspect.js", 1)
+	return &repl{cx: cx, format: format}
+}
+
+func historyFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".monkey_history")
+}
+
+// Read lines until the input is a complete unit, evaluate it and print the result.
+func (r *repl) run() int {
+	r.line = liner.NewLiner()
+	defer r.line.Close()
+
+	r.line.SetCtrlCAborts(true)
+
+	history := historyFile()
+	if f, err := os.Open(history); err == nil {
+		r.line.ReadHistory(f)
+		f.Close()
+	}
+	defer func() {
+		if f, err := os.Create(history); err == nil {
+			r.line.WriteHistory(f)
+			f.Close()
+		}
+	}()
+
+	var input []string
+
+	for {
+		prompt := "> "
+		if len(input) > 0 {
+			prompt = "... "
+		}
+
+		text, err := r.line.Prompt(prompt)
+		if err == liner.ErrPromptAborted {
+			input = nil
+			continue
+		}
+		if err == io.EOF {
+			fmt.Println()
+			return 0
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+
+		if args := parseCommand(text); len(input) == 0 && args != nil {
+			if !r.command(args) {
+				return 0
+			}
+			r.line.AppendHistory(text)
+			continue
+		}
+
+		var code string
+		if input, code = r.feed(input, text); code == "" {
+			continue
+		}
+
+		r.line.AppendHistory(code)
+
+		if r.eval(code, "repl") {
+			r.session = append(r.session, code)
+		}
+	}
+}
+
+// The other lines which start with a dot are JavaScript, like .5 + 1
+var replCommands = map[string]bool{
+	".load":    true,
+	".save":    true,
+	".globals": true,
+	".help":    true,
+	".exit":    true,
+}
+
+// Split a line of a REPL command, nil when the line is JavaScript.
+func parseCommand(text string) []string {
+	if fields := strings.Fields(text); len(fields) > 0 && replCommands[fields[0]] {
+		return fields
+	}
+	return nil
+}
+
+// Add a line to the pending input. The code is empty until the input is a
+// complete unit, then it's the input to evaluate and nothing is pending.
+func (r *repl) feed(input []string, text string) (pending []string, code string) {
+	input = append(input, text)
+	code = strings.Join(input, "\n")
+
+	if strings.TrimSpace(code) == "" {
+		return nil, ""
+	}
+	if !r.cx.IsCompilableUnit(code) {
+		return input, ""
+	}
+	return nil, code
+}
+
+// Run a REPL command, the result is false to exit.
+func (r *repl) command(args []string) bool {
+	switch args[0] {
+	case ".exit":
+		return false
+	case ".help":
+		fmt.Print(replHelp)
+	case ".load":
+		if len(args) != 2 {
+			fmt.Fprintln(os.Stderr, "usage: .load FILE")
+			break
+		}
+		code, err := os.ReadFile(args[1])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			break
+		}
+		if r.eval(string(code), args[1]) {
+			r.session = append(r.session, string(code))
+		}
+	case ".save":
+		if len(args) != 2 {
+			fmt.Fprintln(os.Stderr, "usage: .save FILE")
+			break
+		}
+		data := strings.Join(r.session, "\n")
+		if data != "" {
+			data += "\n"
+		}
+		if err := os.WriteFile(args[1], []byte(data), 0644); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			break
+		}
+		fmt.Printf("Session saved to %s\n", args[1])
+	case ".globals":
+		keys := r.cx.GlobalObject().Keys()
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Println(key)
+		}
+	}
+	return true
+}
+
+// Evaluate the code and print the result or the error, the result is true when it succeeded.
+func (r *repl) eval(code, filename string) bool {
+	value, err := r.cx.EvalWith(code, js.EvalOptions{FileName: filename})
+	if err != nil {
+		printError(err)
+		return false
+	}
+
+	fmt.Println(r.inspect(value))
+	return true
+}
+
+// Print the location of an error report, the position in the line and the stack.
+func printError(err error) {
+	fmt.Fprintln(os.Stderr, err)
+
+	var report *js.ErrorReport
+	if !errors.As(err, &report) {
+		return
+	}
+
+	if report.LineBuf != "" {
+		fmt.Fprintln(os.Stderr, strings.TrimRight(report.LineBuf, "\n"))
+		if report.Column <= len(report.LineBuf) {
+			fmt.Fprintln(os.Stderr, strings.Repeat(" ", report.Column)+"^")
+		}
+	}
+
+	if stack := strings.TrimRight(report.Stack, "\n"); stack != "" {
+		fmt.Fprintln(os.Stderr, stack)
+	}
+}
+
+// Format a result, objects and arrays are printed as JSON.
+func (r *repl) inspect(v *js.Value) string {
+	switch {
+	case v == nil || v.IsVoid():
+		return "undefined"
+	case v.IsFunction():
+		return "[Function]"
+	case v.IsString():
+		return strconv.Quote(v.ToString())
+	case v.IsNull() || !v.IsObject():
+		return v.ToString()
+	}
+
+	// JSON.stringify can throw, e.g. by a getter or a toJSON method.
+	if r.format != nil {
+		if data, err := r.format.Call(v); err == nil && data.IsString() {
+			return data.ToString()
+		}
+	}
+	return v.ToString()
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	js "github.com/kirillDanshin/monkey"
+)
+
+func Test_ParseCommand(t *testing.T) {
+	for text, expected := range map[string][]string{
+		".load lib.js": {".load", "lib.js"},
+		"  .exit  ":    {".exit"},
+		".globals":     {".globals"},
+		".5 + 1":       nil,
+		".loader":      nil,
+		"x.load":       nil,
+		"":             nil,
+	} {
+		if args := parseCommand(text); fmt.Sprint(args) != fmt.Sprint(expected) || (args == nil) != (expected == nil) {
+			t.Fatal(text, args)
+		}
+	}
+}
+
+func Test_ReplInput(t *testing.T) {
+	r := newRepl(js.NewRuntime(8 * 1024 * 1024).NewContext())
+
+	input, code := r.feed(nil, "function twice(x) {")
+	if len(input) != 1 || code != "" {
+		t.Fatal(input, code)
+	}
+
+	input, code = r.feed(input, "  return x * 2;")
+	if len(input) != 2 || code != "" {
+		t.Fatal(input, code)
+	}
+
+	input, code = r.feed(input, "}")
+	if input != nil || code != "function twice(x) {\n  return x * 2;\n}" {
+		t.Fatal(input, code)
+	}
+
+	if input, code = r.feed(nil, "  "); input != nil || code != "" {
+		t.Fatal(input, code)
+	}
+
+	if input, code = r.feed(nil, "1 + 1"); input != nil || code != "1 + 1" {
+		t.Fatal(input, code)
+	}
+}
+
+func Test_ReplInspect(t *testing.T) {
+	cx := js.NewRuntime(8 * 1024 * 1024).NewContext()
+	r := newRepl(cx)
+
+	for code, expected := range map[string]string{
+		"undefined":              "undefined",
+		"'a\"b'":                 `"a\"b"`,
+		"1.5":                    "1.5",
+		"(function() {})":        "[Function]",
+		"({a: [1, 2]})":          "{\n  \"a\": [\n    1,\n    2\n  ]\n}",
+		"var a = {}; a.a = a; a": "{\n  \"a\": \"[Circular]\"\n}",
+	} {
+		if s := r.inspect(cx.Eval(code)); s != expected {
+			t.Fatal(code, s)
+		}
+	}
+
+	// The same object twice isn't a cycle.
+	if s := r.inspect(cx.Eval("var o = {}; [o, o]")); strings.Contains(s, "Circular") {
+		t.Fatal(s)
+	}
+}
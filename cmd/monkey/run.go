@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	js "github.com/kirillDanshin/monkey"
+)
+
+// Exit codes of run.
+const (
+	exitFailure = 1
+	exitUsage   = 2
+	exitTimeout = 124
+)
+
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// Parse a size like 1024, 64K, 64M or 1G, it must be less than 4G.
+func parseSize(s string) (uint32, error) {
+	size, unit := s, 1
+	switch {
+	case strings.HasSuffix(s, "K"):
+		unit = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		unit = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		unit = 1 << 30
+	}
+	if unit != 1 {
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil || n == 0 || n*uint64(unit) > math.MaxUint32 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return uint32(n) * uint32(unit), nil
+}
+
+// Run a script with the preloads, then run the event loop until nothing is left.
+func runCommand(args []string) int {
+	flags := flag.NewFlagSet("run", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: monkey run [flags] script.js [args...]")
+		flags.PrintDefaults()
+	}
+
+	var preloads stringList
+	flags.Var(&preloads, "preload", "run the `file` before the script, can be repeated")
+	timeout := flags.Duration("timeout", 0, "stop the script after the `duration`, 0 means no limit")
+	maxHeap := flags.String("max-heap", "64M", "the maximum `size` of the JavaScript heap")
+	debug := flags.String("debug", "", "wait for a debugger client on the `address`, the script pauses at the start")
+
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return exitUsage
+	}
+
+	if flags.NArg() < 1 {
+		flags.Usage()
+		return exitUsage
+	}
+
+	heap, err := parseSize(*maxHeap)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "monkey:", err)
+		return exitUsage
+	}
+
+	script := flags.Arg(0)
+
+	runtime := js.NewRuntime(heap)
+	cx := runtime.NewContext()
+
+	cx.InitConsole(js.ConsoleHandlerFunc(func(level js.ConsoleLevel, message string) {
+		if level >= js.ConsoleWarn {
+			fmt.Fprintln(os.Stderr, message)
+		} else {
+			fmt.Println(message)
+		}
+	}))
+	cx.InitEventLoop(nil)
+	cx.InitPromise()
+	cx.InitRequire(os.DirFS(filepath.Dir(script)))
+
+	if err := defineProcess(cx, append([]string{"monkey", script}, flags.Args()[1:]...)); err != nil {
+		fmt.Fprintln(os.Stderr, "monkey:", err)
+		return exitFailure
+	}
+
+	if *debug != "" {
+		if err := attachDebugger(cx, *debug); err != nil {
+			fmt.Fprintln(os.Stderr, "monkey:", err)
+			return exitFailure
+		}
+	}
+
+	ctx := context.Background()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+
+		timer := time.AfterFunc(*timeout, cx.Interrupt)
+		defer timer.Stop()
+	}
+
+	err = runScripts(ctx, cx, append(preloads, script))
+	if err == nil {
+		return 0
+	}
+
+	if errors.Is(err, js.ErrInterrupted) || errors.Is(err, context.DeadlineExceeded) {
+		fmt.Fprintf(os.Stderr, "monkey: timed out after %s\n", *timeout)
+		return exitTimeout
+	}
+
+	printError(err)
+	return exitFailure
+}
+
+func runScripts(ctx context.Context, cx *js.Context, files []string) error {
+	for _, file := range files {
+		code, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+
+		source := string(code)
+		if strings.HasPrefix(source, "#!") {
+			source = "//" + source
+		}
+
+		script, err := cx.CompileWith(source, js.EvalOptions{FileName: file})
+		if err != nil {
+			return err
+		}
+
+		if _, err := script.Run(); err != nil {
+			return err
+		}
+	}
+
+	return cx.RunLoop(ctx)
+}
+
+// A listener which tells when the first client is accepted.
+type notifyListener struct {
+	net.Listener
+	once     sync.Once
+	accepted chan struct{}
+}
+
+func (l *notifyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.once.Do(func() {
+			close(l.accepted)
+		})
+	}
+	return conn, err
+}
+
+// Serve the debugger on the address and wait for the first client.
+func attachDebugger(cx *js.Context, addr string) error {
+	d, err := cx.NewDebugger(nil)
+	if err != nil {
+		return err
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "monkey: waiting for a debugger client on %s\n", l.Addr())
+
+	nl := &notifyListener{Listener: l, accepted: make(chan struct{})}
+	go d.Serve(nl)
+	<-nl.accepted
+
+	d.Pause()
+	return nil
+}
+
+// Define process.argv, process.env and process.exit().
+func defineProcess(cx *js.Context, argv []string) error {
+	env := make(map[string]string)
+	for _, kv := range os.Environ() {
+		if i := strings.IndexByte(kv, '='); i > 0 {
+			env[kv[:i]] = kv[i+1:]
+		}
+	}
+
+	process := cx.NewObject(nil)
+
+	for name, v := range map[string]interface{}{"argv": argv, "env": env} {
+		value, err := cx.ValueOf(v)
+		if err != nil {
+			return err
+		}
+		process.SetProperty(name, value)
+	}
+
+	process.DefineFunction("exit", func(o *js.Object, name string, argv []*js.Value) *js.Value {
+		code := 0
+		if len(argv) > 0 {
+			n, _ := argv[0].ToInt()
+			code = int(n)
+		}
+		os.Exit(code)
+		return nil
+	})
+
+	if !cx.GlobalObject().SetObject("process", process) {
+		return errors.New("can't define process")
+	}
+	return nil
+}
@@ -12,28 +12,43 @@ import (
 type Array struct {
 	cx  *Context
 	obj *C.JSObject
+	ref *rootRef
 }
 
 // See newObject()
 func newArray(cx *Context, obj *C.JSObject) *Array {
-	result := &Array{cx, obj}
-
-	C.JS_AddObjectRoot(cx.jscx, &result.obj)
+	result := &Array{cx, obj, cx.rt.addObjectRoot(cx, obj, "array")}
 
 	runtime.SetFinalizer(result, func(a *Array) {
-		cx.rt.aryDisposeChan <- a
+		a.ref.finalize()
 	})
 
 	return result
 }
 
+// Release the array's GC root. Its methods return zero values after this.
+func (a *Array) Release() {
+	if a == nil {
+		return
+	}
+	a.ref.release()
+}
+
+func (a *Array) root() *rootRef {
+	return a.ref
+}
+
 func (a *Array) ToValue() *Value {
-	return newValue(a.cx, C.OBJECT_TO_JSVAL(a.obj))
+	var result *Value
+	a.cx.useHandle(a.ref, func() {
+		result = newValue(a.cx, C.OBJECT_TO_JSVAL(a.obj))
+	})
+	return result
 }
 
 func (a *Array) GetLength() int {
 	var result int = -1
-	a.cx.rt.Use(func() {
+	a.cx.useHandle(a.ref, func() {
 		var l C.jsuint
 		if C.JS_GetArrayLength(a.cx.jscx, a.obj, &l) == C.JS_TRUE {
 			result = int(l)
@@ -44,7 +59,7 @@ func (a *Array) GetLength() int {
 
 func (a *Array) SetLength(length int) bool {
 	var result bool
-	a.cx.rt.Use(func() {
+	a.cx.useHandle(a.ref, func() {
 		result = C.JS_SetArrayLength(a.cx.jscx, a.obj, C.jsuint(length)) == C.JS_TRUE
 	})
 	return result
@@ -52,89 +67,167 @@ func (a *Array) SetLength(length int) bool {
 
 func (a *Array) GetElement(index int) *Value {
 	var result *Value
-	a.cx.rt.Use(func() {
-		var rval C.jsval
-		if C.JS_GetElement(a.cx.jscx, a.obj, C.jsint(index), &rval) == C.JS_TRUE {
-			result = newValue(a.cx, rval)
-		}
+	a.cx.useHandle(a.ref, func() {
+		result, _ = a.getValue(index)
 	})
 	return result
 }
 
 func (a *Array) SetElement(index int, v *Value) bool {
 	var result bool
-	a.cx.rt.Use(func() {
-		result = C.JS_SetElement(a.cx.jscx, a.obj, C.jsint(index), &v.val) == C.JS_TRUE
+	a.cx.useHandle(a.ref, func() {
+		if v.live() {
+			result = a.setElement(index, v.val)
+		}
 	})
 	return result
 }
 
+// Must be called in the runtime thread. The result isn't rooted.
+func (a *Array) getElement(index int) (C.jsval, bool) {
+	var rval C.jsval
+	ok := C.JS_GetElement(a.cx.jscx, a.obj, C.jsint(index), &rval) == C.JS_TRUE
+	return rval, ok
+}
+
+// Must be called in the runtime thread. See Object.getValue().
+func (a *Array) getValue(index int) (*Value, bool) {
+	if rval, ok := a.getElement(index); ok {
+		return newValue(a.cx, rval), true
+	}
+	return nil, false
+}
+
+// Must be called in the runtime thread.
+func (a *Array) setElement(index int, val C.jsval) bool {
+	return C.JS_SetElement(a.cx.jscx, a.obj, C.jsint(index), &val) == C.JS_TRUE
+}
+
 /*
 Utilities
+Each of them takes one hop to the runtime thread.
 */
 
 func (a *Array) GetInt(index int) (int32, bool) {
-	if v := a.GetElement(index); v != nil {
-		return v.ToInt()
-	}
-	return 0, false
+	var result1 int32
+	var result2 bool
+	a.cx.useHandle(a.ref, func() {
+		if v, ok := a.getValue(index); ok {
+			defer v.ref.remove()
+			result1, result2 = a.cx.jsvalToInt(v.val)
+		}
+	})
+	return result1, result2
 }
 
 func (a *Array) SetInt(index int, v int32) bool {
-	return a.SetElement(index, a.cx.Int(v))
+	var result bool
+	a.cx.useHandle(a.ref, func() {
+		result = a.setElement(index, C.INT_TO_JSVAL(C.int32(v)))
+	})
+	return result
 }
 
 func (a *Array) GetNumber(index int) (float64, bool) {
-	if v := a.GetElement(index); v != nil {
-		return v.ToNumber()
-	}
-	return 0, false
+	var result1 float64
+	var result2 bool
+	a.cx.useHandle(a.ref, func() {
+		if v, ok := a.getValue(index); ok {
+			defer v.ref.remove()
+			result1, result2 = a.cx.jsvalToNumber(v.val)
+		}
+	})
+	return result1, result2
 }
 
 func (a *Array) SetNumber(index int, v float64) bool {
-	return a.SetElement(index, a.cx.Number(v))
+	var result bool
+	a.cx.useHandle(a.ref, func() {
+		result = a.setElement(index, C.DOUBLE_TO_JSVAL(C.jsdouble(v)))
+	})
+	return result
 }
 
 func (a *Array) GetBoolean(index int) (bool, bool) {
-	if v := a.GetElement(index); v != nil {
-		return v.ToBoolean()
-	}
-	return false, false
+	var result1 bool
+	var result2 bool
+	a.cx.useHandle(a.ref, func() {
+		if v, ok := a.getValue(index); ok {
+			defer v.ref.remove()
+			result1, result2 = a.cx.jsvalToBoolean(v.val)
+		}
+	})
+	return result1, result2
 }
 
 func (a *Array) SetBoolean(index int, v bool) bool {
-	return a.SetElement(index, a.cx.Boolean(v))
+	var result bool
+	a.cx.useHandle(a.ref, func() {
+		result = a.setElement(index, boolToJsval(v))
+	})
+	return result
 }
 
 func (a *Array) GetString(index int) (string, bool) {
-	if v := a.GetElement(index); v != nil {
-		return v.ToString(), true
-	}
-	return "", false
+	var result1 string
+	var result2 bool
+	a.cx.useHandle(a.ref, func() {
+		if v, ok := a.getValue(index); ok {
+			defer v.ref.remove()
+			result1, result2 = a.cx.jsvalToString(v.val), true
+		}
+	})
+	return result1, result2
 }
 
 func (a *Array) SetString(index int, v string) bool {
-	return a.SetElement(index, a.cx.String(v))
+	var result bool
+	a.cx.useHandle(a.ref, func() {
+		tmp := newValue(a.cx, a.cx.newString(v))
+		defer tmp.ref.remove()
+		result = a.setElement(index, tmp.val)
+	})
+	return result
 }
 
 func (a *Array) GetObject(index int) *Object {
-	if v := a.GetElement(index); v != nil {
-		return v.ToObject()
-	}
-	return nil
+	var result *Object
+	a.cx.useHandle(a.ref, func() {
+		if v, ok := a.getValue(index); ok {
+			defer v.ref.remove()
+			result = a.cx.jsvalToObject(v.val)
+		}
+	})
+	return result
 }
 
 func (a *Array) SetObject(index int, o *Object) bool {
-	return a.SetElement(index, o.ToValue())
+	var result bool
+	a.cx.useHandle(a.ref, func() {
+		if !o.ref.isReleased() {
+			result = a.setElement(index, C.OBJECT_TO_JSVAL(o.obj))
+		}
+	})
+	return result
 }
 
 func (a *Array) GetArray(index int) *Array {
-	if v := a.GetElement(index); v != nil {
-		return v.ToArray()
-	}
-	return nil
+	var result *Array
+	a.cx.useHandle(a.ref, func() {
+		if v, ok := a.getValue(index); ok {
+			defer v.ref.remove()
+			result = a.cx.jsvalToArray(v.val)
+		}
+	})
+	return result
 }
 
 func (a *Array) SetArray(index int, o *Array) bool {
-	return a.SetElement(index, o.ToValue())
+	var result bool
+	a.cx.useHandle(a.ref, func() {
+		if !o.ref.isReleased() {
+			result = a.setElement(index, C.OBJECT_TO_JSVAL(o.obj))
+		}
+	})
+	return result
 }
@@ -0,0 +1,594 @@
+package monkey
+
+/*
+#include "monkey.h"
+*/
+import "C"
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"unsafe"
+)
+
+// ErrUnsupportedType is returned when a Go value can't be converted to JavaScript.
+var ErrUnsupportedType = errors.New("monkey: unsupported type")
+
+// ErrCyclicValue is returned when a JavaScript value which refers to itself is converted to Go.
+var ErrCyclicValue = errors.New("monkey: cyclic value")
+
+// Go defined asynchronous JS function callback.
+// It runs in its own goroutine, so it can block without blocking the runtime.
+// The arguments are released after it returns, the result is converted by Context.ValueOf().
+type AsyncJsFunc func(argv []*Value) (interface{}, error)
+
+// DefineAsyncFunction defines a function which runs the callback in a new goroutine.
+// When the last argument is a function, it's called like Node.js: cb(err, result),
+// otherwise the function returns a thenable object: p.then(onResolve, onReject).
+// The results are delivered by RunLoop(), so the event loop must be initialized first.
+func (c *Context) DefineAsyncFunction(name string, callback AsyncJsFunc) bool {
+	var l *eventLoop
+
+	c.use(func() {
+		l = c.loop
+	})
+
+	if l == nil {
+		return false
+	}
+
+	return c.DefineFunction(name, func(f *Func) {
+		f.Return(c.callAsync(f.args, callback))
+	})
+}
+
+// Start an asynchronous call, must be called in the runtime thread.
+func (c *Context) callAsync(args []*Value, callback AsyncJsFunc) *Value {
+	var settle func(result interface{}, err error) error
+	var ret *Value
+
+	if n := len(args); n > 0 && args[n-1].IsFunction() {
+		cb := newPinnedValue(c, args[n-1].val)
+		args = args[:n-1]
+
+		settle = func(result interface{}, err error) error {
+			defer cb.ref.remove()
+
+			var argv []*Value
+			if err == nil {
+				var v *Value
+				if v, err = c.valueOf(result); err == nil {
+					argv = []*Value{newValue(c, C.GET_NULL()), v}
+				}
+			}
+			if err != nil {
+				argv = []*Value{c.newError(err.Error())}
+			}
+
+			_, err = c.callFunction(nil, cb.val, argv)
+			return err
+		}
+
+		ret = newValue(c, C.GET_VOID())
+	} else {
+		d, err := c.newDeferred()
+		if err != nil {
+			c.throwError(err.Error())
+			return nil
+		}
+
+		settle = d.settle
+		ret = newValue(c, d.promise.val)
+	}
+
+	pinned := make([]*Value, len(args))
+	for i, arg := range args {
+		pinned[i] = newPinnedValue(c, arg.val)
+	}
+
+	c.goAsync(func() (interface{}, error) {
+		return callback(pinned)
+	}, func(result interface{}, err error) error {
+		for _, v := range pinned {
+			v.ref.remove()
+		}
+		return settle(result, err)
+	})
+
+	return ret
+}
+
+// Run the work in a new goroutine and deliver the result by the event loop.
+// The event loop keeps running until the result delivered.
+// Must be called in the runtime thread.
+func (c *Context) goAsync(work func() (interface{}, error), deliver func(interface{}, error) error) {
+	l := c.loop
+	l.addPending(1)
+
+	go func() {
+		var result interface{}
+		var err error
+
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					err = fmt.Errorf("panic: %v", r)
+				}
+			}()
+			result, err = work()
+		}()
+
+		l.post(func() error {
+			l.addPending(-1)
+			return deliver(result, err)
+		})
+	}()
+}
+
+// Minimal thenable, settles once and calls the handlers in order.
+const deferredScript = `(function() {
+	var state = 0, value, handlers = [];
+	function run(h) {
+		var f = state == 1 ? h[0] : h[1];
+		if (typeof f == 'function') f(value);
+	}
+	function settle(s, v) {
+		if (state) return;
+		state = s;
+		value = v;
+		for (var i = 0; i < handlers.length; i++) run(handlers[i]);
+		handlers = null;
+	}
+	var promise = {
+		then: function(onResolve, onReject) {
+			if (state) run([onResolve, onReject]);
+			else handlers.push([onResolve, onReject]);
+			return promise;
+		}
+	};
+	return {
+		promise: promise,
+		resolve: function(v) { settle(1, v); },
+		reject: function(e) { settle(2, e); }
+	};
+})()`
+
+// A thenable settled from Go.
+type deferred struct {
+	cx      *Context
+	promise *Value
+	resolve *Value
+	reject  *Value
+}
+
+// Must be called in the runtime thread.
+// The thenable is a real Promise after InitPromise().
+func (c *Context) newDeferred() (*deferred, error) {
+	var v *Value
+	var err error
+
+	if c.promise != nil {
+		v, err = c.promiseHelper("deferred")
+	} else {
+		v, err = c.evaluate(deferredScript, "", 0)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer v.ref.remove()
+
+	obj := c.jsvalToObject(v.val)
+	defer obj.ref.remove()
+
+	d := &deferred{cx: c}
+
+	for name, field := range map[string]**Value{
+		"promise": &d.promise,
+		"resolve": &d.resolve,
+		"reject":  &d.reject,
+	} {
+		val, _ := obj.getProperty(name)
+		*field = newPinnedValue(c, val)
+	}
+
+	return d, nil
+}
+
+// Resolve or reject the thenable, must be called in the runtime thread.
+func (d *deferred) settle(result interface{}, err error) error {
+	c := d.cx
+
+	defer func() {
+		d.promise.ref.remove()
+		d.resolve.ref.remove()
+		d.reject.ref.remove()
+	}()
+
+	fn := d.resolve
+
+	var v *Value
+	if err == nil {
+		v, err = c.valueOf(result)
+	}
+	if err != nil {
+		fn = d.reject
+		v = c.newError(err.Error())
+	}
+
+	_, err = c.callFunction(nil, fn.val, []*Value{v})
+	return err
+}
+
+// NewChannel exposes a Go channel to JavaScript.
+// The object has recv(cb), which calls cb(value, ok) when a value received,
+// send(value[, cb]), which calls cb() when the value was delivered,
+// and close(). The operations run in their own goroutines and are delivered
+// by RunLoop(), so the event loop must be initialized first.
+// The values are converted by Context.ValueOf() and the JavaScript values are
+// converted to the element type of the channel. GetPrivate() returns the channel.
+func (c *Context) NewChannel(ch interface{}) *Object {
+	rch := reflect.ValueOf(ch)
+	if rch.Kind() != reflect.Chan {
+		return nil
+	}
+
+	var result *Object
+
+	c.use(func() {
+		if c.loop == nil {
+			return
+		}
+
+		obj := newGoObject(c, ch)
+		if obj == nil {
+			return
+		}
+
+		obj.DefineFunction("recv", func(o *Object, name string, argv []*Value) *Value {
+			if rch.Type().ChanDir()&reflect.RecvDir == 0 {
+				c.throwError("recv on send-only channel")
+				return nil
+			}
+
+			var cb *Value
+			if len(argv) > 0 && argv[0].IsFunction() {
+				cb = newPinnedValue(c, argv[0].val)
+			}
+
+			c.goAsync(func() (interface{}, error) {
+				x, ok := rch.Recv()
+				if !ok {
+					return nil, nil
+				}
+				return []interface{}{x.Interface()}, nil
+			}, func(result interface{}, _ error) error {
+				if cb == nil {
+					return nil
+				}
+				defer cb.ref.remove()
+
+				argv := []*Value{newValue(c, C.GET_VOID()), newValue(c, boolToJsval(false))}
+				if result != nil {
+					v, err := c.valueOf(result.([]interface{})[0])
+					if err != nil {
+						return err
+					}
+					argv = []*Value{v, newValue(c, boolToJsval(true))}
+				}
+
+				_, err := c.callFunction(nil, cb.val, argv)
+				return err
+			})
+
+			return newValue(c, C.GET_VOID())
+		})
+
+		obj.DefineFunction("send", func(o *Object, name string, argv []*Value) *Value {
+			if rch.Type().ChanDir()&reflect.SendDir == 0 {
+				c.throwError("send on receive-only channel")
+				return nil
+			}
+
+			var x reflect.Value
+			if len(argv) > 0 {
+				var err error
+				if x, err = c.jsvalToType(argv[0].val, rch.Type().Elem()); err != nil {
+					c.throwError(err.Error())
+					return nil
+				}
+			} else {
+				x = reflect.Zero(rch.Type().Elem())
+			}
+
+			var cb *Value
+			if len(argv) > 1 && argv[1].IsFunction() {
+				cb = newPinnedValue(c, argv[1].val)
+			}
+
+			c.goAsync(func() (interface{}, error) {
+				rch.Send(x)
+				return nil, nil
+			}, func(_ interface{}, err error) error {
+				if cb == nil {
+					return err
+				}
+				defer cb.ref.remove()
+
+				var argv []*Value
+				if err != nil {
+					argv = []*Value{c.newError(err.Error())}
+				}
+
+				_, err = c.callFunction(nil, cb.val, argv)
+				return err
+			})
+
+			return newValue(c, C.GET_VOID())
+		})
+
+		obj.DefineFunction("close", func(o *Object, name string, argv []*Value) *Value {
+			var err error
+			func() {
+				defer func() {
+					if r := recover(); r != nil {
+						err = fmt.Errorf("%v", r)
+					}
+				}()
+				rch.Close()
+			}()
+
+			if err != nil {
+				c.throwError(err.Error())
+				return nil
+			}
+
+			return newValue(c, C.GET_VOID())
+		})
+
+		result = obj
+	})
+
+	return result
+}
+
+// ValueOf converts a Go value to JavaScript.
+// Supports nil, bool, numbers, strings, errors, slices, arrays, maps with
+// string keys, and the handles (*Value, *Object, *Array and *Function) of this context.
+func (c *Context) ValueOf(v interface{}) (*Value, error) {
+	var result *Value
+	var err error
+
+	if err2 := c.use(func() {
+		result, err = c.valueOf(v)
+	}); err2 != nil {
+		return nil, err2
+	}
+
+	return result, err
+}
+
+// Must be called in the runtime thread.
+func (c *Context) valueOf(v interface{}) (*Value, error) {
+	switch x := v.(type) {
+	case nil:
+		return newValue(c, C.GET_NULL()), nil
+	case *Value:
+		return newValue(c, x.val), nil
+	case *Object:
+		return newValue(c, C.OBJECT_TO_JSVAL(x.obj)), nil
+	case *Array:
+		return newValue(c, C.OBJECT_TO_JSVAL(x.obj)), nil
+	case *Function:
+		return newValue(c, C.OBJECT_TO_JSVAL(x.obj)), nil
+	case error:
+		return c.newError(x.Error()), nil
+	}
+
+	rv := reflect.ValueOf(v)
+
+	switch rv.Kind() {
+	case reflect.Bool:
+		return newValue(c, boolToJsval(rv.Bool())), nil
+	case reflect.String:
+		return newValue(c, c.newString(rv.String())), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if i := rv.Int(); i >= math.MinInt32 && i <= math.MaxInt32 {
+			return newValue(c, C.INT_TO_JSVAL(C.int32(i))), nil
+		}
+		return newValue(c, C.DOUBLE_TO_JSVAL(C.jsdouble(rv.Int()))), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if i := rv.Uint(); i <= math.MaxInt32 {
+			return newValue(c, C.INT_TO_JSVAL(C.int32(i))), nil
+		}
+		return newValue(c, C.DOUBLE_TO_JSVAL(C.jsdouble(rv.Uint()))), nil
+	case reflect.Float32, reflect.Float64:
+		return newValue(c, C.DOUBLE_TO_JSVAL(C.jsdouble(rv.Float()))), nil
+	case reflect.Ptr, reflect.Interface:
+		if rv.IsNil() {
+			return newValue(c, C.GET_NULL()), nil
+		}
+		return c.valueOf(rv.Elem().Interface())
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice && rv.IsNil() {
+			return newValue(c, C.GET_NULL()), nil
+		}
+
+		arr := newArray(c, C.JS_NewArrayObject(c.jscx, 0, nil))
+		defer arr.ref.remove()
+
+		for i := 0; i < rv.Len(); i++ {
+			item, err := c.valueOf(rv.Index(i).Interface())
+			if err != nil {
+				return nil, err
+			}
+			arr.setElement(i, item.val)
+			item.ref.remove()
+		}
+
+		return newValue(c, C.OBJECT_TO_JSVAL(arr.obj)), nil
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			break
+		}
+		if rv.IsNil() {
+			return newValue(c, C.GET_NULL()), nil
+		}
+
+		obj := newObject(c, C.JS_NewObject(c.jscx, nil, nil, nil))
+		defer obj.ref.remove()
+
+		iter := rv.MapRange()
+		for iter.Next() {
+			item, err := c.valueOf(iter.Value().Interface())
+			if err != nil {
+				return nil, err
+			}
+			obj.setProperty(iter.Key().String(), item.val)
+			item.ref.remove()
+		}
+
+		return newValue(c, C.OBJECT_TO_JSVAL(obj.obj)), nil
+	}
+
+	return nil, fmt.Errorf("%w: %T", ErrUnsupportedType, v)
+}
+
+// Convert a JavaScript value to Go, must be called in the runtime thread.
+// Objects become map[string]interface{}, arrays become []interface{}
+// and functions are skipped.
+func (c *Context) jsvalToGo(val C.jsval) (interface{}, error) {
+	return c.jsvalToGoSeen(val, make(map[*C.JSObject]bool))
+}
+
+// The seen objects are the ones being converted, a cycle returns ErrCyclicValue.
+func (c *Context) jsvalToGoSeen(val C.jsval, seen map[*C.JSObject]bool) (interface{}, error) {
+	switch {
+	case C.JSVAL_IS_NULL(val) == C.JS_TRUE, C.JSVAL_IS_VOID(val) == C.JS_TRUE:
+		return nil, nil
+	case C.JSVAL_IS_BOOLEAN(val) == C.JS_TRUE:
+		b, _ := c.jsvalToBoolean(val)
+		return b, nil
+	case C.JSVAL_IS_INT(val) == C.JS_TRUE:
+		i, _ := c.jsvalToInt(val)
+		return i, nil
+	case C.JSVAL_IS_NUMBER(val) == C.JS_TRUE:
+		n, _ := c.jsvalToNumber(val)
+		return n, nil
+	case C.JSVAL_IS_STRING(val) == C.JS_TRUE:
+		return c.jsvalToString(val), nil
+	}
+
+	obj := C.JSVAL_TO_OBJECT(val)
+
+	if C.JS_ObjectIsFunction(c.jscx, obj) == C.JS_TRUE {
+		return nil, nil
+	}
+
+	if seen[obj] {
+		return nil, ErrCyclicValue
+	}
+	seen[obj] = true
+	defer delete(seen, obj)
+
+	if C.JS_IsArrayObject(c.jscx, obj) == C.JS_TRUE {
+		arr := newArray(c, obj)
+		defer arr.ref.remove()
+
+		var length C.jsuint
+		C.JS_GetArrayLength(c.jscx, obj, &length)
+
+		result := make([]interface{}, int(length))
+		for i := range result {
+			item, ok := arr.getValue(i)
+			if !ok {
+				continue
+			}
+			x, err := c.jsvalToGoSeen(item.val, seen)
+			item.ref.remove()
+			if err != nil {
+				return nil, err
+			}
+			result[i] = x
+		}
+		return result, nil
+	}
+
+	o := newObject(c, obj)
+	defer o.ref.remove()
+
+	result := make(map[string]interface{})
+	for _, key := range o.keys() {
+		item, ok := o.getValue(key)
+		if !ok {
+			continue
+		}
+		if C.JSVAL_IS_OBJECT(item.val) == C.JS_TRUE && C.JSVAL_IS_NULL(item.val) != C.JS_TRUE &&
+			C.JS_ObjectIsFunction(c.jscx, C.JSVAL_TO_OBJECT(item.val)) == C.JS_TRUE {
+			item.ref.remove()
+			continue
+		}
+		x, err := c.jsvalToGoSeen(item.val, seen)
+		item.ref.remove()
+		if err != nil {
+			return nil, err
+		}
+		result[key] = x
+	}
+	return result, nil
+}
+
+// Convert a JavaScript value to the Go type, must be called in the runtime thread.
+func (c *Context) jsvalToType(val C.jsval, typ reflect.Type) (reflect.Value, error) {
+	if typ == reflect.TypeOf((*Value)(nil)) {
+		return reflect.ValueOf(newValue(c, val)), nil
+	}
+
+	x, err := c.jsvalToGo(val)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	if x == nil {
+		switch typ.Kind() {
+		case reflect.Interface, reflect.Ptr, reflect.Slice, reflect.Map:
+			return reflect.Zero(typ), nil
+		}
+		return reflect.Value{}, fmt.Errorf("can't convert null to %s", typ)
+	}
+
+	rx := reflect.ValueOf(x)
+
+	switch {
+	case rx.Type().AssignableTo(typ):
+		return rx, nil
+	case isNumberKind(rx.Kind()) && isNumberKind(typ.Kind()),
+		rx.Kind() == reflect.String && typ.Kind() == reflect.String,
+		rx.Kind() == reflect.Bool && typ.Kind() == reflect.Bool:
+		return rx.Convert(typ), nil
+	}
+
+	return reflect.Value{}, fmt.Errorf("can't convert %s to %s", rx.Type(), typ)
+}
+
+func isNumberKind(k reflect.Kind) bool {
+	return k >= reflect.Int && k <= reflect.Float64
+}
+
+// Create an Error object, must be called in the runtime thread.
+func (c *Context) newError(message string) *Value {
+	if ctor, ok := c.GlobalObject().getProperty("Error"); ok {
+		if v, err := c.callFunction(nil, ctor, []*Value{newValue(c, c.newString(message))}); err == nil {
+			return v
+		}
+	}
+	return newValue(c, c.newString(message))
+}
+
+// Raise an exception in the calling script, must be called in the runtime thread.
+// The callback must return failure after this.
+func (c *Context) throwError(message string) {
+	cmessage := C.CString(message)
+	defer C.free(unsafe.Pointer(cmessage))
+
+	C.report_error(c.jscx, cmessage)
+}
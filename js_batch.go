@@ -0,0 +1,182 @@
+package monkey
+
+/*
+#include "monkey.h"
+*/
+import "C"
+
+// Batch runs many operations in one hop to the runtime thread.
+// Its methods call SpiderMonkey directly, they don't post work to the runtime.
+// A Batch is only valid in the callback of Runtime.Batch().
+type Batch struct {
+	rt *Runtime
+}
+
+// Batch executes the callback in the runtime thread.
+// Returns ErrDisposed without calling the callback when the runtime is closed.
+func (r *Runtime) Batch(callback func(b *Batch)) error {
+	return r.Use(func() {
+		callback(&Batch{r})
+	})
+}
+
+func (b *Batch) Runtime() *Runtime {
+	return b.rt
+}
+
+// A Batch which escaped its callback can't call SpiderMonkey from another thread.
+func (b *Batch) alive(cx *Context) bool {
+	return cx != nil && cx.rt == b.rt && b.rt.inThread() && !cx.isDisposed()
+}
+
+// The raw values of nil and released handles can't be used.
+func (b *Batch) aliveValue(v *Value) bool {
+	return v != nil && !v.ref.isReleased() && b.alive(v.cx)
+}
+
+func (b *Batch) aliveObject(o *Object) bool {
+	return o != nil && !o.ref.isReleased() && b.alive(o.cx)
+}
+
+func (b *Batch) aliveArray(a *Array) bool {
+	return a != nil && !a.ref.isReleased() && b.alive(a.cx)
+}
+
+func (b *Batch) aliveValues(argv []*Value) bool {
+	for _, v := range argv {
+		if !b.aliveValue(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// Get the property of an object.
+func (b *Batch) Get(o *Object, name string) *Value {
+	if !b.aliveObject(o) {
+		return nil
+	}
+	result, _ := o.getValue(name)
+	return result
+}
+
+// Set the property of an object.
+func (b *Batch) Set(o *Object, name string, v *Value) bool {
+	if !b.aliveObject(o) || !b.aliveValue(v) {
+		return false
+	}
+	return o.setProperty(name, v.val)
+}
+
+// Get the element of an array.
+func (b *Batch) GetElement(a *Array, index int) *Value {
+	if !b.aliveArray(a) {
+		return nil
+	}
+	result, _ := a.getValue(index)
+	return result
+}
+
+// Set the element of an array.
+func (b *Batch) SetElement(a *Array, index int, v *Value) bool {
+	if !b.aliveArray(a) || !b.aliveValue(v) {
+		return false
+	}
+	return a.setElement(index, v.val)
+}
+
+// Call a function value.
+func (b *Batch) Call(fn *Value, argv ...*Value) *Value {
+	if !b.aliveValue(fn) || !b.aliveValues(argv) {
+		return nil
+	}
+	result, _ := fn.cx.callFunction(nil, fn.val, argv)
+	return result
+}
+
+// Call a method of an object.
+func (b *Batch) CallMethod(o *Object, name string, argv ...*Value) *Value {
+	if !b.aliveObject(o) || !b.aliveValues(argv) {
+		return nil
+	}
+	if fn, ok := o.getValue(name); ok {
+		defer fn.ref.remove()
+		result, _ := o.cx.callFunction(o.obj, fn.val, argv)
+		return result
+	}
+	return nil
+}
+
+func (b *Batch) ToInt(v *Value) (int32, bool) {
+	if !b.aliveValue(v) {
+		return 0, false
+	}
+	return v.cx.jsvalToInt(v.val)
+}
+
+func (b *Batch) ToNumber(v *Value) (float64, bool) {
+	if !b.aliveValue(v) {
+		return 0, false
+	}
+	return v.cx.jsvalToNumber(v.val)
+}
+
+func (b *Batch) ToBoolean(v *Value) (bool, bool) {
+	if !b.aliveValue(v) {
+		return false, false
+	}
+	return v.cx.jsvalToBoolean(v.val)
+}
+
+func (b *Batch) ToString(v *Value) string {
+	if !b.aliveValue(v) {
+		return ""
+	}
+	return v.cx.jsvalToString(v.val)
+}
+
+func (b *Batch) ToObject(v *Value) *Object {
+	if !b.aliveValue(v) {
+		return nil
+	}
+	return v.cx.jsvalToObject(v.val)
+}
+
+func (b *Batch) ToArray(v *Value) *Array {
+	if !b.aliveValue(v) {
+		return nil
+	}
+	return v.cx.jsvalToArray(v.val)
+}
+
+// Warp integer
+func (b *Batch) Int(cx *Context, v int32) *Value {
+	if !b.alive(cx) {
+		return nil
+	}
+	return newValue(cx, C.INT_TO_JSVAL(C.int32(v)))
+}
+
+// Warp float
+func (b *Batch) Number(cx *Context, v float64) *Value {
+	if !b.alive(cx) {
+		return nil
+	}
+	return newValue(cx, C.DOUBLE_TO_JSVAL(C.jsdouble(v)))
+}
+
+// Warp string
+func (b *Batch) String(cx *Context, v string) *Value {
+	if !b.alive(cx) {
+		return nil
+	}
+	return newValue(cx, cx.newString(v))
+}
+
+// Warp boolean
+func (b *Batch) Boolean(cx *Context, v bool) *Value {
+	if !b.alive(cx) {
+		return nil
+	}
+	return newValue(cx, boolToJsval(v))
+}
@@ -0,0 +1,79 @@
+package monkey
+
+/*
+#include "monkey.h"
+*/
+import "C"
+import (
+	"errors"
+	"unsafe"
+)
+
+// ErrBudgetExceeded is returned when an evaluation runs more bytecodes than its budget.
+// The script can't catch it.
+var ErrBudgetExceeded = errors.New("monkey: execution budget exceeded")
+
+// Budget limits the bytecodes an evaluation runs, a zero Limit only counts them.
+// Used is the count after the evaluation, with the microtasks it queued.
+// The scripts of a budget run in the interpreter, so they're slower.
+type Budget struct {
+	Limit uint64
+	Used  uint64
+}
+
+// RunBudget executes the script within the budget.
+func (s *Script) RunBudget(b *Budget) (*Value, error) {
+	var result *Value
+	var err error
+
+	if err2 := s.cx.use(func() {
+		result, err = s.cx.metered(b, func() (*Value, error) {
+			return s.execute(s.cx)
+		})
+	}); err2 != nil {
+		return nil, err2
+	}
+
+	return result, err
+}
+
+// Count the bytecodes of the call, must be called in the runtime thread.
+// A nested budget of the context is also counted by the outer one.
+func (c *Context) metered(b *Budget, call func() (*Value, error)) (*Value, error) {
+	if b == nil {
+		return call()
+	}
+
+	cb := (*C.budget)(C.calloc(1, C.sizeof_budget))
+	defer C.free(unsafe.Pointer(cb))
+	cb.cx = c.jscx
+	cb.limit = C.uint64_t(b.Limit)
+
+	prev := C.set_budget(cb)
+	c.rt.budgets++
+	c.rt.updateInterrupt()
+
+	// The method JIT doesn't call the interrupt hook.
+	options := C.JS_GetOptions(c.jscx)
+	C.JS_SetOptions(c.jscx, options&^(C.JSOPTION_JIT|C.JSOPTION_METHODJIT))
+
+	result, err := call()
+
+	C.JS_SetOptions(c.jscx, options)
+	c.rt.budgets--
+	c.rt.updateInterrupt()
+	C.set_budget(prev)
+
+	used := uint64(cb.used)
+	if prev != nil && prev.cx == cb.cx {
+		prev.used += cb.used
+	}
+
+	if b.Limit != 0 && used > b.Limit {
+		b.Used = b.Limit
+		return nil, ErrBudgetExceeded
+	}
+
+	b.Used = used
+	return result, err
+}
@@ -0,0 +1,196 @@
+package monkey
+
+/*
+#include "monkey.h"
+*/
+import "C"
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Capabilities is a registry of host functions which require permissions,
+// like "fs.read" or "net". It can be shared by contexts of any runtime.
+type Capabilities struct {
+	mutex sync.Mutex
+	funcs map[string]capability
+	audit AuditFunc
+}
+
+type capability struct {
+	fn          JsFunc
+	permissions []string
+}
+
+// AuditEvent is a call of a host function of the capabilities.
+type AuditEvent struct {
+	Context     *Context
+	Function    string
+	Permissions []string
+
+	// Missing is the permissions which aren't granted, the call is denied when it has any.
+	Missing []string
+	Caller  StackFrame
+}
+
+// Allowed tells whether the call went to the host function.
+func (e *AuditEvent) Allowed() bool {
+	return len(e.Missing) == 0
+}
+
+// AuditFunc is called in the runtime thread before the call.
+type AuditFunc func(e *AuditEvent)
+
+func NewCapabilities() *Capabilities {
+	return &Capabilities{funcs: make(map[string]capability)}
+}
+
+// Register adds a host function which requires all the permissions,
+// the contexts initialized later get it.
+func (caps *Capabilities) Register(name string, fn JsFunc, permissions ...string) {
+	caps.mutex.Lock()
+	defer caps.mutex.Unlock()
+
+	caps.funcs[name] = capability{fn, append([]string(nil), permissions...)}
+}
+
+// SetAudit sets the callback of the calls, allowed and denied.
+func (caps *Capabilities) SetAudit(audit AuditFunc) {
+	caps.mutex.Lock()
+	defer caps.mutex.Unlock()
+
+	caps.audit = audit
+}
+
+func (caps *Capabilities) auditFunc() AuditFunc {
+	caps.mutex.Lock()
+	defer caps.mutex.Unlock()
+
+	return caps.audit
+}
+
+// SecurityError is an Error, with the location of the call of the denied function.
+const capabilityScript = `(function(global) {
+	function SecurityError(message, fileName, lineNumber) {
+		var error = new Error(message, fileName, lineNumber);
+		error.__proto__ = SecurityError.prototype;
+		return error;
+	}
+
+	SecurityError.prototype = Object.create(Error.prototype);
+	Object.defineProperty(SecurityError.prototype, 'constructor', {
+		value: SecurityError,
+		writable: true,
+		configurable: true
+	});
+	Object.defineProperty(SecurityError.prototype, 'name', {
+		value: 'SecurityError',
+		writable: true,
+		configurable: true
+	});
+
+	global.SecurityError = SecurityError;
+	return SecurityError;
+})`
+
+// InitCapabilities installs the host functions of the capabilities which the grants
+// allow. A grant allows a permission and the ones under it, "fs" allows "fs.read".
+// The other functions throw a SecurityError, so the scripts get a clear error.
+func (c *Context) InitCapabilities(caps *Capabilities, grants ...string) bool {
+	caps.mutex.Lock()
+	funcs := make(map[string]capability, len(caps.funcs))
+	for name, cp := range caps.funcs {
+		funcs[name] = cp
+	}
+	caps.mutex.Unlock()
+
+	var result bool
+
+	c.use(func() {
+		install, err := c.install(capabilityScript, "capabilities.js")
+		if err != nil {
+			return
+		}
+		securityError := newPinnedValue(c, install.val)
+		install.ref.remove()
+
+		names := make([]string, 0, len(funcs))
+		for name := range funcs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			name, cp := name, funcs[name]
+
+			var missing []string
+			for _, permission := range cp.permissions {
+				if !granted(grants, permission) {
+					missing = append(missing, permission)
+				}
+			}
+
+			ok := c.DefineFunction(name, func(f *Func) {
+				caller, _ := f.Caller()
+
+				if audit := caps.auditFunc(); audit != nil {
+					audit(&AuditEvent{
+						Context:     c,
+						Function:    name,
+						Permissions: cp.permissions,
+						Missing:     missing,
+						Caller:      caller,
+					})
+				}
+
+				if len(missing) == 0 {
+					cp.fn(f)
+					return
+				}
+
+				message := name + "() requires the permission " + strings.Join(missing, ", ")
+				c.throwSecurityError(securityError, message, caller)
+			})
+			if !ok {
+				return
+			}
+		}
+
+		result = true
+	})
+
+	return result
+}
+
+func granted(grants []string, permission string) bool {
+	for _, grant := range grants {
+		if permission == grant || strings.HasPrefix(permission, grant+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// Throw a SecurityError at the caller, must be called in the runtime thread.
+func (c *Context) throwSecurityError(securityError *Value, message string, caller StackFrame) {
+	argv := []*Value{
+		newValue(c, c.newString(message)),
+		newValue(c, c.newString(caller.File)),
+		newValue(c, C.INT_TO_JSVAL(C.int32(caller.Line))),
+	}
+	defer func() {
+		for _, v := range argv {
+			v.ref.remove()
+		}
+	}()
+
+	exn, err := c.callFunction(nil, securityError.val, argv)
+	if err != nil {
+		c.throwError(message)
+		return
+	}
+	defer exn.ref.remove()
+
+	C.JS_SetPendingException(c.jscx, exn.val)
+}
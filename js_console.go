@@ -0,0 +1,314 @@
+package monkey
+
+/*
+#include "monkey.h"
+*/
+import "C"
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// Level of a console message.
+type ConsoleLevel int
+
+const (
+	ConsoleDebug ConsoleLevel = iota
+	ConsoleLog
+	ConsoleInfo
+	ConsoleWarn
+	ConsoleError
+)
+
+func (l ConsoleLevel) String() string {
+	switch l {
+	case ConsoleDebug:
+		return "debug"
+	case ConsoleLog:
+		return "log"
+	case ConsoleInfo:
+		return "info"
+	case ConsoleWarn:
+		return "warn"
+	case ConsoleError:
+		return "error"
+	}
+	return "unknown"
+}
+
+// ConsoleHandler receives the formatted messages of console.
+// It's called in the runtime thread, so it must not block for long.
+type ConsoleHandler interface {
+	Handle(level ConsoleLevel, message string)
+}
+
+// ConsoleHandlerFunc is a function as ConsoleHandler.
+type ConsoleHandlerFunc func(level ConsoleLevel, message string)
+
+func (f ConsoleHandlerFunc) Handle(level ConsoleLevel, message string) {
+	f(level, message)
+}
+
+type consoleWriter struct {
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+// NewConsoleWriter writes every message as a line.
+func NewConsoleWriter(w io.Writer) ConsoleHandler {
+	return &consoleWriter{w: w}
+}
+
+func (cw *consoleWriter) Handle(level ConsoleLevel, message string) {
+	cw.mutex.Lock()
+	defer cw.mutex.Unlock()
+	io.WriteString(cw.w, message+"\n")
+}
+
+// The console object, it formats the messages like browsers do
+// and gives them to sink.write(level, message).
+const consoleScript = `(function(global, sink) {
+	var DEBUG = 0, LOG = 1, INFO = 2, WARN = 3, ERROR = 4;
+
+	function quote(s) {
+		return "'" + s.replace(/\\/g, '\\\\').replace(/'/g, "\\'").replace(/\n/g, '\\n') + "'";
+	}
+
+	function inspect(x, depth, seen) {
+		switch (typeof x) {
+		case 'string':
+			return quote(x);
+		case 'undefined':
+		case 'number':
+		case 'boolean':
+			return String(x);
+		case 'function':
+			return '[Function' + (x.name ? ': ' + x.name : ' (anonymous)') + ']';
+		}
+		if (x === null) return 'null';
+		if (x instanceof Error) return x.stack ? String(x) + '\n' + x.stack.replace(/\n$/, '') : String(x);
+		if (x instanceof Date) return isNaN(x) ? 'Invalid Date' : x.toISOString();
+		if (x instanceof RegExp) return String(x);
+		if (seen.indexOf(x) >= 0) return '[Circular]';
+
+		var isArray = Array.isArray(x);
+		if (depth > 2) return isArray ? '[Array]' : '[Object]';
+
+		seen.push(x);
+		var parts = [], i;
+		if (isArray) {
+			for (i = 0; i < x.length; i++) parts.push(inspect(x[i], depth + 1, seen));
+		} else {
+			var keys = Object.keys(x);
+			for (i = 0; i < keys.length; i++) {
+				var key = /^[A-Za-z_$][\w$]*$/.test(keys[i]) ? keys[i] : quote(keys[i]);
+				parts.push(key + ': ' + inspect(x[keys[i]], depth + 1, seen));
+			}
+		}
+		seen.pop();
+
+		if (parts.length == 0) return isArray ? '[]' : '{}';
+		return isArray ? '[ ' + parts.join(', ') + ' ]' : '{ ' + parts.join(', ') + ' }';
+	}
+
+	function show(x) {
+		return typeof x == 'string' ? x : inspect(x, 0, []);
+	}
+
+	function format(args) {
+		if (args.length == 0) return '';
+
+		var i = 1, out;
+		if (typeof args[0] == 'string') {
+			out = args[0].replace(/%([sdifoOjc%])/g, function(m, f) {
+				if (f == '%') return '%';
+				if (i >= args.length) return m;
+				var a = args[i++];
+				switch (f) {
+				case 's': return typeof a == 'object' && a !== null ? inspect(a, 1, []) : String(a);
+				case 'd':
+				case 'i': return typeof a == 'object' ? 'NaN' : String(parseInt(a, 10));
+				case 'f': return String(parseFloat(a));
+				case 'j': try { return JSON.stringify(a); } catch (e) { return '[Circular]'; }
+				case 'c': return '';
+				}
+				return inspect(a, 0, []);
+			});
+		} else {
+			out = show(args[0]);
+		}
+
+		for (; i < args.length; i++) out += ' ' + show(args[i]);
+		return out;
+	}
+
+	function printer(level) {
+		return function() {
+			sink.write(level, format(arguments));
+		};
+	}
+
+	function pad(s, width) {
+		var left = Math.floor((width - s.length) / 2);
+		return new Array(left + 1).join(' ') + s + new Array(width - s.length - left + 1).join(' ');
+	}
+
+	function line(widths, l, m, r) {
+		var parts = [];
+		for (var i = 0; i < widths.length; i++) parts.push(new Array(widths[i] + 3).join('─'));
+		return l + parts.join(m) + r;
+	}
+
+	function table(data, columns) {
+		if (data === null || typeof data != 'object') {
+			sink.write(LOG, format(arguments));
+			return;
+		}
+
+		var header = ['(index)'], rows = [], hasValues = false, i, j;
+		var keys = Object.keys(data);
+
+		if (columns) header = header.concat(columns);
+
+		for (i = 0; i < keys.length; i++) {
+			var v = data[keys[i]], row = {'(index)': keys[i]};
+			if (v !== null && typeof v == 'object') {
+				var cols = columns || Object.keys(v);
+				for (j = 0; j < cols.length; j++) {
+					if (!columns && header.indexOf(cols[j]) < 0) header.push(cols[j]);
+					if (cols[j] in v) row[cols[j]] = inspect(v[cols[j]], 1, []);
+				}
+			} else {
+				row.Values = inspect(v, 1, []);
+				hasValues = true;
+			}
+			rows.push(row);
+		}
+
+		if (hasValues) header.push('Values');
+
+		var widths = [];
+		for (j = 0; j < header.length; j++) {
+			widths[j] = header[j].length;
+			for (i = 0; i < rows.length; i++) {
+				var cell = rows[i][header[j]];
+				if (cell !== undefined && cell.length > widths[j]) widths[j] = cell.length;
+			}
+		}
+
+		function render(cells) {
+			var parts = [];
+			for (var j = 0; j < header.length; j++) parts.push(' ' + pad(cells[j], widths[j]) + ' ');
+			return '│' + parts.join('│') + '│';
+		}
+
+		var out = [line(widths, '┌', '┬', '┐'), render(header), line(widths, '├', '┼', '┤')];
+		for (i = 0; i < rows.length; i++) {
+			var cells = [];
+			for (j = 0; j < header.length; j++) cells.push(rows[i][header[j]] === undefined ? '' : rows[i][header[j]]);
+			out.push(render(cells));
+		}
+		out.push(line(widths, '└', '┴', '┘'));
+
+		sink.write(LOG, out.join('\n'));
+	}
+
+	var timers = {};
+
+	function elapsed(label, remove) {
+		label = label === undefined ? 'default' : String(label);
+		if (!(label in timers)) {
+			sink.write(WARN, "Timer '" + label + "' does not exist");
+			return undefined;
+		}
+		var ms = Date.now() - timers[label];
+		if (remove) delete timers[label];
+		return label + ': ' + ms + 'ms';
+	}
+
+	var console = {
+		debug: printer(DEBUG),
+		log: printer(LOG),
+		info: printer(INFO),
+		warn: printer(WARN),
+		error: printer(ERROR),
+		table: table,
+		trace: function() {
+			var stack = new Error().stack || '';
+			stack = stack.split('\n').slice(1).join('\n').replace(/\n$/, '');
+			sink.write(LOG, 'Trace' + (arguments.length ? ': ' + format(arguments) : '') + (stack ? '\n' + stack : ''));
+		},
+		assert: function(condition) {
+			if (condition) return;
+			var args = Array.prototype.slice.call(arguments, 1);
+			sink.write(ERROR, 'Assertion failed' + (args.length ? ': ' + format(args) : ''));
+		},
+		time: function(label) {
+			label = label === undefined ? 'default' : String(label);
+			if (label in timers) {
+				sink.write(WARN, "Timer '" + label + "' already exists");
+				return;
+			}
+			timers[label] = Date.now();
+		},
+		timeLog: function(label) {
+			var msg = elapsed(label, false);
+			if (msg !== undefined) {
+				var args = Array.prototype.slice.call(arguments, 1);
+				sink.write(LOG, msg + (args.length ? ' ' + format(args) : ''));
+			}
+		},
+		timeEnd: function(label) {
+			var msg = elapsed(label, true);
+			if (msg !== undefined) sink.write(LOG, msg);
+		}
+	};
+
+	global.console = console;
+})`
+
+// InitConsole installs console into the global object.
+// The messages go to the handler, nil means the standard output.
+func (c *Context) InitConsole(handler ConsoleHandler) bool {
+	if handler == nil {
+		handler = NewConsoleWriter(os.Stdout)
+	}
+
+	var result bool
+
+	c.use(func() {
+		c.console = handler
+
+		sink := newGoObject(c, nil)
+		defer sink.ref.remove()
+
+		sink.DefineFunction("write", func(o *Object, name string, argv []*Value) *Value {
+			if len(argv) == 2 && c.console != nil {
+				level, _ := c.jsvalToInt(argv[0].val)
+				c.console.Handle(ConsoleLevel(level), c.remapStack(c.jsvalToString(argv[1].val)))
+			}
+			return newValue(c, C.GET_VOID())
+		})
+
+		sinkValue := newValue(c, C.OBJECT_TO_JSVAL(sink.obj))
+		defer sinkValue.ref.remove()
+
+		v, err := c.install(consoleScript, "console.js", sinkValue)
+		if err != nil {
+			return
+		}
+		v.ref.remove()
+
+		result = true
+	})
+
+	return result
+}
+
+// SetConsoleHandler changes where the messages of console go.
+func (c *Context) SetConsoleHandler(handler ConsoleHandler) {
+	c.use(func() {
+		c.console = handler
+	})
+}
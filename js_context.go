@@ -5,8 +5,13 @@ package monkey
 */
 import "C"
 import (
+	"errors"
+	"fmt"
 	"runtime"
+	"runtime/cgo"
+	"sync"
 	"sync/atomic"
+	"time"
 	"unsafe"
 
 	"github.com/kirillDanshin/dlog"
@@ -17,11 +22,38 @@ var log = dlog.WithCaller{}
 // Context describes JavaScript context
 type Context struct {
 	rt            *Runtime
+	handle        cgo.Handle
 	jscx          *C.JSContext
 	jsglobal      *C.JSObject
 	funcs         map[string]JsFunc
+	foreign       map[*C.JSObject]*objectData
 	errorReporter ErrorReporter
-	disposed      int64
+	lastError     *ErrorReport
+	scope         *Scope
+	disposed      int32
+
+	interruptMutex sync.Mutex
+	interrupted    int32
+	exceptionStack string
+
+	loop               *eventLoop
+	microtasks         []func() error
+	drainingMicrotasks bool
+	runningLoop        bool
+	depth              int
+	promise            *Value
+	console            ConsoleHandler
+	modules            *moduleSystem
+	resolver           ModuleResolver
+	sourceMaps         map[string]attachedSourceMap
+	debugger           *Debugger
+	debugUsers         int
+	debugOptions       C.uint32
+	profiler           *profiler
+	determinism        *determinism
+	coverage           *coverage
+	sandbox            *SandboxOptions
+	trusted            int
 }
 
 // NewContext initializes JavaScript context
@@ -29,56 +61,115 @@ func (r *Runtime) NewContext() *Context {
 	var result *Context
 	log.Ln("r.use")
 	r.Use(func() {
-		log.Ln("new(context)")
-		c := new(Context)
-		log.Ln("setting runtime")
-		c.rt = r
-
-		log.Ln("setting context to C.JS_NewContext")
-		c.jscx = C.JS_NewContext(r.jsrt, 8192)
-		if c.jscx == nil {
-			return
-		}
+		result = r.newContext(&C.global_class)
+	})
+
+	return result
+}
 
-		log.Ln("setting options")
-		C.JS_SetOptions(c.jscx, C.JSOPTION_VAROBJFIX|C.JSOPTION_JIT|C.JSOPTION_METHODJIT)
-		log.Ln("setting version")
-		C.JS_SetVersion(c.jscx, C.JSVERSION_LATEST)
+// Must be called in the runtime thread.
+func (r *Runtime) newContext(class *C.JSClass) *Context {
+	log.Ln("new(context)")
+	c := new(Context)
+	log.Ln("setting runtime")
+	c.rt = r
 
-		log.Ln("setting global object")
-		c.jsglobal = C.JS_NewCompartmentAndGlobalObject(c.jscx, unsafe.Pointer(&C.global_class), nil)
+	log.Ln("setting context to C.JS_NewContext")
+	c.jscx = C.JS_NewContext(r.jsrt, 8192)
+	if c.jscx == nil {
+		return nil
+	}
 
-		log.Ln("init standard classes on new context and global object")
-		if C.JS_InitStandardClasses(c.jscx, c.jsglobal) != C.JS_TRUE {
-			log.Ln("can't init standard classes")
+	// Errors are always recorded, Eval and Execute use them as the result error.
+	C.JS_SetErrorReporter(c.jscx, C.the_error_callback)
 
-			return
-		}
+	// Uncaught exceptions are reported by takeError() with their stacks.
+	log.Ln("setting options")
+	C.JS_SetOptions(c.jscx, C.JSOPTION_VAROBJFIX|C.JSOPTION_JIT|C.JSOPTION_METHODJIT|C.JSOPTION_DONT_REPORT_UNCAUGHT)
+	log.Ln("setting version")
+	C.JS_SetVersion(c.jscx, C.JSVERSION_LATEST)
 
-		// User defined function use this to find callback.
-		log.Ln("set private context")
-		C.JS_SetContextPrivate(
-			unsafe.Pointer(c.jscx),
-			unsafe.Pointer(c),
-		)
-
-		log.Ln("set finalizer")
-		runtime.SetFinalizer(c, func(c *Context) {
-			log.Ln("calling Dispose")
-			c.Dispose()
-		})
+	log.Ln("setting global object")
+	c.jsglobal = C.JS_NewCompartmentAndGlobalObject(c.jscx, class, nil)
 
-		result = c
-	})
+	log.Ln("init standard classes on new context and global object")
+	if C.JS_InitStandardClasses(c.jscx, c.jsglobal) != C.JS_TRUE {
+		log.Ln("can't init standard classes")
 
-	return result
+		return nil
+	}
+
+	// User defined function use this to find callback.
+	log.Ln("set private context")
+	c.handle = cgo.NewHandle(c)
+	C.set_context_handle(c.jscx, C.uintptr_t(c.handle))
+	C.JS_SetOperationCallback(c.jscx, C.the_operation_callback)
+
+	// The runtime keeps the context until Dispose() or Runtime.Close().
+	r.contexts = append(r.contexts, c)
+
+	return c
 }
 
-// Dispose the context
+// Dispose the context and remove all the roots created in it.
+// Handles derived from the context return zero values after this.
 func (c *Context) Dispose() {
-	if atomic.CompareAndSwapInt64(&c.disposed, 0, 1) {
-		c.rt.ctxDisposeChan <- c
+	c.rt.Use(func() {
+		c.destroy()
+	})
+}
+
+// Must be called in the runtime thread.
+func (c *Context) destroy() {
+	if !atomic.CompareAndSwapInt32(&c.disposed, 0, 1) {
+		return
+	}
+
+	for ref := range c.rt.roots {
+		if ref.cx == c {
+			ref.remove()
+		}
 	}
+
+	c.stopProfiling()
+	if d := c.debugger; d != nil {
+		d.detach()
+	}
+	c.stopCoverage()
+
+	c.interruptMutex.Lock()
+	C.JS_DestroyContext(c.jscx)
+	c.interruptMutex.Unlock()
+	c.handle.Delete()
+
+	for i, c2 := range c.rt.contexts {
+		if c2 == c {
+			c.rt.contexts = append(c.rt.contexts[:i], c.rt.contexts[i+1:]...)
+			break
+		}
+	}
+
+	// A stepping debugger of the context kept the interrupt hook of the runtime.
+	c.rt.updateInterrupt()
+}
+
+func (c *Context) isDisposed() bool {
+	return atomic.LoadInt32(&c.disposed) == 1
+}
+
+// Executes the callback in the runtime thread if the context is still alive.
+func (c *Context) use(callback func()) error {
+	var err error
+	if err2 := c.rt.Use(func() {
+		if c.isDisposed() {
+			err = ErrDisposed
+			return
+		}
+		callback()
+	}); err2 != nil {
+		return err2
+	}
+	return err
 }
 
 type ErrorReporter func(report *ErrorReport)
@@ -99,31 +190,86 @@ type ErrorReport struct {
 	LineNum    int
 	ErrorNum   int
 	TokenIndex int
+	Column     int
 	Flags      ErrorReportFlags
+
+	// Stack of an uncaught exception.
+	Stack string
+
+	// Frames of the stack of an uncaught exception, or of the running
+	// scripts for the other reports. The innermost frame is the first.
+	Frames []StackFrame
+
+	// The column is only known for the syntax errors.
+	hasColumn bool
 }
 
+// Find the Context by the handle stored in the JSContext.
+func contextOf(h C.uintptr_t) *Context {
+	return cgo.Handle(h).Value().(*Context)
+}
+
+// ErrorReport is also an error, Eval and Execute failures are reported as it.
+func (r *ErrorReport) Error() string {
+	return fmt.Sprintf("%s:%d: %s", r.FileName, r.LineNum, r.Message)
+}
+
+// ErrSourceMapFileName is returned when a source map is given without a file name.
+var ErrSourceMapFileName = errors.New("monkey: a source map requires a file name")
+
+// ErrExecutionFailed is returned when a script failed without an error report,
+// e.g. a Go function returned no result.
+var ErrExecutionFailed = errors.New("monkey: script execution failed")
+
 //export call_error_func
-func call_error_func(c unsafe.Pointer, message *C.char, report *C.JSErrorReport) {
-	cx := (*Context)(c)
-	if cx.errorReporter != nil {
-		cx.errorReporter(&ErrorReport{
-			Context:    cx,
-			Message:    C.GoString(message),
-			FileName:   C.GoString(report.filename),
-			LineNum:    int(report.lineno),
-			ErrorNum:   int(report.errorNumber),
-			LineBuf:    C.GoString(report.linebuf),
-			TokenIndex: int(uintptr(unsafe.Pointer(report.tokenptr)) - uintptr(unsafe.Pointer(report.linebuf))),
-		})
+func call_error_func(c C.uintptr_t, message *C.char, report *C.JSErrorReport) {
+	cx := contextOf(c)
+
+	r := &ErrorReport{
+		Context:  cx,
+		Message:  C.GoString(message),
+		FileName: C.GoString(report.filename),
+		LineNum:  int(report.lineno),
+		ErrorNum: int(report.errorNumber),
+		LineBuf:  C.GoString(report.linebuf),
+		Flags:    ErrorReportFlags(report.flags),
+	}
+
+	if report.linebuf != nil && report.tokenptr != nil {
+		r.TokenIndex = int(uintptr(unsafe.Pointer(report.tokenptr)) - uintptr(unsafe.Pointer(report.linebuf)))
+		r.Column = r.TokenIndex
+		r.hasColumn = true
+	}
+
+	if r.Flags&JSREPORT_EXCEPTION != 0 {
+		r.Stack = cx.exceptionStack
+		r.Frames = parseStack(r.Stack)
+	} else {
+		r.Frames = cx.stackTrace()
+	}
+
+	cx.report(r)
+}
+
+// Record the report and give it to the error reporter, must be called in the runtime thread.
+// The location is remapped when the file has a source map.
+func (c *Context) report(r *ErrorReport) {
+	c.remapReport(r)
+
+	if r.Flags&JSREPORT_WARNING == 0 {
+		c.lastError = r
+	}
+
+	if c.errorReporter != nil {
+		c.errorReporter(r)
 	}
 }
 
 // Set a error reporter
 func (c *Context) SetErrorReporter(reporter ErrorReporter) {
-	if c.errorReporter == nil {
-		C.JS_SetErrorReporter(c.jscx, C.the_error_callback)
-	}
-	c.errorReporter = reporter
+	c.use(func() {
+		c.errorReporter = reporter
+	})
 }
 
 // Eval JavaScript
@@ -131,40 +277,202 @@ func (c *Context) SetErrorReporter(reporter ErrorReporter) {
 func (c *Context) Eval(script string) *Value {
 	var result *Value
 
-	c.rt.Use(func() {
-		cscript := C.CString(script)
-		defer C.free(unsafe.Pointer(cscript))
-
-		var rval C.jsval
-		if C.JS_EvaluateScript(c.jscx, c.jsglobal, cscript, C.uintN(len(script)), C.eval_filename, 0, &rval) == C.JS_TRUE {
-			result = newValue(c, rval)
-		}
+	c.use(func() {
+		result, _ = c.evaluate(script, "", 0)
 	})
 
 	return result
 }
 
-// Compiled Script
-type Script struct {
-	cx       *Context
-	obj      *C.JSObject
-	disposed int64
+// Options of EvalWith and CompileWith.
+type EvalOptions struct {
+	// File name of the errors and stacks.
+	FileName string
+
+	// Line number of the first line, 0 means 1.
+	Line int
+
+	// Source map of the code, the error reports and stacks of the file name
+	// are remapped to the original sources. It requires a file name.
+	SourceMap *SourceMap
+
+	// Seed of Math.random and the time of Date during the evaluation, in a
+	// deterministic context. A nil seed and a zero time keep the generator and the clock.
+	// EvalWith only.
+	Seed *int64
+	Now  time.Time
+
+	// Budget of the bytecodes of the evaluation, nil means no limit. EvalWith only.
+	Budget *Budget
 }
 
-// Free by manual
-func (s *Script) Dispose() {
-	if s == nil || s.disposed == 1 || &s.disposed == nil {
-		return
+// EvalWith evaluates JavaScript with a file name, a line number and a source map.
+// The error is the error report of the failure.
+func (c *Context) EvalWith(script string, opts EvalOptions) (*Value, error) {
+	var result *Value
+	var err error
+
+	if opts.SourceMap != nil && opts.FileName == "" {
+		return nil, ErrSourceMapFileName
+	}
+
+	if err2 := c.use(func() {
+		c.attachSourceMap(opts.FileName, opts.Line, opts.SourceMap)
+		defer c.determine(opts)()
+		result, err = c.metered(opts.Budget, func() (*Value, error) {
+			return c.evaluate(script, opts.FileName, opts.lineno())
+		})
+		c.coverSource(opts.FileName, opts.lineno(), script)
+	}); err2 != nil {
+		return nil, err2
+	}
+
+	return result, err
+}
+
+func (opts EvalOptions) lineno() int {
+	if opts.Line < 1 {
+		return 1
+	}
+	return opts.Line
+}
+
+// Must be called in the runtime thread.
+// The error is the last error report or ErrExecutionFailed.
+func (c *Context) evaluate(script, filename string, lineno int) (*Value, error) {
+	cscript := C.CString(script)
+	defer C.free(unsafe.Pointer(cscript))
+
+	cfilename := C.eval_filename
+	if filename != "" {
+		cfilename = C.CString(filename)
+		defer C.free(unsafe.Pointer(cfilename))
+	}
+
+	c.enter()
+	defer c.leave()
+
+	c.lastError = nil
+
+	var rval C.jsval
+	if C.JS_EvaluateScript(c.jscx, c.jsglobal, cscript, C.uintN(len(script)), cfilename, C.uintN(lineno), &rval) == C.JS_TRUE {
+		return newValue(c, rval), nil
+	}
+
+	return nil, c.takeError()
+}
+
+// Evaluate an installer script of the package and call it by the global object
+// and the arguments, must be called in the runtime thread. The installers can
+// define globals in sandboxes. The caller removes the roots of the arguments and the result.
+func (c *Context) install(script, filename string, argv ...*Value) (*Value, error) {
+	c.trusted++
+	defer func() {
+		c.trusted--
+	}()
+
+	fn, err := c.evaluate(script, filename, 1)
+	if err != nil {
+		return nil, err
+	}
+	defer fn.ref.remove()
+
+	global := newValue(c, C.OBJECT_TO_JSVAL(c.jsglobal))
+	defer global.ref.remove()
+
+	return c.callFunction(nil, fn.val, append([]*Value{global}, argv...))
+}
+
+// Must be called in the runtime thread, right after a failed call.
+func (c *Context) takeError() error {
+	if atomic.LoadInt32(&c.interrupted) == 1 {
+		C.JS_ClearPendingException(c.jscx)
+		c.lastError = nil
+		return ErrInterrupted
+	}
+
+	// Nested in JavaScript, the exception stays pending for the caller.
+	if C.JS_IsExceptionPending(c.jscx) == C.JS_TRUE && C.JS_IsRunning(c.jscx) != C.JS_TRUE {
+		c.reportException()
 	}
-	if _, ok := <-s.cx.rt.sptDisposeChan; !ok {
+
+	err := c.lastError
+	c.lastError = nil
+	if err == nil {
+		return ErrExecutionFailed
+	}
+	return err
+}
+
+// Report the pending exception with its stack, must be called in the runtime thread.
+func (c *Context) reportException() {
+	var exn C.jsval
+	if C.JS_GetPendingException(c.jscx, &exn) != C.JS_TRUE {
 		return
 	}
-	log.F("s: %+#v", s)
-	if atomic.CompareAndSwapInt64(&s.disposed, 0, 1) {
-		s.cx.rt.sptDisposeChan <- s
+
+	if C.JSVAL_IS_PRIMITIVE(exn) != C.JS_TRUE {
+		v := newValue(c, exn)
+		defer v.ref.remove()
+
+		C.JS_ClearPendingException(c.jscx)
+		o := &Object{cx: c, obj: C.JSVAL_TO_OBJECT(exn)}
+		if stack, ok := o.getProperty("stack"); ok && C.JSVAL_IS_STRING(stack) == C.JS_TRUE {
+			c.exceptionStack = c.jsvalToString(stack)
+		}
+		C.JS_SetPendingException(c.jscx, exn)
+	}
+
+	C.JS_ReportPendingException(c.jscx)
+	C.JS_ClearPendingException(c.jscx)
+	c.exceptionStack = ""
+}
+
+// Count the calls into JavaScript, must be called in the runtime thread.
+// An interrupt only stops the calls running when it happened.
+func (c *Context) enter() {
+	if c.depth == 0 && !c.drainingMicrotasks {
+		atomic.StoreInt32(&c.interrupted, 0)
+	}
+	c.depth++
+}
+
+// The microtasks run when the outermost call into JavaScript returns, their
+// errors were given to the error reporter already. The event loop drains them
+// itself, so RunLoop() returns their errors.
+func (c *Context) leave() {
+	c.depth--
+	if c.depth == 0 && !c.runningLoop {
+		for len(c.microtasks) > 0 && !c.drainingMicrotasks {
+			c.drainMicrotasks()
+		}
 	}
 }
 
+// Compiled Script
+type Script struct {
+	cx  *Context
+	obj *C.JSObject
+	ref *rootRef
+}
+
+// Release the script's GC root. The script can't be executed after this.
+func (s *Script) Release() {
+	if s == nil {
+		return
+	}
+	s.ref.release()
+}
+
+// Free by manual, same as Release()
+func (s *Script) Dispose() {
+	s.Release()
+}
+
+func (s *Script) root() *rootRef {
+	return s.ref
+}
+
 func (s *Script) Context() *Context {
 	return s.cx
 }
@@ -177,11 +485,8 @@ func (s *Script) Runtime() *Runtime {
 func (s *Script) Execute() *Value {
 	var result *Value
 
-	s.cx.rt.Use(func() {
-		var rval C.jsval
-		if C.JS_ExecuteScript(s.cx.jscx, s.cx.jsglobal, s.obj, &rval) == C.JS_TRUE {
-			result = newValue(s.cx, rval)
-		}
+	s.cx.use(func() {
+		result, _ = s.execute(s.cx)
 	})
 
 	return result
@@ -191,44 +496,120 @@ func (s *Script) Execute() *Value {
 func (s *Script) ExecuteIn(cx *Context) *Value {
 	var result *Value
 
-	cx.rt.Use(func() {
-		var rval C.jsval
-		if C.JS_ExecuteScript(cx.jscx, cx.jsglobal, s.obj, &rval) == C.JS_TRUE {
-			result = newValue(cx, rval)
-		}
+	cx.use(func() {
+		result, _ = s.execute(cx)
 	})
 
 	return result
 }
 
+// Run executes the script, the error is the error report of the failure.
+func (s *Script) Run() (*Value, error) {
+	var result *Value
+	var err error
+
+	if err2 := s.cx.use(func() {
+		result, err = s.execute(s.cx)
+	}); err2 != nil {
+		return nil, err2
+	}
+
+	return result, err
+}
+
+// Must be called in the runtime thread.
+func (s *Script) execute(cx *Context) (*Value, error) {
+	if s.ref.isReleased() {
+		return nil, ErrDisposed
+	}
+
+	cx.enter()
+	defer cx.leave()
+
+	cx.lastError = nil
+
+	var rval C.jsval
+	if C.JS_ExecuteScript(cx.jscx, cx.jsglobal, s.obj, &rval) == C.JS_TRUE {
+		return newValue(cx, rval), nil
+	}
+
+	return nil, cx.takeError()
+}
+
 // Compile JavaScript
 // When you need run a script many times, you can use this to avoid dynamic compile.
 func (c *Context) Compile(code, filename string, lineno int) *Script {
 	var result *Script
 
-	c.rt.Use(func() {
-		ccode := C.CString(code)
-		defer C.free(unsafe.Pointer(ccode))
+	c.use(func() {
+		result, _ = c.compile(code, filename, lineno)
+	})
 
-		cfilename := C.CString(filename)
-		defer C.free(unsafe.Pointer(cfilename))
+	return result
+}
 
-		var obj = C.JS_CompileScript(c.jscx, c.jsglobal, ccode, C.size_t(len(code)), cfilename, C.uintN(lineno))
+// CompileWith compiles JavaScript with a file name, a line number and a source map.
+// The error is the error report of the failure.
+func (c *Context) CompileWith(code string, opts EvalOptions) (*Script, error) {
+	var result *Script
+	var err error
 
-		if obj != nil {
-			script := &Script{c, obj, 0}
+	if opts.SourceMap != nil && opts.FileName == "" {
+		return nil, ErrSourceMapFileName
+	}
+
+	if err2 := c.use(func() {
+		c.attachSourceMap(opts.FileName, opts.Line, opts.SourceMap)
+		result, err = c.compile(code, opts.FileName, opts.lineno())
+	}); err2 != nil {
+		return nil, err2
+	}
 
-			C.JS_AddObjectRoot(c.jscx, &script.obj)
+	return result, err
+}
 
-			runtime.SetFinalizer(script, func(s *Script) {
-				s.Dispose()
-			})
+// Must be called in the runtime thread.
+func (c *Context) compile(code, filename string, lineno int) (*Script, error) {
+	c.lastError = nil
+	source := code
 
-			result = script
+	if c.resolver != nil {
+		var err error
+		if code, err = c.transformEntry(code, filename); err != nil {
+			r := &ErrorReport{Context: c, Message: err.Error(), FileName: filename, LineNum: lineno}
+			if serr, ok := err.(*ModuleSyntaxError); ok {
+				r.Message = "SyntaxError: " + serr.Message
+				r.LineNum = lineno + serr.Line - 1
+			}
+			c.report(r)
+			return nil, c.takeError()
 		}
+	}
+
+	ccode := C.CString(code)
+	defer C.free(unsafe.Pointer(ccode))
+
+	cfilename := C.CString(filename)
+	defer C.free(unsafe.Pointer(cfilename))
+
+	var obj = C.JS_CompileScript(c.jscx, c.jsglobal, ccode, C.size_t(len(code)), cfilename, C.uintN(lineno))
+	if obj == nil {
+		return nil, c.takeError()
+	}
+
+	c.coverSource(filename, lineno, source)
+	return c.newScript(obj), nil
+}
+
+// Root a script object, must be called in the runtime thread.
+func (c *Context) newScript(obj *C.JSObject) *Script {
+	script := &Script{c, obj, c.rt.addObjectRoot(c, obj, "script")}
+
+	runtime.SetFinalizer(script, func(s *Script) {
+		s.ref.finalize()
 	})
 
-	return result
+	return script
 }
 
 // Go defined JS function callback info
@@ -259,12 +640,21 @@ func (f *Func) Return(v *Value) {
 	f.result = v
 }
 
+// Caller returns the frame of the script which called the function,
+// false when it's called by Go. It must be called in the callback.
+func (f *Func) Caller() (StackFrame, bool) {
+	if frames := f.context.StackTrace(); len(frames) > 0 {
+		return frames[0], true
+	}
+	return StackFrame{}, false
+}
+
 // Go defined JS function callback
 type JsFunc func(f *Func)
 
 //export call_go_func
-func call_go_func(c unsafe.Pointer, name *C.char, argc C.uintN, vp *C.jsval) C.JSBool {
-	var context = (*Context)(c)
+func call_go_func(c C.uintptr_t, name *C.char, argc C.uintN, vp *C.jsval) C.JSBool {
+	var context = contextOf(c)
 
 	var args = make([]*Value, int(argc))
 
@@ -295,7 +685,7 @@ func call_go_func(c unsafe.Pointer, name *C.char, argc C.uintN, vp *C.jsval) C.J
 func (c *Context) DefineFunction(name string, callback JsFunc) bool {
 	var result bool
 
-	c.rt.Use(func() {
+	c.use(func() {
 		cname := C.CString(name)
 		defer C.free(unsafe.Pointer(cname))
 
@@ -317,7 +707,7 @@ func (c *Context) DefineFunction(name string, callback JsFunc) bool {
 
 // Retrieves a context's global object. (In JavaScript, global variables are stored as properties of the global object.)
 func (c *Context) GlobalObject() *Object {
-	return &Object{c, c.jsglobal, nil, nil, nil, nil}
+	return &Object{c, c.jsglobal, nil, nil}
 }
 
 func (c *Context) Runtime() *Runtime {
@@ -345,7 +735,7 @@ func (c *Context) Suspend() *resumer {
 // Warp null
 func (c *Context) Null() *Value {
 	var result *Value
-	c.rt.Use(func() {
+	c.use(func() {
 		result = newValue(c, C.GET_NULL())
 	})
 	return result
@@ -354,7 +744,7 @@ func (c *Context) Null() *Value {
 // Warp void
 func (c *Context) Void() *Value {
 	var result *Value
-	c.rt.Use(func() {
+	c.use(func() {
 		result = newValue(c, C.GET_VOID())
 	})
 	return result
@@ -363,7 +753,7 @@ func (c *Context) Void() *Value {
 // Warp integer
 func (c *Context) Int(v int32) *Value {
 	var result *Value
-	c.rt.Use(func() {
+	c.use(func() {
 		result = newValue(c, C.INT_TO_JSVAL(C.int32(v)))
 	})
 	return result
@@ -372,7 +762,7 @@ func (c *Context) Int(v int32) *Value {
 // Warp float
 func (c *Context) Number(v float64) *Value {
 	var result *Value
-	c.rt.Use(func() {
+	c.use(func() {
 		result = newValue(c, C.DOUBLE_TO_JSVAL(C.jsdouble(v)))
 	})
 	return result
@@ -381,11 +771,8 @@ func (c *Context) Number(v float64) *Value {
 // Warp string
 func (c *Context) String(v string) *Value {
 	var result *Value
-	c.rt.Use(func() {
-		cv := C.CString(v)
-		defer C.free(unsafe.Pointer(cv))
-
-		result = newValue(c, C.STRING_TO_JSVAL(C.JS_NewStringCopyN(c.jscx, cv, C.size_t(len(v)))))
+	c.use(func() {
+		result = newValue(c, c.newString(v))
 	})
 	return result
 }
@@ -393,20 +780,32 @@ func (c *Context) String(v string) *Value {
 // Warp boolean
 func (c *Context) Boolean(v bool) *Value {
 	var result *Value
-	c.rt.Use(func() {
-		if v {
-			result = newValue(c, C.JS_TRUE)
-		} else {
-			result = newValue(c, C.JS_FALSE)
-		}
+	c.use(func() {
+		result = newValue(c, boolToJsval(v))
 	})
 	return result
 }
 
+// Create a string value, must be called in the runtime thread.
+// The result isn't rooted.
+func (c *Context) newString(v string) C.jsval {
+	cv := C.CString(v)
+	defer C.free(unsafe.Pointer(cv))
+
+	return C.STRING_TO_JSVAL(C.JS_NewStringCopyN(c.jscx, cv, C.size_t(len(v))))
+}
+
+func boolToJsval(v bool) C.jsval {
+	if v {
+		return C.BOOLEAN_TO_JSVAL(C.JS_TRUE)
+	}
+	return C.BOOLEAN_TO_JSVAL(C.JS_FALSE)
+}
+
 // Create an empty array, like: []
 func (c *Context) NewArray() *Array {
 	var result *Array
-	c.rt.Use(func() {
+	c.use(func() {
 		result = newArray(c, C.JS_NewArrayObject(c.jscx, 0, nil))
 	})
 	return result
@@ -415,8 +814,8 @@ func (c *Context) NewArray() *Array {
 // Create an empty object, like: {}
 func (c *Context) NewObject(gval interface{}) *Object {
 	var result *Object
-	c.rt.Use(func() {
-		result = newObject(c, C.JS_NewObject(c.jscx, nil, nil, nil), gval)
+	c.use(func() {
+		result = newGoObject(c, gval)
 	})
 	return result
 }
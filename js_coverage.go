@@ -0,0 +1,349 @@
+package monkey
+
+/*
+#include "monkey.h"
+*/
+import "C"
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"sort"
+	"strings"
+)
+
+// ErrCoverage is returned by StartCoverage() when the coverage is collected already.
+var ErrCoverage = errors.New("monkey: coverage collected already")
+
+// Coverage is the executed lines of the scripts by file name.
+type Coverage struct {
+	files map[string]*fileCoverage
+}
+
+type fileCoverage struct {
+	// Hits of the lines which have code.
+	lines map[int]int64
+
+	// The source and its first line, when it's known.
+	source string
+	base   int
+}
+
+// LineCoverage is the hits of a line which has code.
+type LineCoverage struct {
+	Line int
+	Hits int64
+}
+
+type coverageLine struct {
+	file *fileCoverage
+	line int
+}
+
+// The collector of a context.
+type coverage struct {
+	cx     *Context
+	result *Coverage
+	traps  map[trapKey]coverageLine
+}
+
+// StartCoverage collects the executed lines of the scripts compiled from now on,
+// until StopCoverage() is called. Every line with code is trapped, so the scripts
+// run slower. It must not be called by a running script.
+func (c *Context) StartCoverage() error {
+	var err error
+
+	if err2 := c.use(func() {
+		if c.coverage != nil {
+			err = ErrCoverage
+			return
+		}
+
+		if !c.enterDebugMode() {
+			err = ErrDebugMode
+			return
+		}
+
+		c.coverage = &coverage{
+			cx:     c,
+			result: &Coverage{files: make(map[string]*fileCoverage)},
+			traps:  make(map[trapKey]coverageLine),
+		}
+	}); err2 != nil {
+		return err2
+	}
+
+	return err
+}
+
+// StopCoverage stops collecting and returns the coverage,
+// nil when it isn't collected.
+func (c *Context) StopCoverage() *Coverage {
+	var result *Coverage
+
+	c.use(func() {
+		result = c.stopCoverage()
+	})
+
+	return result
+}
+
+// Must be called in the runtime thread.
+func (c *Context) stopCoverage() *Coverage {
+	cov := c.coverage
+	if cov == nil {
+		return nil
+	}
+
+	c.coverage = nil
+	for key := range cov.traps {
+		c.clearTrap(key)
+	}
+	c.leaveDebugMode()
+
+	return cov.result
+}
+
+// Record the source of a covered file for the reports, must be called in the
+// runtime thread after the source is compiled.
+func (c *Context) coverSource(filename string, line int, source string) {
+	if cov := c.coverage; cov != nil {
+		if f, ok := cov.result.files[filename]; ok {
+			f.source, f.base = source, line
+		}
+	}
+}
+
+// Trap the lines of a new script, must be called in the runtime thread.
+// The scripts of Eval() without a file name are not covered.
+func (cov *coverage) addScript(script *C.JSScript) {
+	c := cov.cx
+
+	filename := C.GoString(C.JS_GetScriptFilename(c.jscx, script))
+	if filename == "" || filename == C.GoString(C.eval_filename) {
+		return
+	}
+
+	f := cov.result.file(filename)
+	base := int(C.JS_GetScriptBaseLineNumber(c.jscx, script))
+	extent := int(C.JS_GetScriptLineExtent(c.jscx, script))
+
+	for line := base; line < base+extent; line++ {
+		pc := c.linePC(script, line)
+		if pc == nil {
+			continue
+		}
+		if C.JS_SetTrap(c.jscx, script, pc, C.the_debug_trap, C.GET_VOID()) != C.JS_TRUE {
+			continue
+		}
+		cov.traps[trapKey{script, pc}] = coverageLine{f, line}
+		if _, ok := f.lines[line]; !ok {
+			f.lines[line] = 0
+		}
+	}
+}
+
+// Count a hit of a trap, must be called in the runtime thread.
+func (cov *coverage) hit(key trapKey) {
+	if l, ok := cov.traps[key]; ok {
+		l.file.lines[l.line]++
+	}
+}
+
+func (cov *Coverage) file(filename string) *fileCoverage {
+	f, ok := cov.files[filename]
+	if !ok {
+		f = &fileCoverage{lines: make(map[int]int64), base: 1}
+		cov.files[filename] = f
+	}
+	return f
+}
+
+// Files returns the covered file names in order.
+func (cov *Coverage) Files() []string {
+	result := make([]string, 0, len(cov.files))
+	for filename := range cov.files {
+		result = append(result, filename)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// Lines returns the lines of a file which have code, in order.
+func (cov *Coverage) Lines(filename string) []LineCoverage {
+	f, ok := cov.files[filename]
+	if !ok {
+		return nil
+	}
+
+	result := make([]LineCoverage, 0, len(f.lines))
+	for line, hits := range f.lines {
+		result = append(result, LineCoverage{line, hits})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Line < result[j].Line
+	})
+	return result
+}
+
+// Percent returns the percentage of the executed lines of the files,
+// all the files when none is given.
+func (cov *Coverage) Percent(filenames ...string) float64 {
+	if len(filenames) == 0 {
+		filenames = cov.Files()
+	}
+
+	var found, hit int
+	for _, filename := range filenames {
+		if f, ok := cov.files[filename]; ok {
+			found += len(f.lines)
+			hit += f.hit()
+		}
+	}
+
+	if found == 0 {
+		return 0
+	}
+	return 100 * float64(hit) / float64(found)
+}
+
+func (f *fileCoverage) hit() int {
+	n := 0
+	for _, hits := range f.lines {
+		if hits > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// WriteLCOV writes the coverage in the LCOV tracefile format, for genhtml and
+// the coverage services.
+func (cov *Coverage) WriteLCOV(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	fmt.Fprintln(bw, "TN:")
+	for _, filename := range cov.Files() {
+		lines := cov.Lines(filename)
+
+		fmt.Fprintf(bw, "SF:%s\n", filename)
+		for _, l := range lines {
+			fmt.Fprintf(bw, "DA:%d,%d\n", l.Line, l.Hits)
+		}
+		fmt.Fprintf(bw, "LF:%d\n", len(lines))
+		fmt.Fprintf(bw, "LH:%d\n", cov.files[filename].hit())
+		fmt.Fprintln(bw, "end_of_record")
+	}
+
+	return bw.Flush()
+}
+
+type htmlCoverageFile struct {
+	Name    string
+	Percent float64
+	Lines   []htmlCoverageLine
+}
+
+type htmlCoverageLine struct {
+	Line  int
+	Class string
+	Hits  int64
+	Text  string
+}
+
+// WriteHTML writes a page like the one of "go tool cover -html", the executed
+// lines are green and the others with code are red. The sources are the ones
+// given to Compile(), EvalWith(), CompileFunction() and the module loaders.
+func (cov *Coverage) WriteHTML(w io.Writer) error {
+	var files []htmlCoverageFile
+
+	for _, filename := range cov.Files() {
+		f := cov.files[filename]
+
+		var text []string
+		if f.source != "" {
+			text = strings.Split(strings.TrimSuffix(f.source, "\n"), "\n")
+		}
+
+		last := f.base + len(text) - 1
+		for line := range f.lines {
+			if line > last {
+				last = line
+			}
+		}
+
+		file := htmlCoverageFile{Name: filename, Percent: cov.Percent(filename)}
+		for line := 1; line <= last; line++ {
+			l := htmlCoverageLine{Line: line}
+			if i := line - f.base; i >= 0 && i < len(text) {
+				l.Text = text[i]
+			}
+			if hits, ok := f.lines[line]; ok {
+				l.Hits = hits
+				if hits > 0 {
+					l.Class = "cov8"
+				} else {
+					l.Class = "cov0"
+				}
+			}
+			file.Lines = append(file.Lines, l)
+		}
+
+		files = append(files, file)
+	}
+
+	return coverageTemplate.Execute(w, files)
+}
+
+var coverageTemplate = template.Must(template.New("coverage").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Coverage</title>
+<style>
+body { background: black; color: rgb(80, 80, 80); font-family: Menlo, monospace; }
+#topbar { position: fixed; top: 0; left: 0; right: 0; height: 42px; background: black; border-bottom: 1px solid rgb(80, 80, 80); padding: 8px; }
+#content { margin-top: 50px; }
+pre { margin: 0; }
+.line { display: inline-block; width: 5em; text-align: right; padding-right: 1em; color: rgb(80, 80, 80); }
+.cov0 { color: rgb(192, 0, 0); }
+.cov8 { color: rgb(44, 212, 149); }
+.legend { color: rgb(128, 128, 128); padding-left: 1em; }
+</style>
+</head>
+<body>
+<div id="topbar">
+<select id="files">
+{{range $i, $f := .}}<option value="file{{$i}}">{{$f.Name}} ({{printf "%.1f" $f.Percent}}%)</option>
+{{end}}</select>
+<span class="legend">not covered: <span class="cov0">red</span> covered: <span class="cov8">green</span></span>
+</div>
+<div id="content">
+{{range $i, $f := .}}<pre class="file" id="file{{$i}}" style="display: none">
+{{range $f.Lines}}<span class="line">{{.Line}}</span>{{if .Class}}<span class="{{.Class}}" title="{{.Hits}}">{{.Text}}</span>{{else}}{{.Text}}{{end}}
+{{end}}</pre>
+{{end}}</div>
+<script>
+(function() {
+	var files = document.getElementById('files');
+	var visible;
+	function select(id) {
+		if (visible) {
+			visible.style.display = 'none';
+		}
+		visible = document.getElementById(id);
+		if (visible) {
+			visible.style.display = 'block';
+		}
+	}
+	files.addEventListener('change', function() {
+		select(files.value);
+	});
+	select(files.value);
+})();
+</script>
+</body>
+</html>
+`))
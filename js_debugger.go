@@ -0,0 +1,658 @@
+package monkey
+
+/*
+#include "monkey.h"
+*/
+import "C"
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"unsafe"
+)
+
+// StepMode tells how a paused script goes on.
+type StepMode int
+
+const (
+	Continue StepMode = iota
+	StepIn
+	StepOver
+	StepOut
+)
+
+// Why a script paused.
+type PauseReason int
+
+const (
+	PauseBreakpoint PauseReason = iota
+	PauseStep
+)
+
+func (r PauseReason) String() string {
+	if r == PauseBreakpoint {
+		return "breakpoint"
+	}
+	return "step"
+}
+
+var (
+	// ErrDebuggerAttached is returned when the context has a debugger already.
+	ErrDebuggerAttached = errors.New("monkey: debugger attached already")
+
+	// ErrDebugMode is returned when the debug mode can't be turned on, e.g. a script is running.
+	ErrDebugMode = errors.New("monkey: can't turn on debug mode")
+
+	// ErrNotPaused is returned when the pause of a frame is over.
+	ErrNotPaused = errors.New("monkey: script not paused")
+)
+
+// DebugHandler is called in the runtime thread when a script pauses.
+// The script waits until it returns how to go on.
+type DebugHandler func(p *Pause) StepMode
+
+// Breakpoint of a line.
+type Breakpoint struct {
+	File string
+	Line int
+}
+
+// Debugger pauses the scripts of a context at breakpoints and steps.
+// Only the scripts compiled after it's attached can have breakpoints.
+type Debugger struct {
+	cx *Context
+
+	// Requests of other goroutines, applied in the runtime thread.
+	mutex        sync.Mutex
+	breakpoints  map[Breakpoint]bool
+	pauseRequest bool
+	pending      bool
+
+	handler DebugHandler
+	scripts map[*C.JSScript]*debugScript
+	traps   map[trapKey]Breakpoint
+	pause   *Pause
+
+	step       StepMode
+	stepScript *C.JSScript
+	stepLine   int
+	stepDepth  int
+
+	// The trap after a step pause at the same place is skipped.
+	skip trapKey
+}
+
+type debugScript struct {
+	file   string
+	base   int
+	extent int
+}
+
+type trapKey struct {
+	script *C.JSScript
+	pc     *C.jsbytecode
+}
+
+// NewDebugger attaches a debugger to the context, the handler can be nil and
+// set by SetHandler() later. It must not be called by a running script.
+func (c *Context) NewDebugger(handler DebugHandler) (*Debugger, error) {
+	var result *Debugger
+	var err error
+
+	if err2 := c.use(func() {
+		if c.debugger != nil {
+			err = ErrDebuggerAttached
+			return
+		}
+
+		if !c.enterDebugMode() {
+			err = ErrDebugMode
+			return
+		}
+
+		d := &Debugger{
+			cx:          c,
+			breakpoints: make(map[Breakpoint]bool),
+			handler:     handler,
+			scripts:     make(map[*C.JSScript]*debugScript),
+			traps:       make(map[trapKey]Breakpoint),
+		}
+
+		c.debugger = d
+		result = d
+	}); err2 != nil {
+		return nil, err2
+	}
+
+	return result, err
+}
+
+// Close detaches the debugger, the breakpoints are cleared.
+func (d *Debugger) Close() {
+	c := d.cx
+
+	c.use(func() {
+		if c.debugger == d {
+			d.detach()
+			c.rt.updateInterrupt()
+		}
+	})
+}
+
+// Clear the traps and leave the debug mode, must be called in the runtime thread.
+func (d *Debugger) detach() {
+	c := d.cx
+
+	c.debugger = nil
+	for key := range d.traps {
+		c.clearTrap(key)
+	}
+
+	d.step = Continue
+	c.leaveDebugMode()
+}
+
+// Turn on the debug mode for a debugger or the coverage, the false result
+// means it can't be turned on. Must be called in the runtime thread.
+func (c *Context) enterDebugMode() bool {
+	if c.debugUsers == 0 {
+		if C.JS_SetDebugMode(c.jscx, C.JS_TRUE) != C.JS_TRUE {
+			return false
+		}
+
+		// The hooks are called by the interpreter only.
+		c.debugOptions = C.JS_GetOptions(c.jscx)
+		C.JS_SetOptions(c.jscx, c.debugOptions&^(C.JSOPTION_JIT|C.JSOPTION_METHODJIT))
+
+		if !c.rt.debugHooks {
+			C.JS_SetNewScriptHook(c.rt.jsrt, C.the_new_script_hook, nil)
+			C.JS_SetDestroyScriptHook(c.rt.jsrt, C.the_destroy_script_hook, nil)
+			c.rt.debugHooks = true
+		}
+	}
+
+	c.debugUsers++
+	return true
+}
+
+// Must be called in the runtime thread.
+func (c *Context) leaveDebugMode() {
+	c.debugUsers--
+	if c.debugUsers == 0 {
+		C.JS_SetOptions(c.jscx, c.debugOptions)
+		C.JS_SetDebugMode(c.jscx, C.JS_FALSE)
+	}
+}
+
+// The pc of the code of a line, nil when the script has no code of the line.
+// Must be called in the runtime thread.
+func (c *Context) linePC(script *C.JSScript, line int) *C.jsbytecode {
+	// Other lines are mapped to the next code.
+	pc := C.JS_LineNumberToPC(c.jscx, script, C.uintN(line))
+	if pc != nil && int(C.JS_PCToLineNumber(c.jscx, script, pc)) == line {
+		return pc
+	}
+	return nil
+}
+
+// The debugger and the coverage share the traps, a trap is cleared
+// when both of them don't need it. Must be called in the runtime thread.
+func (c *Context) clearTrap(key trapKey) {
+	if d := c.debugger; d != nil {
+		if _, ok := d.traps[key]; ok {
+			return
+		}
+	}
+	if cov := c.coverage; cov != nil {
+		if _, ok := cov.traps[key]; ok {
+			return
+		}
+	}
+	C.JS_ClearTrap(c.jscx, key.script, key.pc, nil, nil)
+}
+
+// SetHandler changes the handler, nil means the scripts never pause.
+func (d *Debugger) SetHandler(handler DebugHandler) {
+	d.cx.use(func() {
+		d.handler = handler
+	})
+}
+
+// SetBreakpoint sets a breakpoint, it can be called in any goroutine,
+// even when a script is running or paused.
+func (d *Debugger) SetBreakpoint(file string, line int) {
+	d.mutex.Lock()
+	d.breakpoints[Breakpoint{file, line}] = true
+	d.pending = true
+	d.mutex.Unlock()
+
+	d.requestSync()
+}
+
+// ClearBreakpoint clears a breakpoint, it can be called in any goroutine.
+func (d *Debugger) ClearBreakpoint(file string, line int) {
+	d.mutex.Lock()
+	delete(d.breakpoints, Breakpoint{file, line})
+	d.pending = true
+	d.mutex.Unlock()
+
+	d.requestSync()
+}
+
+// Breakpoints returns the breakpoints ordered by file and line.
+func (d *Debugger) Breakpoints() []Breakpoint {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	result := make([]Breakpoint, 0, len(d.breakpoints))
+	for bp := range d.breakpoints {
+		result = append(result, bp)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].File != result[j].File {
+			return result[i].File < result[j].File
+		}
+		return result[i].Line < result[j].Line
+	})
+
+	return result
+}
+
+// Pause stops the script at the next statement, or the next script at its
+// first statement. It can be called in any goroutine.
+func (d *Debugger) Pause() {
+	d.mutex.Lock()
+	d.pauseRequest = true
+	d.pending = true
+	d.mutex.Unlock()
+
+	d.requestSync()
+}
+
+// Apply the requests now in the runtime thread, otherwise by the operation
+// callback of the running script or after it.
+func (d *Debugger) requestSync() {
+	c := d.cx
+
+	if c.rt.inThread() {
+		d.sync()
+		return
+	}
+
+	c.triggerOperationCallback()
+	c.rt.post(PriorityInteractive, func() {
+		if !c.isDisposed() {
+			d.sync()
+		}
+	})
+}
+
+func (d *Debugger) hasPending() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.pending
+}
+
+// Apply the requests, must be called in the runtime thread.
+func (d *Debugger) sync() {
+	c := d.cx
+	if c.debugger != d {
+		return
+	}
+
+	d.mutex.Lock()
+	breakpoints := make(map[Breakpoint]bool, len(d.breakpoints))
+	for bp := range d.breakpoints {
+		breakpoints[bp] = true
+	}
+	pause := d.pauseRequest
+	d.pauseRequest, d.pending = false, false
+	d.mutex.Unlock()
+
+	traps := make(map[trapKey]Breakpoint)
+	for script, info := range d.scripts {
+		for bp := range breakpoints {
+			if bp.File != info.file || bp.Line < info.base || bp.Line >= info.base+info.extent {
+				continue
+			}
+
+			if pc := c.linePC(script, bp.Line); pc != nil {
+				traps[trapKey{script, pc}] = bp
+			}
+		}
+	}
+
+	for key := range d.traps {
+		if _, ok := traps[key]; !ok {
+			delete(d.traps, key)
+			c.clearTrap(key)
+		}
+	}
+
+	for key, bp := range traps {
+		if _, ok := d.traps[key]; !ok {
+			if C.JS_SetTrap(c.jscx, key.script, key.pc, C.the_debug_trap, C.GET_VOID()) != C.JS_TRUE {
+				continue
+			}
+		}
+		d.traps[key] = bp
+	}
+
+	if pause && d.pause == nil {
+		d.step, d.stepScript = StepIn, nil
+		c.rt.updateInterrupt()
+	}
+}
+
+// The interrupt hook is set while a debugger of the runtime steps or a budget
+// is counted. Must be called in the runtime thread.
+func (r *Runtime) updateInterrupt() {
+	stepping := false
+	for _, c := range r.contexts {
+		if c.debugger != nil && c.debugger.step != Continue {
+			stepping = true
+			break
+		}
+	}
+
+	switch {
+	case stepping:
+		C.set_interrupt(r.jsrt, 1)
+	case r.budgets > 0:
+		C.set_interrupt(r.jsrt, 0)
+	default:
+		C.JS_ClearInterrupt(r.jsrt, nil, nil)
+	}
+}
+
+//export call_debug_new_script
+func call_debug_new_script(h C.uintptr_t, script *C.JSScript) {
+	c := contextOf(h)
+	if cov := c.coverage; cov != nil {
+		cov.addScript(script)
+	}
+
+	d := c.debugger
+	if d == nil {
+		return
+	}
+
+	d.scripts[script] = &debugScript{
+		file:   C.GoString(C.JS_GetScriptFilename(c.jscx, script)),
+		base:   int(C.JS_GetScriptBaseLineNumber(c.jscx, script)),
+		extent: int(C.JS_GetScriptLineExtent(c.jscx, script)),
+	}
+
+	d.mutex.Lock()
+	d.pending = true
+	d.mutex.Unlock()
+
+	d.sync()
+}
+
+//export call_debug_destroy_script
+func call_debug_destroy_script(h C.uintptr_t, script *C.JSScript) {
+	// Scripts are destroyed by the GC of any context, the engine clears their traps.
+	for _, c := range contextOf(h).rt.contexts {
+		if d := c.debugger; d != nil {
+			delete(d.scripts, script)
+			for key := range d.traps {
+				if key.script == script {
+					delete(d.traps, key)
+				}
+			}
+		}
+		if cov := c.coverage; cov != nil {
+			for key := range cov.traps {
+				if key.script == script {
+					delete(cov.traps, key)
+				}
+			}
+		}
+	}
+}
+
+//export call_debug_hook
+func call_debug_hook(h C.uintptr_t, script *C.JSScript, pc *C.jsbytecode, trap C.int) {
+	c := contextOf(h)
+	key := trapKey{script, pc}
+
+	if cov := c.coverage; cov != nil && trap != 0 {
+		cov.hit(key)
+	}
+
+	d := c.debugger
+	if d == nil || d.pause != nil {
+		return
+	}
+
+	if trap != 0 {
+		if d.skip == key {
+			d.skip = trapKey{}
+			return
+		}
+		if bp, ok := d.traps[key]; ok {
+			d.paused(PauseBreakpoint, &bp, script, pc)
+		}
+		return
+	}
+
+	if d.skip != key {
+		d.skip = trapKey{}
+	}
+
+	line := int(C.JS_PCToLineNumber(d.cx.jscx, script, pc))
+	depth := len(d.cx.scriptFrames())
+
+	var pause bool
+	switch d.step {
+	case StepIn:
+		pause = d.stepScript == nil || depth != d.stepDepth || script != d.stepScript || line != d.stepLine
+	case StepOver:
+		pause = depth < d.stepDepth || depth == d.stepDepth && (script != d.stepScript || line != d.stepLine)
+	case StepOut:
+		pause = depth < d.stepDepth
+	}
+
+	if pause {
+		d.skip = key
+		d.paused(PauseStep, nil, script, pc)
+	}
+}
+
+// Give the pause to the handler and set the step it returned.
+func (d *Debugger) paused(reason PauseReason, bp *Breakpoint, script *C.JSScript, pc *C.jsbytecode) {
+	c := d.cx
+
+	p := &Pause{d: d, Reason: reason, Breakpoint: bp}
+	p.frames = c.debugFrames(p)
+	if len(p.frames) > 0 {
+		p.File, p.Line = p.frames[0].File, p.frames[0].Line
+	}
+
+	mode := Continue
+	if d.handler != nil {
+		d.pause = p
+		mode = d.handler(p)
+		d.pause = nil
+	}
+	p.done = true
+
+	d.step = mode
+	d.stepScript = script
+	d.stepLine = int(C.JS_PCToLineNumber(c.jscx, script, pc))
+	d.stepDepth = len(p.frames)
+	c.rt.updateInterrupt()
+
+	if d.hasPending() {
+		d.sync()
+	}
+}
+
+// Pause is a paused script, it's valid until the handler returns.
+type Pause struct {
+	d          *Debugger
+	frames     []*Frame
+	done       bool
+	Reason     PauseReason
+	Breakpoint *Breakpoint
+	File       string
+	Line       int
+}
+
+// Frames returns the call stack, the first is the paused frame.
+func (p *Pause) Frames() []*Frame {
+	return p.frames
+}
+
+// EvalInFrame evaluates the code in the scope of the i-th frame.
+func (p *Pause) EvalInFrame(i int, code string) (*Value, error) {
+	if i < 0 || i >= len(p.frames) {
+		return nil, errors.New("monkey: no frame " + strconv.Itoa(i))
+	}
+	return p.frames[i].Eval(code)
+}
+
+// Frame of a paused script.
+type Frame struct {
+	p  *Pause
+	fp *C.JSStackFrame
+
+	// Function name, empty for the top level code and anonymous functions.
+	Function string
+	File     string
+	Line     int
+}
+
+// A script frame of the stack.
+type scriptFrame struct {
+	fp     *C.JSStackFrame
+	script *C.JSScript
+	pc     *C.jsbytecode
+}
+
+// The script frames from the innermost, must be called in the runtime thread.
+func (c *Context) scriptFrames() []scriptFrame {
+	var frames []scriptFrame
+	var iter *C.JSStackFrame
+
+	for fp := C.JS_FrameIterator(c.jscx, &iter); fp != nil; fp = C.JS_FrameIterator(c.jscx, &iter) {
+		if C.JS_IsScriptFrame(c.jscx, fp) != C.JS_TRUE {
+			continue
+		}
+		frames = append(frames, scriptFrame{fp, C.JS_GetFrameScript(c.jscx, fp), C.JS_GetFramePC(c.jscx, fp)})
+	}
+
+	return frames
+}
+
+// The function name, file and line of a frame, must be called in the runtime thread.
+func (c *Context) frameLocation(f scriptFrame) (function, file string, line int) {
+	if fun := C.JS_GetFrameFunction(c.jscx, f.fp); fun != nil {
+		function = c.jsstringToString(C.JS_GetFunctionId(fun))
+	}
+	file = C.GoString(C.JS_GetScriptFilename(c.jscx, f.script))
+	if f.pc != nil {
+		line = int(C.JS_PCToLineNumber(c.jscx, f.script, f.pc))
+	}
+	return
+}
+
+// Must be called in the runtime thread.
+func (c *Context) debugFrames(p *Pause) []*Frame {
+	var frames []*Frame
+	for _, f := range c.scriptFrames() {
+		function, file, line := c.frameLocation(f)
+		frames = append(frames, &Frame{p: p, fp: f.fp, Function: function, File: file, Line: line})
+	}
+	return frames
+}
+
+// Locals returns the arguments and variables of a function frame,
+// nil for the top level code, which has global variables.
+func (f *Frame) Locals() (map[string]*Value, error) {
+	c := f.p.d.cx
+
+	var result map[string]*Value
+	var err error
+
+	if err2 := c.use(func() {
+		if f.p.done {
+			err = ErrNotPaused
+			return
+		}
+
+		if C.JS_GetFrameFunction(c.jscx, f.fp) == nil {
+			return
+		}
+
+		obj := C.JS_GetFrameCallObject(c.jscx, f.fp)
+		if obj == nil {
+			return
+		}
+
+		var pda C.JSPropertyDescArray
+		if C.JS_GetPropertyDescArray(c.jscx, obj, &pda) != C.JS_TRUE {
+			err = ErrExecutionFailed
+			return
+		}
+		defer C.JS_PutPropertyDescArray(c.jscx, &pda)
+
+		result = make(map[string]*Value, int(pda.length))
+		if pda.length > 0 {
+			for _, desc := range unsafe.Slice(pda.array, int(pda.length)) {
+				result[c.jsvalToString(desc.id)] = newValue(c, desc.value)
+			}
+		}
+	}); err2 != nil {
+		return nil, err2
+	}
+
+	return result, err
+}
+
+// Eval evaluates the code in the scope of the frame.
+// The exceptions are returned as the error and don't go to the script.
+func (f *Frame) Eval(code string) (*Value, error) {
+	c := f.p.d.cx
+
+	var result *Value
+	var err error
+
+	if err2 := c.use(func() {
+		if f.p.done {
+			err = ErrNotPaused
+			return
+		}
+
+		ccode := C.CString(code)
+		defer C.free(unsafe.Pointer(ccode))
+
+		cfilename := C.CString("debugger eval")
+		defer C.free(unsafe.Pointer(cfilename))
+
+		c.lastError = nil
+
+		var rval C.jsval
+		if C.JS_EvaluateInStackFrame(c.jscx, f.fp, ccode, C.uintN(len(code)), cfilename, 1, &rval) == C.JS_TRUE {
+			result = newValue(c, rval)
+			return
+		}
+
+		// The script is running, so the exception is pending.
+		reporter := c.errorReporter
+		c.errorReporter = nil
+		if C.JS_IsExceptionPending(c.jscx) == C.JS_TRUE {
+			c.reportException()
+		}
+		c.errorReporter = reporter
+
+		err = c.takeError()
+	}); err2 != nil {
+		return nil, err2
+	}
+
+	return result, err
+}
@@ -0,0 +1,286 @@
+package monkey
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const debugHelp = `break FILE:LINE   set a breakpoint
+clear FILE:LINE   clear a breakpoint
+breakpoints       list the breakpoints
+pause             pause at the next statement
+continue, c       continue the paused script
+step, s           step in
+next, n           step over
+out, o            step out
+backtrace, bt     list the frames of the paused script
+locals [N]        list the local variables of the frame N
+eval [N] CODE     evaluate the code in the frame N
+help              show this help`
+
+// A command of the client for the paused script.
+type debugCommand struct {
+	line string
+	done chan struct{}
+}
+
+type debugClient struct {
+	conn     net.Conn
+	mutex    sync.Mutex
+	commands chan debugCommand
+	closed   chan struct{}
+}
+
+func (cl *debugClient) println(a ...interface{}) {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	fmt.Fprintln(cl.conn, a...)
+}
+
+type debugServer struct {
+	d      *Debugger
+	mutex  sync.Mutex
+	client *debugClient
+	paused bool
+}
+
+// Serve runs a debug server of a line protocol on the listener, until the
+// listener is closed. A terminal client like netcat can attach to it, one at a time.
+// It replaces the handler, the scripts don't pause without a client.
+// Send "help" for the commands, the server writes "paused REASON FILE:LINE"
+// when a script pauses, and ends the replies by "ok" or "error: MESSAGE".
+func (d *Debugger) Serve(l net.Listener) error {
+	s := &debugServer{d: d}
+	d.SetHandler(s.handle)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		s.mutex.Lock()
+		busy := s.client != nil
+		var cl *debugClient
+		if !busy {
+			cl = &debugClient{conn: conn, commands: make(chan debugCommand), closed: make(chan struct{})}
+			s.client = cl
+		}
+		s.mutex.Unlock()
+
+		if busy {
+			fmt.Fprintln(conn, "error: another client is attached")
+			conn.Close()
+			continue
+		}
+
+		go s.serve(cl)
+	}
+}
+
+// Read the commands of a client, they go to the paused script if any.
+func (s *debugServer) serve(cl *debugClient) {
+	defer func() {
+		cl.conn.Close()
+		s.mutex.Lock()
+		s.client = nil
+		s.mutex.Unlock()
+		close(cl.closed)
+	}()
+
+	cl.println("monkey debugger, send help for the commands")
+
+	scanner := bufio.NewScanner(cl.conn)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		s.mutex.Lock()
+		paused := s.paused
+		s.mutex.Unlock()
+
+		if paused {
+			cmd := debugCommand{line, make(chan struct{})}
+			cl.commands <- cmd
+			<-cmd.done
+			continue
+		}
+
+		if !s.command(cl, nil, line) {
+			cl.println("error: not paused")
+		}
+	}
+}
+
+// Wait for the commands of the client until one of them continues the script.
+func (s *debugServer) handle(p *Pause) StepMode {
+	s.mutex.Lock()
+	cl := s.client
+	s.paused = cl != nil
+	s.mutex.Unlock()
+
+	if cl == nil {
+		return Continue
+	}
+
+	cl.println("paused", p.Reason, p.File+":"+strconv.Itoa(p.Line))
+
+	for {
+		select {
+		case cmd := <-cl.commands:
+			mode, resume := s.pauseCommand(cl, p, cmd.line)
+			if resume {
+				s.mutex.Lock()
+				s.paused = false
+				s.mutex.Unlock()
+				cl.println("ok")
+			}
+			close(cmd.done)
+			if resume {
+				return mode
+			}
+		case <-cl.closed:
+			s.mutex.Lock()
+			s.paused = false
+			s.mutex.Unlock()
+			return Continue
+		}
+	}
+}
+
+// Run a command which works without a pause, the result is false for an unknown command.
+func (s *debugServer) command(cl *debugClient, p *Pause, line string) bool {
+	name, arg := splitCommand(line)
+
+	switch name {
+	case "help":
+		cl.println(debugHelp)
+		cl.println("ok")
+	case "break", "clear":
+		file, lineno, ok := parseLocation(arg)
+		if !ok {
+			cl.println("error: usage: " + name + " FILE:LINE")
+			break
+		}
+		if name == "break" {
+			s.d.SetBreakpoint(file, lineno)
+		} else {
+			s.d.ClearBreakpoint(file, lineno)
+		}
+		cl.println("ok")
+	case "breakpoints":
+		for _, bp := range s.d.Breakpoints() {
+			cl.println(bp.File + ":" + strconv.Itoa(bp.Line))
+		}
+		cl.println("ok")
+	case "pause":
+		if p == nil {
+			s.d.Pause()
+		}
+		cl.println("ok")
+	default:
+		return false
+	}
+	return true
+}
+
+// Run a command of a paused script, resume tells whether the script goes on.
+func (s *debugServer) pauseCommand(cl *debugClient, p *Pause, line string) (mode StepMode, resume bool) {
+	name, arg := splitCommand(line)
+
+	switch name {
+	case "continue", "c":
+		return Continue, true
+	case "step", "s":
+		return StepIn, true
+	case "next", "n":
+		return StepOver, true
+	case "out", "o":
+		return StepOut, true
+	case "backtrace", "bt":
+		for i, f := range p.Frames() {
+			function := f.Function
+			if function == "" {
+				function = "(anonymous)"
+			}
+			cl.println(fmt.Sprintf("#%d %s %s:%d", i, function, f.File, f.Line))
+		}
+		cl.println("ok")
+	case "locals":
+		i, _ := strconv.Atoi(arg)
+		if i < 0 || i >= len(p.Frames()) {
+			cl.println("error: no frame " + arg)
+			break
+		}
+		locals, err := p.Frames()[i].Locals()
+		if err != nil {
+			cl.println("error: " + err.Error())
+			break
+		}
+		names := make([]string, 0, len(locals))
+		for name := range locals {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			cl.println(name + " = " + debugString(locals[name]))
+		}
+		cl.println("ok")
+	case "eval":
+		i := 0
+		if first, rest := splitCommand(arg); first != "" {
+			if n, err := strconv.Atoi(first); err == nil {
+				i, arg = n, rest
+			}
+		}
+		v, err := p.EvalInFrame(i, arg)
+		if err != nil {
+			cl.println("error: " + strings.ReplaceAll(err.Error(), "\n", " "))
+			break
+		}
+		cl.println(debugString(v))
+		cl.println("ok")
+	default:
+		if !s.command(cl, p, line) {
+			cl.println("error: unknown command " + name)
+		}
+	}
+
+	return Continue, false
+}
+
+func splitCommand(line string) (string, string) {
+	line = strings.TrimSpace(line)
+	if i := strings.IndexAny(line, " \t"); i >= 0 {
+		return line[:i], strings.TrimSpace(line[i+1:])
+	}
+	return line, ""
+}
+
+// Parse FILE:LINE, the file can have colons.
+func parseLocation(s string) (string, int, bool) {
+	i := strings.LastIndexByte(s, ':')
+	if i <= 0 {
+		return "", 0, false
+	}
+	line, err := strconv.Atoi(s[i+1:])
+	if err != nil || line < 1 {
+		return "", 0, false
+	}
+	return s[:i], line, true
+}
+
+// A value in one line, strings are quoted.
+func debugString(v *Value) string {
+	if v.IsString() {
+		return strconv.Quote(v.ToString())
+	}
+	return strings.ReplaceAll(v.ToString(), "\n", " ")
+}
@@ -0,0 +1,154 @@
+package monkey
+
+/*
+#include "monkey.h"
+*/
+import "C"
+import (
+	"math/rand"
+	"time"
+)
+
+// Math.random and Date read the generator and the clock of Go.
+const determinismScript = `(function(global, host) {
+	Math.random = function random() {
+		return host.random();
+	};
+
+	var NativeDate = global.Date;
+	if (typeof NativeDate != 'function') {
+		return;
+	}
+
+	function now() {
+		return host.now();
+	}
+
+	var bind = Function.prototype.bind;
+
+	function Date() {
+		if (!(this instanceof Date)) {
+			return new NativeDate(now()).toString();
+		}
+		if (arguments.length == 0) {
+			return new NativeDate(now());
+		}
+		var args = [null];
+		for (var i = 0; i < arguments.length; i++) {
+			args.push(arguments[i]);
+		}
+		return new (bind.apply(NativeDate, args))();
+	}
+
+	Date.prototype = NativeDate.prototype;
+	Date.now = now;
+	Date.parse = NativeDate.parse;
+	Date.UTC = NativeDate.UTC;
+	Object.defineProperty(NativeDate.prototype, 'constructor', {
+		value: Date,
+		writable: true,
+		configurable: true
+	});
+
+	global.Date = Date;
+})`
+
+// The generator and the clock of a deterministic context.
+type determinism struct {
+	rand  *rand.Rand
+	clock Clock
+
+	// The time of an evaluation, zero means the clock.
+	now time.Time
+}
+
+// EnableDeterminism makes the results of the scripts reproducible: Math.random
+// is a generator seeded by the seed, Date.now() and new Date() read the clock.
+// A nil clock is a FakeClock at the Unix epoch, which only moves by Advance().
+// The engine enumerates the properties in the order they're defined, so the
+// iteration order of objects is stable already. The local time zone of the
+// process still affects the local time methods of Date.
+func (c *Context) EnableDeterminism(seed int64, clock Clock) bool {
+	if clock == nil {
+		clock = NewFakeClock(time.Unix(0, 0))
+	}
+
+	var result bool
+
+	c.use(func() {
+		if c.determinism != nil {
+			c.determinism.rand.Seed(seed)
+			c.determinism.clock = clock
+			result = true
+			return
+		}
+
+		d := &determinism{
+			rand:  rand.New(rand.NewSource(seed)),
+			clock: clock,
+		}
+
+		host := newGoObject(c, nil)
+		defer host.ref.remove()
+
+		host.DefineFunction("random", func(o *Object, name string, argv []*Value) *Value {
+			return newValue(c, C.DOUBLE_TO_JSVAL(C.jsdouble(d.rand.Float64())))
+		})
+		host.DefineFunction("now", func(o *Object, name string, argv []*Value) *Value {
+			ms := float64(d.time().UnixNano()) / float64(time.Millisecond)
+			return newValue(c, C.DOUBLE_TO_JSVAL(C.jsdouble(ms)))
+		})
+
+		hostValue := newValue(c, C.OBJECT_TO_JSVAL(host.obj))
+		defer hostValue.ref.remove()
+
+		v, err := c.install(determinismScript, "determinism.js", hostValue)
+		if err != nil {
+			return
+		}
+		v.ref.remove()
+
+		c.determinism = d
+		result = true
+	})
+
+	return result
+}
+
+// SetSeed seeds Math.random of a deterministic context again.
+func (c *Context) SetSeed(seed int64) {
+	c.use(func() {
+		if d := c.determinism; d != nil {
+			d.rand.Seed(seed)
+		}
+	})
+}
+
+func (d *determinism) time() time.Time {
+	if !d.now.IsZero() {
+		return d.now
+	}
+	return d.clock.Now()
+}
+
+// Apply the seed and the time of an evaluation, the result restores the time.
+// Must be called in the runtime thread.
+func (c *Context) determine(opts EvalOptions) func() {
+	d := c.determinism
+	if d == nil {
+		return func() {}
+	}
+
+	if opts.Seed != nil {
+		d.rand.Seed(*opts.Seed)
+	}
+
+	now := d.now
+	if !opts.Now.IsZero() {
+		d.now = opts.Now
+	}
+
+	return func() {
+		d.now = now
+	}
+}
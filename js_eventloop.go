@@ -0,0 +1,517 @@
+package monkey
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// ErrNoEventLoop is returned by RunLoop when the context has no event loop.
+var ErrNoEventLoop = errors.New("monkey: event loop not initialized")
+
+// Clock is the time source of an event loop.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// SystemClock is the wall clock.
+var SystemClock Clock = systemClock{}
+
+// FakeClock is a deterministic clock for tests.
+// Its time only moves by Advance(), or by waiting on it when AutoAdvance is set.
+// Set AutoAdvance before the clock is used.
+type FakeClock struct {
+	// Jump to the deadline instead of waiting for it, so timers fire at once
+	// in virtual time.
+	AutoAdvance bool
+
+	mutex   sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	when time.Time
+	ch   chan time.Time
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	ch := make(chan time.Time, 1)
+	when := c.now.Add(d)
+
+	if c.AutoAdvance && when.After(c.now) {
+		c.now = when
+	}
+
+	c.waiters = append(c.waiters, fakeWaiter{when, ch})
+	c.fire()
+
+	return ch
+}
+
+// Advance moves the time forward and fires the due waiters.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.now = c.now.Add(d)
+	c.fire()
+}
+
+func (c *FakeClock) fire() {
+	waiters := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.when.After(c.now) {
+			waiters = append(waiters, w)
+		} else {
+			w.ch <- c.now
+		}
+	}
+	c.waiters = waiters
+}
+
+type timer struct {
+	id        int
+	when      time.Time
+	interval  time.Duration
+	repeat    bool
+	immediate bool
+	fn        *Value
+	args      []*Value
+	seq       uint64
+	index     int
+}
+
+// Timers ordered by deadline, then by creation.
+type timerHeap []*timer
+
+func (h timerHeap) Len() int {
+	return len(h)
+}
+
+func (h timerHeap) Less(i, j int) bool {
+	if h[i].when.Equal(h[j].when) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].when.Before(h[j].when)
+}
+
+func (h timerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *timerHeap) Push(x interface{}) {
+	t := x.(*timer)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *timerHeap) Pop() interface{} {
+	old := *h
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	t.index = -1
+	return t
+}
+
+// eventLoop of a context.
+// The timers are only touched in the runtime thread,
+// the tasks and the pending counter are shared with other goroutines.
+type eventLoop struct {
+	cx         *Context
+	clock      Clock
+	timers     timerHeap
+	immediates []*timer
+	byID       map[int]*timer
+	nextID     int
+	seq        uint64
+
+	mutex   sync.Mutex
+	tasks   []func() error
+	pending int
+	wake    chan struct{}
+}
+
+// InitEventLoop installs setTimeout, setInterval, setImmediate, their clear
+// functions and queueMicrotask into the global object.
+// The timers only fire in RunLoop(). A nil clock means SystemClock.
+func (c *Context) InitEventLoop(clock Clock) bool {
+	if clock == nil {
+		clock = SystemClock
+	}
+
+	var result bool
+
+	c.use(func() {
+		if c.loop != nil {
+			result = true
+			return
+		}
+
+		l := &eventLoop{
+			cx:    c,
+			clock: clock,
+			byID:  make(map[int]*timer),
+			wake:  make(chan struct{}, 1),
+		}
+
+		result = c.DefineFunction("setTimeout", func(f *Func) {
+			f.Return(l.add(f, false, false))
+		}) && c.DefineFunction("setInterval", func(f *Func) {
+			f.Return(l.add(f, true, false))
+		}) && c.DefineFunction("setImmediate", func(f *Func) {
+			f.Return(l.add(f, false, true))
+		}) && c.DefineFunction("clearTimeout", l.jsClear) &&
+			c.DefineFunction("clearInterval", l.jsClear) &&
+			c.DefineFunction("clearImmediate", l.jsClear) &&
+			c.defineQueueMicrotask()
+
+		if result {
+			c.loop = l
+		}
+	})
+
+	return result
+}
+
+// Add a timer, must be called in the runtime thread.
+func (l *eventLoop) add(f *Func, repeat, immediate bool) *Value {
+	c := l.cx
+
+	if f.Argc() == 0 {
+		return c.Void()
+	}
+
+	if f.Argv(0).IsString() && c.sandbox != nil && !c.sandbox.AllowDynamicCode {
+		c.throwError("sandbox: can't compile strings")
+		return nil
+	}
+
+	args := f.args[1:]
+
+	var delay time.Duration
+	if !immediate && f.Argc() > 1 {
+		if ms, ok := f.Argv(1).ToNumber(); ok && !math.IsNaN(ms) && ms > 0 {
+			delay = time.Duration(ms * float64(time.Millisecond))
+		}
+		args = f.args[2:]
+	}
+
+	// Same as browsers, the minimal delay is 1ms.
+	if !immediate && delay < time.Millisecond {
+		delay = time.Millisecond
+	}
+
+	l.nextID++
+	l.seq++
+
+	t := &timer{
+		id:        l.nextID,
+		when:      l.clock.Now().Add(delay),
+		interval:  delay,
+		repeat:    repeat,
+		immediate: immediate,
+		fn:        newPinnedValue(c, f.Argv(0).val),
+		seq:       l.seq,
+	}
+
+	for _, arg := range args {
+		t.args = append(t.args, newPinnedValue(c, arg.val))
+	}
+
+	l.byID[t.id] = t
+
+	if immediate {
+		l.immediates = append(l.immediates, t)
+	} else {
+		heap.Push(&l.timers, t)
+	}
+
+	return c.Int(int32(t.id))
+}
+
+func (l *eventLoop) jsClear(f *Func) {
+	if f.Argc() > 0 {
+		if id, ok := f.Argv(0).ToInt(); ok {
+			if t, ok := l.byID[int(id)]; ok {
+				if t.index >= 0 && !t.immediate {
+					heap.Remove(&l.timers, t.index)
+				}
+				l.remove(t)
+			}
+		}
+	}
+	f.Return(f.Context().Void())
+}
+
+func (l *eventLoop) remove(t *timer) {
+	delete(l.byID, t.id)
+	t.fn.ref.remove()
+	for _, arg := range t.args {
+		arg.ref.remove()
+	}
+}
+
+// Fire a timer, must be called in the runtime thread.
+func (l *eventLoop) fire(t *timer) error {
+	c := l.cx
+
+	var err error
+	if t.fn.IsString() {
+		_, err = c.evaluate(c.jsvalToString(t.fn.val), "", 0)
+	} else {
+		_, err = c.callFunction(nil, t.fn.val, t.args)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return c.drainMicrotasks()
+}
+
+// Run everything ready, must be called in the runtime thread.
+func (l *eventLoop) runOnce() error {
+	// The microtasks queued by the scripts evaluated out of the loop.
+	if err := l.cx.drainMicrotasks(); err != nil {
+		return err
+	}
+
+	l.mutex.Lock()
+	tasks := l.tasks
+	l.tasks = nil
+	l.mutex.Unlock()
+
+	for _, task := range tasks {
+		if err := task(); err != nil {
+			return err
+		}
+		if err := l.cx.drainMicrotasks(); err != nil {
+			return err
+		}
+	}
+
+	// Immediates added by the immediates run in the next round.
+	immediates := l.immediates
+	l.immediates = nil
+
+	for _, t := range immediates {
+		if _, ok := l.byID[t.id]; !ok {
+			continue
+		}
+		delete(l.byID, t.id)
+		err := l.fire(t)
+		l.remove(t)
+		if err != nil {
+			return err
+		}
+	}
+
+	now := l.clock.Now()
+
+	for len(l.timers) > 0 && !l.timers[0].when.After(now) {
+		t := heap.Pop(&l.timers).(*timer)
+
+		if !t.repeat {
+			delete(l.byID, t.id)
+		}
+
+		err := l.fire(t)
+
+		if _, ok := l.byID[t.id]; ok && t.repeat {
+			l.seq++
+			t.when = t.when.Add(t.interval)
+			if t.when.Before(now) {
+				t.when = now.Add(t.interval)
+			}
+			t.seq = l.seq
+			heap.Push(&l.timers, t)
+		} else {
+			l.remove(t)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Post a task from any goroutine, it runs in RunLoop().
+func (l *eventLoop) post(task func() error) {
+	l.mutex.Lock()
+	l.tasks = append(l.tasks, task)
+	l.mutex.Unlock()
+	l.notify()
+}
+
+// Count the asynchronous operations which will post tasks later.
+// RunLoop() doesn't return while there are pending operations.
+func (l *eventLoop) addPending(delta int) {
+	l.mutex.Lock()
+	l.pending += delta
+	l.mutex.Unlock()
+	l.notify()
+}
+
+func (l *eventLoop) notify() {
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (l *eventLoop) hasPending() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.pending > 0 || len(l.tasks) > 0
+}
+
+// RunLoop runs the timers, immediates and microtasks until nothing is left
+// or ctx is done. Returns the first error of the callbacks, ctx.Err() when
+// cancelled, the loop can be run again after that.
+func (c *Context) RunLoop(ctx context.Context) error {
+	var l *eventLoop
+
+	if err := c.use(func() {
+		l = c.loop
+	}); err != nil {
+		return err
+	}
+
+	if l == nil {
+		return ErrNoEventLoop
+	}
+
+	for {
+		var runErr error
+		var next time.Time
+		var hasTimer, busy bool
+
+		if err := c.use(func() {
+			running := c.runningLoop
+			c.runningLoop = true
+			defer func() {
+				c.runningLoop = running
+			}()
+
+			if runErr = l.runOnce(); runErr == nil {
+				runErr = c.drainMicrotasks()
+			}
+			if hasTimer = len(l.timers) > 0; hasTimer {
+				next = l.timers[0].when
+			}
+			busy = len(l.immediates) > 0
+		}); err != nil {
+			return err
+		}
+
+		if runErr != nil {
+			return runErr
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if busy {
+			continue
+		}
+
+		if !hasTimer && !l.hasPending() {
+			return nil
+		}
+
+		var timeout <-chan time.Time
+		if hasTimer {
+			timeout = l.clock.After(next.Sub(l.clock.Now()))
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-l.wake:
+		case <-timeout:
+		}
+	}
+}
+
+// Define queueMicrotask() once, must be called in the runtime thread.
+func (c *Context) defineQueueMicrotask() bool {
+	if _, ok := c.funcs["queueMicrotask"]; ok {
+		return true
+	}
+
+	return c.DefineFunction("queueMicrotask", func(f *Func) {
+		if f.Argc() > 0 && f.Argv(0).IsFunction() {
+			fn := newPinnedValue(c, f.Argv(0).val)
+			c.enqueueMicrotask(func() error {
+				defer fn.ref.remove()
+				_, err := c.callFunction(nil, fn.val, nil)
+				return err
+			})
+		}
+		f.Return(c.Void())
+	})
+}
+
+// Queue a microtask, must be called in the runtime thread.
+func (c *Context) enqueueMicrotask(task func() error) {
+	c.microtasks = append(c.microtasks, task)
+}
+
+// Run the queued microtasks until the queue is empty, must be called in the runtime thread.
+// The microtasks queued by a failed one stay in the queue.
+func (c *Context) drainMicrotasks() error {
+	if c.drainingMicrotasks {
+		return nil
+	}
+
+	c.drainingMicrotasks = true
+	defer func() {
+		c.drainingMicrotasks = false
+	}()
+
+	for len(c.microtasks) > 0 {
+		task := c.microtasks[0]
+		c.microtasks[0] = nil
+		c.microtasks = c.microtasks[1:]
+
+		if err := task(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
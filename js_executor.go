@@ -0,0 +1,143 @@
+package monkey
+
+/*
+#include "monkey.h"
+*/
+import "C"
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// executor owns the OS thread of a runtime.
+//
+// SpiderMonkey must only be used in the thread that created the runtime, so the
+// runtime goroutine locks itself to an OS thread. A locked thread never runs
+// other goroutines, which makes the thread identity the token of reentrancy:
+// a call made from a Go callback invoked by JavaScript (or from the callback
+// of Runtime.Use) runs in the locked thread and is executed in place, anything
+// else is posted to the work channel. No goroutine ids are involved.
+//
+// This replaces the token passed through callbacks, which was the first design:
+// a token would have to be an argument of every method, because a callback can
+// call any handle captured from outside, e.g. a *Context in a closure. The
+// thread identity is the same information without changing the API.
+// It's enough because JavaScript only calls Go in the thread running it, which
+// is the locked thread. A cgo callback from another OS thread, e.g. a thread
+// of a C library calling Runtime.Use, is not in the runtime thread and posts
+// its work like any goroutine, so it waits until the runtime thread is free.
+type executor struct {
+	thread  C.pthread_t
+	started int32
+}
+
+// Lock the calling goroutine to its OS thread and remember the thread.
+func (e *executor) lock() {
+	runtime.LockOSThread()
+	e.thread = C.pthread_self()
+	atomic.StoreInt32(&e.started, 1)
+}
+
+func (e *executor) unlock() {
+	atomic.StoreInt32(&e.started, 0)
+	runtime.UnlockOSThread()
+}
+
+// Reports whether the caller is running in the executor thread.
+func (e *executor) inThread() bool {
+	return atomic.LoadInt32(&e.started) == 1 && C.pthread_equal(C.pthread_self(), e.thread) != 0
+}
+
+// Priority of the work posted to a runtime.
+// Work of higher priority runs first, work of the same priority runs in order.
+type Priority int
+
+const (
+	PriorityBackground Priority = iota
+	PriorityNormal
+	PriorityInteractive
+
+	priorityLevels = 3
+)
+
+type jswork struct {
+	callback   func()
+	resultChan chan int
+}
+
+// workQueue is an unbounded queue of work, so posting never blocks,
+// even from the runtime thread.
+type workQueue struct {
+	mutex  sync.Mutex
+	queues [priorityLevels][]jswork
+	closed bool
+	wake   chan struct{}
+}
+
+func newWorkQueue() *workQueue {
+	return &workQueue{wake: make(chan struct{}, 1)}
+}
+
+// Returns false when the queue closed.
+func (q *workQueue) push(p Priority, work jswork) bool {
+	if p < PriorityBackground {
+		p = PriorityBackground
+	} else if p > PriorityInteractive {
+		p = PriorityInteractive
+	}
+
+	q.mutex.Lock()
+	if q.closed {
+		q.mutex.Unlock()
+		return false
+	}
+	q.queues[p] = append(q.queues[p], work)
+	q.mutex.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+
+	return true
+}
+
+// Take the work of the highest priority.
+func (q *workQueue) pop() (jswork, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for p := priorityLevels - 1; p >= 0; p-- {
+		if len(q.queues[p]) > 0 {
+			work := q.queues[p][0]
+			q.queues[p][0] = jswork{}
+			q.queues[p] = q.queues[p][1:]
+			return work, true
+		}
+	}
+
+	return jswork{}, false
+}
+
+// Close the queue, returns the work left in it.
+func (q *workQueue) close() []jswork {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.closed = true
+
+	var left []jswork
+	for p := priorityLevels - 1; p >= 0; p-- {
+		left = append(left, q.queues[p]...)
+		q.queues[p] = nil
+	}
+	return left
+}
+
+func (work jswork) run() {
+	work.callback()
+	if work.resultChan != nil {
+		work.resultChan <- 1
+	}
+}
@@ -0,0 +1,188 @@
+package monkey
+
+/*
+#include "monkey.h"
+*/
+import "C"
+import (
+	"runtime"
+	"unsafe"
+)
+
+// Compiled JavaScript function
+type Function struct {
+	cx  *Context
+	obj *C.JSObject
+	ref *rootRef
+
+	// The this object of a bound function, it's rooted as long as the function.
+	this *Value
+}
+
+// CompileFunction compiles a function from its parameter names and body.
+// The function is not defined in the global object, but it can use the globals.
+// The error is the error report of the failure.
+func (c *Context) CompileFunction(name string, params []string, body, filename string, line int) (*Function, error) {
+	var result *Function
+	var err error
+
+	if err2 := c.use(func() {
+		result, err = c.compileFunction(name, params, body, filename, line)
+	}); err2 != nil {
+		return nil, err2
+	}
+
+	return result, err
+}
+
+// Must be called in the runtime thread.
+func (c *Context) compileFunction(name string, params []string, body, filename string, line int) (*Function, error) {
+	var cname *C.char
+	if name != "" {
+		cname = C.CString(name)
+		defer C.free(unsafe.Pointer(cname))
+	}
+
+	var cparams **C.char
+	if len(params) > 0 {
+		cparams = (**C.char)(C.malloc(C.size_t(len(params)) * C.size_t(unsafe.Sizeof(cname))))
+		defer C.free(unsafe.Pointer(cparams))
+
+		names := unsafe.Slice(cparams, len(params))
+		for i, param := range params {
+			names[i] = C.CString(param)
+			defer C.free(unsafe.Pointer(names[i]))
+		}
+	}
+
+	cbody := C.CString(body)
+	defer C.free(unsafe.Pointer(cbody))
+
+	cfilename := C.CString(filename)
+	defer C.free(unsafe.Pointer(cfilename))
+
+	// A named function is defined in the object, so it's compiled in
+	// a holder object of which the parent is the global object.
+	holder := C.JS_NewObject(c.jscx, nil, nil, c.jsglobal)
+	if holder == nil {
+		return nil, ErrExecutionFailed
+	}
+
+	c.lastError = nil
+
+	fun := C.JS_CompileFunction(c.jscx, holder, cname, C.uintN(len(params)), cparams, cbody, C.size_t(len(body)), cfilename, C.uintN(line))
+	if fun == nil {
+		return nil, c.takeError()
+	}
+
+	c.coverSource(filename, line, body)
+	return c.newFunction(C.JS_GetFunctionObject(fun), nil), nil
+}
+
+// Root a function object, must be called in the runtime thread.
+func (c *Context) newFunction(obj *C.JSObject, this *Value) *Function {
+	f := &Function{c, obj, c.rt.addObjectRoot(c, obj, "function"), this}
+
+	runtime.SetFinalizer(f, func(f *Function) {
+		f.ref.finalize()
+	})
+
+	return f
+}
+
+// Release the function's GC root. The function can't be called after this.
+func (f *Function) Release() {
+	if f == nil {
+		return
+	}
+	f.ref.release()
+	f.this.Release()
+}
+
+// Free by manual, same as Release()
+func (f *Function) Dispose() {
+	f.Release()
+}
+
+func (f *Function) root() *rootRef {
+	return f.ref
+}
+
+func (f *Function) Context() *Context {
+	return f.cx
+}
+
+func (f *Function) Runtime() *Runtime {
+	return f.cx.rt
+}
+
+// Bind returns the function which is called with this as the this object,
+// nil means the global object.
+func (f *Function) Bind(this *Object) *Function {
+	var result *Function
+
+	f.cx.use(func() {
+		if f.ref.isReleased() || this != nil && this.ref.isReleased() {
+			return
+		}
+
+		var thisValue *Value
+		if this != nil {
+			thisValue = newPinnedValue(f.cx, C.OBJECT_TO_JSVAL(this.obj))
+		}
+		result = f.cx.newFunction(f.obj, thisValue)
+	})
+
+	return result
+}
+
+// Call the function, the arguments are converted by Context.ValueOf().
+// The error is the error report of the failure.
+func (f *Function) Call(argv ...interface{}) (*Value, error) {
+	var result *Value
+	var err error
+
+	if err2 := f.cx.use(func() {
+		if f.ref.isReleased() {
+			err = ErrDisposed
+			return
+		}
+
+		args := make([]*Value, len(argv))
+		defer func() {
+			for _, arg := range args {
+				if arg != nil {
+					arg.ref.remove()
+				}
+			}
+		}()
+
+		for i, arg := range argv {
+			if args[i], err = f.cx.valueOf(arg); err != nil {
+				return
+			}
+		}
+
+		var this *C.JSObject
+		if f.this != nil {
+			this = C.JSVAL_TO_OBJECT(f.this.val)
+		}
+
+		result, err = f.cx.callFunction(this, C.OBJECT_TO_JSVAL(f.obj), args)
+	}); err2 != nil {
+		return nil, err2
+	}
+
+	return result, err
+}
+
+// Value returns the function as a JavaScript value, nil after Release.
+func (f *Function) Value() *Value {
+	var result *Value
+
+	f.cx.useHandle(f.ref, func() {
+		result = newValue(f.cx, C.OBJECT_TO_JSVAL(f.obj))
+	})
+
+	return result
+}
@@ -0,0 +1,125 @@
+package monkey
+
+import (
+	"context"
+)
+
+// Future is the result of an asynchronous evaluation.
+type Future struct {
+	done  chan struct{}
+	value *Value
+	err   error
+}
+
+func newFuture() *Future {
+	return &Future{done: make(chan struct{})}
+}
+
+func (f *Future) resolve(value *Value, err error) {
+	f.value, f.err = value, err
+	close(f.done)
+}
+
+// Done is closed when the evaluation finished.
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait for the result until the evaluation finished or ctx is done.
+// Cancelling ctx doesn't cancel the evaluation.
+func (f *Future) Wait(ctx context.Context) (*Value, error) {
+	select {
+	case <-f.done:
+		return f.value, f.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Value returns the result, nil if the evaluation is not finished or failed.
+func (f *Future) Value() *Value {
+	select {
+	case <-f.done:
+		return f.value
+	default:
+		return nil
+	}
+}
+
+// Err returns the error, nil if the evaluation is not finished or succeeded.
+func (f *Future) Err() error {
+	select {
+	case <-f.done:
+		return f.err
+	default:
+		return nil
+	}
+}
+
+// Post the evaluation to the runtime thread.
+// Even in the runtime thread it's queued, so it never runs in place.
+func (c *Context) async(priority Priority, evaluate func() (*Value, error)) *Future {
+	f := newFuture()
+
+	posted := c.rt.post(priority, func() {
+		if c.isDisposed() {
+			f.resolve(nil, ErrDisposed)
+			return
+		}
+		f.resolve(evaluate())
+	})
+
+	if !posted {
+		f.resolve(nil, ErrDisposed)
+	}
+
+	return f
+}
+
+// EvalAsync queues the script and returns immediately.
+func (c *Context) EvalAsync(script string) *Future {
+	return c.EvalAsyncPriority(script, PriorityNormal)
+}
+
+// EvalAsyncPriority is the same as EvalAsync, but the script jumps ahead of
+// the pending work of lower priority.
+func (c *Context) EvalAsyncPriority(script string, priority Priority) *Future {
+	return c.async(priority, func() (*Value, error) {
+		return c.evaluate(script, "", 0)
+	})
+}
+
+// ExecuteAsync queues the script and returns immediately.
+func (s *Script) ExecuteAsync() *Future {
+	return s.ExecuteAsyncPriority(PriorityNormal)
+}
+
+// ExecuteAsyncPriority is the same as ExecuteAsync, but the script jumps ahead of
+// the pending work of lower priority.
+func (s *Script) ExecuteAsyncPriority(priority Priority) *Future {
+	return s.cx.async(priority, func() (*Value, error) {
+		return s.execute(s.cx)
+	})
+}
+
+// CallAsync queues the function call and returns immediately.
+func (v *Value) CallAsync(argv []*Value) *Future {
+	return v.CallAsyncPriority(argv, PriorityNormal)
+}
+
+// CallAsyncPriority is the same as CallAsync, but the call jumps ahead of
+// the pending work of lower priority.
+// The future fails by ErrDisposed when the function or an argument is released.
+func (v *Value) CallAsyncPriority(argv []*Value, priority Priority) *Future {
+	return v.cx.async(priority, func() (*Value, error) {
+		if v.ref.isReleased() {
+			return nil, ErrDisposed
+		}
+		for _, arg := range argv {
+			if arg == nil || arg.ref.isReleased() {
+				return nil, ErrDisposed
+			}
+		}
+		return v.cx.callFunction(nil, v.val, argv)
+	})
+}
@@ -0,0 +1,50 @@
+package monkey
+
+/*
+#include "monkey.h"
+*/
+import "C"
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// ErrInterrupted is returned by the calls stopped by Context.Interrupt().
+var ErrInterrupted = errors.New("monkey: script interrupted")
+
+// Interrupt stops the script running in the context, it can be called in any goroutine.
+// The script can't catch it, the stopped call returns ErrInterrupted.
+// It does nothing when no script is running.
+func (c *Context) Interrupt() {
+	atomic.StoreInt32(&c.interrupted, 1)
+	c.triggerOperationCallback()
+}
+
+// The running script calls the operation callback soon, it can be called in any goroutine.
+func (c *Context) triggerOperationCallback() {
+	c.interruptMutex.Lock()
+	defer c.interruptMutex.Unlock()
+
+	if !c.isDisposed() {
+		C.JS_TriggerOperationCallback(c.jscx)
+	}
+}
+
+//export call_operation_callback
+func call_operation_callback(h C.uintptr_t) C.JSBool {
+	c := contextOf(h)
+
+	if atomic.LoadInt32(&c.interrupted) == 1 {
+		return C.JS_FALSE
+	}
+
+	if p := c.profiler; p != nil {
+		p.sample(c)
+	}
+
+	if d := c.debugger; d != nil && d.hasPending() {
+		d.sync()
+	}
+
+	return C.JS_TRUE
+}
@@ -0,0 +1,935 @@
+package monkey
+
+/*
+#include "monkey.h"
+*/
+import "C"
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"strings"
+)
+
+// ModuleResolver finds and loads the modules of import and export declarations.
+type ModuleResolver interface {
+	// Resolve returns the id of the module imported by specifier from the referrer module.
+	Resolve(specifier, referrer string) (string, error)
+
+	// Load returns the source of the module.
+	Load(id string) (string, error)
+}
+
+type fsModuleResolver struct {
+	m *moduleSystem
+}
+
+// NewFSModuleResolver resolves the specifiers the same way as require(),
+// the ids are the paths in fsys.
+func NewFSModuleResolver(fsys fs.FS) ModuleResolver {
+	return &fsModuleResolver{&moduleSystem{fsys: fsys}}
+}
+
+func (r *fsModuleResolver) Resolve(specifier, referrer string) (string, error) {
+	if id, ok := r.m.resolve(specifier, referrer); ok {
+		return id, nil
+	}
+	return "", fmt.Errorf("Cannot find module '%s' from '%s'", specifier, referrer)
+}
+
+func (r *fsModuleResolver) Load(id string) (string, error) {
+	data, err := fs.ReadFile(r.m.fsys, id)
+	return string(data), err
+}
+
+// The module registry. A module is a function which gets the import and
+// export functions, it's run once and its namespace object is cached by id.
+const moduleScript = `(function(global, host) {
+	var modules = {};
+
+	function run(id, fn) {
+		var ns = {};
+		modules[id] = ns;
+
+		function exportName(name, getter) {
+			Object.defineProperty(ns, name, {get: getter, enumerable: true, configurable: true});
+		}
+
+		function exportAll(other) {
+			Object.keys(other).forEach(function(name) {
+				if (name != 'default' && !(name in ns)) {
+					exportName(name, function() { return other[name]; });
+				}
+			});
+		}
+
+		try {
+			fn(load, exportName, exportAll);
+		} catch (e) {
+			delete modules[id];
+			throw e;
+		}
+
+		return ns;
+	}
+
+	function load(id) {
+		if (id in modules) return modules[id];
+		return run(id, host.compile(id));
+	}
+
+	Object.defineProperty(global, '__modules', {value: {run: run, load: load}});
+})`
+
+const moduleWrapper = "function (__import, __export, __exportAll) {"
+
+// EnableModules turns on the import and export declarations.
+// Compile() rewrites them into calls of the module registry, the specifiers
+// are resolved and loaded by the resolver. The script returns the namespace
+// object of the module. The imported bindings are copied when the module starts,
+// so a cycle sees undefined instead of the unfinished bindings.
+func (c *Context) EnableModules(resolver ModuleResolver) bool {
+	if resolver == nil {
+		return false
+	}
+
+	var result bool
+
+	c.use(func() {
+		if c.resolver != nil {
+			c.resolver = resolver
+			result = true
+			return
+		}
+
+		host := newGoObject(c, nil)
+		defer host.ref.remove()
+
+		host.DefineFunction("compile", func(o *Object, name string, argv []*Value) *Value {
+			id := c.jsvalToString(argv[0].val)
+
+			source, err := c.resolver.Load(id)
+			if err != nil {
+				c.throwError(err.Error())
+				return nil
+			}
+
+			var body string
+			if strings.HasSuffix(id, ".json") {
+				body = "__export('default', function () { return __default; }); var __default = " + source + ";"
+			} else if body, err = transformModule(source, id, c.resolver); err != nil {
+				c.throwError(err.Error())
+				return nil
+			}
+
+			fn, err := c.evaluate("("+moduleWrapper+body+"\n})", id, 1)
+			c.coverSource(id, 1, source)
+			if err != nil {
+				if C.JS_IsExceptionPending(c.jscx) != C.JS_TRUE {
+					c.throwError(err.Error())
+				}
+				return nil
+			}
+			return fn
+		})
+
+		hostValue := newValue(c, C.OBJECT_TO_JSVAL(host.obj))
+		defer hostValue.ref.remove()
+
+		v, err := c.install(moduleScript, "modules.js", hostValue)
+		if err != nil {
+			return
+		}
+		v.ref.remove()
+
+		c.resolver = resolver
+		result = true
+	})
+
+	return result
+}
+
+// Rewrite a script which has import or export declarations into a call of the
+// module registry, must be called in the runtime thread.
+// Returns the code as it is when it's a plain script.
+func (c *Context) transformEntry(code, filename string) (string, error) {
+	tokens, err := tokenize(code, filename)
+	if err != nil {
+		return "", err
+	}
+
+	if !hasModuleSyntax(tokens) {
+		return code, nil
+	}
+
+	body, err := transformTokens(code, tokens, filename, c.resolver)
+	if err != nil {
+		return "", err
+	}
+
+	id, _ := json.Marshal(filename)
+
+	return "__modules.run(" + string(id) + ", " + moduleWrapper + body + "\n});", nil
+}
+
+// ModuleSyntaxError is an invalid import or export declaration.
+type ModuleSyntaxError struct {
+	FileName string
+	Line     int
+	Message  string
+}
+
+func (e *ModuleSyntaxError) Error() string {
+	return fmt.Sprintf("%s:%d: SyntaxError: %s", e.FileName, e.Line, e.Message)
+}
+
+// Rewrite the import and export declarations of a module into calls of
+// __import(id), __export(name, getter) and __exportAll(namespace).
+// The line numbers don't change: the imports and exports go to the first line
+// and the removed declarations leave their newlines.
+func transformModule(source, id string, resolver ModuleResolver) (string, error) {
+	tokens, err := tokenize(source, id)
+	if err != nil {
+		return "", err
+	}
+	return transformTokens(source, tokens, id, resolver)
+}
+
+type sourceEdit struct {
+	start, end  int
+	replacement string
+}
+
+type moduleTransformer struct {
+	source   string
+	id       string
+	resolver ModuleResolver
+	tokens   []token
+	pos      int
+	exports  []string
+	imports  []string
+	edits    []sourceEdit
+	modules  map[string]string
+}
+
+func transformTokens(source string, tokens []token, id string, resolver ModuleResolver) (string, error) {
+	t := &moduleTransformer{
+		source:   source,
+		id:       id,
+		resolver: resolver,
+		tokens:   tokens,
+		modules:  make(map[string]string),
+	}
+
+	for t.pos = 0; t.pos < len(tokens); t.pos++ {
+		if !t.atDeclaration() {
+			continue
+		}
+
+		var err error
+		if tokens[t.pos].text == "import" {
+			err = t.importDeclaration()
+		} else {
+			err = t.exportDeclaration()
+		}
+
+		if err != nil {
+			return "", err
+		}
+	}
+
+	var out strings.Builder
+
+	out.WriteString(strings.Join(t.exports, ""))
+	out.WriteString(strings.Join(t.imports, ""))
+
+	last := 0
+	for _, edit := range t.edits {
+		out.WriteString(source[last:edit.start])
+		out.WriteString(edit.replacement)
+		out.WriteString(strings.Repeat("\n", strings.Count(source[edit.start:edit.end], "\n")))
+		last = edit.end
+	}
+	out.WriteString(source[last:])
+
+	return out.String(), nil
+}
+
+func hasModuleSyntax(tokens []token) bool {
+	t := &moduleTransformer{tokens: tokens}
+	for t.pos = 0; t.pos < len(tokens); t.pos++ {
+		if t.atDeclaration() {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether the current token starts a top level import or export declaration.
+func (t *moduleTransformer) atDeclaration() bool {
+	tok := t.tokens[t.pos]
+
+	if tok.depth != 0 || tok.kind != tokIdent || (tok.text != "import" && tok.text != "export") {
+		return false
+	}
+
+	if t.pos > 0 {
+		prev := t.tokens[t.pos-1]
+		if !(prev.kind == tokPunct && (prev.text == ";" || prev.text == "}")) && !tok.nl {
+			return false
+		}
+	}
+
+	// Dynamic import() and import.meta are expressions.
+	if next := t.peek(1); tok.text == "import" && next.kind == tokPunct && (next.text == "(" || next.text == ".") {
+		return false
+	}
+
+	return true
+}
+
+func (t *moduleTransformer) peek(n int) token {
+	if t.pos+n < len(t.tokens) {
+		return t.tokens[t.pos+n]
+	}
+	return token{kind: tokEOF, start: len(t.source), end: len(t.source)}
+}
+
+func (t *moduleTransformer) errorf(tok token, format string, args ...interface{}) error {
+	return &ModuleSyntaxError{t.id, tok.line, fmt.Sprintf(format, args...)}
+}
+
+func (t *moduleTransformer) expectIdent(text string) (token, error) {
+	t.pos++
+	tok := t.peek(0)
+	if tok.kind != tokIdent || (text != "" && tok.text != text) {
+		if text == "" {
+			text = "identifier"
+		}
+		return tok, t.errorf(tok, "expected %s but found '%s'", text, tok.text)
+	}
+	return tok, nil
+}
+
+func (t *moduleTransformer) expectPunct(text string) error {
+	t.pos++
+	if tok := t.peek(0); tok.kind != tokPunct || tok.text != text {
+		return t.errorf(tok, "expected '%s' but found '%s'", text, tok.text)
+	}
+	return nil
+}
+
+// Parse `from 'specifier'` and return the variable of the imported namespace.
+func (t *moduleTransformer) from() (string, error) {
+	if _, err := t.expectIdent("from"); err != nil {
+		return "", err
+	}
+	return t.module()
+}
+
+// Parse the specifier and return the variable of the imported namespace.
+func (t *moduleTransformer) module() (string, error) {
+	t.pos++
+	tok := t.peek(0)
+	if tok.kind != tokString {
+		return "", t.errorf(tok, "expected module specifier but found '%s'", tok.text)
+	}
+
+	id, err := t.resolver.Resolve(tok.value, t.id)
+	if err != nil {
+		return "", t.errorf(tok, "%s", err)
+	}
+
+	if name, ok := t.modules[id]; ok {
+		return name, nil
+	}
+
+	name := fmt.Sprintf("__module%d", len(t.modules))
+	t.modules[id] = name
+
+	quoted, _ := json.Marshal(id)
+	t.imports = append(t.imports, "var "+name+" = __import("+string(quoted)+"); ")
+
+	return name, nil
+}
+
+// Remove the declaration from the start token to the current token, and the semicolon.
+func (t *moduleTransformer) remove(start token, replacement string) {
+	if next := t.peek(1); next.kind == tokPunct && next.text == ";" {
+		t.pos++
+	}
+	t.edits = append(t.edits, sourceEdit{start.start, t.peek(0).end, replacement})
+}
+
+func (t *moduleTransformer) addExport(name, expr string) {
+	quoted, _ := json.Marshal(name)
+	t.exports = append(t.exports, "__export("+string(quoted)+", function () { return "+expr+"; }); ")
+}
+
+// Parse { a, b as c } and return the pairs of names.
+func (t *moduleTransformer) namedList() ([][2]string, error) {
+	if err := t.expectPunct("{"); err != nil {
+		return nil, err
+	}
+
+	var names [][2]string
+
+	for {
+		t.pos++
+		tok := t.peek(0)
+
+		if tok.kind == tokPunct && tok.text == "}" {
+			return names, nil
+		}
+
+		if tok.kind != tokIdent && tok.kind != tokString {
+			return nil, t.errorf(tok, "unexpected '%s'", tok.text)
+		}
+
+		name := [2]string{tok.value, tok.value}
+
+		if next := t.peek(1); next.kind == tokIdent && next.text == "as" {
+			t.pos += 2
+			alias := t.peek(0)
+			if alias.kind != tokIdent && alias.kind != tokString {
+				return nil, t.errorf(alias, "unexpected '%s'", alias.text)
+			}
+			name[1] = alias.value
+		}
+
+		names = append(names, name)
+
+		if next := t.peek(1); next.kind == tokPunct && next.text == "," {
+			t.pos++
+		}
+	}
+}
+
+func (t *moduleTransformer) importDeclaration() error {
+	start := t.peek(0)
+
+	// import 'specifier'
+	if t.peek(1).kind == tokString {
+		if _, err := t.module(); err != nil {
+			return err
+		}
+		t.remove(start, "")
+		return nil
+	}
+
+	var bindings []string
+
+	if next := t.peek(1); next.kind == tokIdent && next.text != "from" {
+		t.pos++
+		bindings = append(bindings, next.text+" = %s[\"default\"]")
+
+		if next := t.peek(1); next.kind == tokPunct && next.text == "," {
+			t.pos++
+		}
+	}
+
+	switch next := t.peek(1); {
+	case next.kind == tokPunct && next.text == "*":
+		t.pos++
+		if _, err := t.expectIdent("as"); err != nil {
+			return err
+		}
+		local, err := t.expectIdent("")
+		if err != nil {
+			return err
+		}
+		bindings = append(bindings, local.text+" = %s")
+	case next.kind == tokPunct && next.text == "{":
+		names, err := t.namedList()
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			quoted, _ := json.Marshal(name[0])
+			bindings = append(bindings, name[1]+" = %s["+string(quoted)+"]")
+		}
+	}
+
+	if len(bindings) == 0 {
+		return t.errorf(t.peek(1), "unexpected '%s'", t.peek(1).text)
+	}
+
+	module, err := t.from()
+	if err != nil {
+		return err
+	}
+
+	for i, binding := range bindings {
+		bindings[i] = fmt.Sprintf(binding, module)
+	}
+	t.imports = append(t.imports, "var "+strings.Join(bindings, ", ")+"; ")
+
+	t.remove(start, "")
+	return nil
+}
+
+func (t *moduleTransformer) exportDeclaration() error {
+	start := t.peek(0)
+	next := t.peek(1)
+
+	switch {
+	case next.kind == tokPunct && next.text == "*":
+		// export * from 'x', export * as ns from 'x'
+		t.pos++
+		var alias string
+		if as := t.peek(1); as.kind == tokIdent && as.text == "as" {
+			t.pos++
+			tok, err := t.expectIdent("")
+			if err != nil {
+				return err
+			}
+			alias = tok.text
+		}
+
+		module, err := t.from()
+		if err != nil {
+			return err
+		}
+
+		if alias != "" {
+			t.addExport(alias, module)
+		} else {
+			t.exports = append(t.exports, "__exportAll("+module+"); ")
+		}
+
+		// The namespace must be imported before it's exported.
+		t.exports, t.imports = t.exports[:len(t.exports)-1], append(t.imports, t.exports[len(t.exports)-1])
+		t.remove(start, "")
+
+	case next.kind == tokPunct && next.text == "{":
+		// export { a, b as c } [from 'x']
+		names, err := t.namedList()
+		if err != nil {
+			return err
+		}
+
+		module := ""
+		if from := t.peek(1); from.kind == tokIdent && from.text == "from" {
+			if module, err = t.from(); err != nil {
+				return err
+			}
+		}
+
+		for _, name := range names {
+			if module != "" {
+				quoted, _ := json.Marshal(name[0])
+				t.addExport(name[1], module+"["+string(quoted)+"]")
+			} else {
+				t.addExport(name[1], name[0])
+			}
+		}
+
+		t.remove(start, "")
+
+	case next.kind == tokIdent && next.text == "default":
+		t.pos++
+		decl := t.peek(1)
+
+		if name, ok := t.declarationName(1); ok && (decl.text == "function" || decl.text == "class") {
+			t.addExport("default", name)
+			t.edits = append(t.edits, sourceEdit{start.start, decl.start, ""})
+			return nil
+		}
+
+		t.addExport("default", "__default")
+		t.edits = append(t.edits, sourceEdit{start.start, next.end, "var __default ="})
+
+	case next.kind == tokIdent && (next.text == "var" || next.text == "let" || next.text == "const"):
+		t.pos++
+		names, err := t.declaredNames()
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			t.addExport(name, name)
+		}
+		t.edits = append(t.edits, sourceEdit{start.start, next.start, ""})
+
+	case next.kind == tokIdent && (next.text == "function" || next.text == "class" || next.text == "async"):
+		name, ok := t.declarationName(1)
+		if !ok {
+			return t.errorf(next, "missing name of exported declaration")
+		}
+		t.addExport(name, name)
+		t.edits = append(t.edits, sourceEdit{start.start, next.start, ""})
+
+	default:
+		return t.errorf(next, "unexpected '%s' after export", next.text)
+	}
+
+	return nil
+}
+
+// The name of the function or class declaration at the offset.
+func (t *moduleTransformer) declarationName(offset int) (string, bool) {
+	if tok := t.peek(offset); tok.kind == tokIdent && tok.text == "async" {
+		offset++
+	}
+
+	switch t.peek(offset).text {
+	case "function":
+		offset++
+		if tok := t.peek(offset); tok.kind == tokPunct && tok.text == "*" {
+			offset++
+		}
+	case "class":
+		offset++
+	default:
+		return "", false
+	}
+
+	if tok := t.peek(offset); tok.kind == tokIdent && tok.text != "extends" {
+		return tok.text, true
+	}
+
+	return "", false
+}
+
+// The names declared by var, let or const at the current token.
+// The declaration ends at a semicolon or a newline which ends the statement.
+func (t *moduleTransformer) declaredNames() ([]string, error) {
+	var names []string
+
+	for {
+		t.pos++
+		tok := t.peek(0)
+		if tok.kind != tokIdent {
+			return nil, t.errorf(tok, "unsupported declaration '%s' after export", tok.text)
+		}
+		names = append(names, tok.text)
+
+		for {
+			next := t.peek(1)
+
+			if next.kind == tokEOF {
+				return names, nil
+			}
+
+			if next.depth == 0 && next.kind == tokPunct && next.text == "," {
+				t.pos++
+				break
+			}
+
+			if next.depth == 0 && next.kind == tokPunct && next.text == ";" {
+				return names, nil
+			}
+
+			if next.depth == 0 && next.nl && endsStatement(t.peek(0), next) {
+				return names, nil
+			}
+
+			t.pos++
+		}
+	}
+}
+
+// Reports whether a newline between the tokens ends the statement.
+func endsStatement(prev, next token) bool {
+	switch prev.kind {
+	case tokPunct:
+		if prev.text != ")" && prev.text != "]" && prev.text != "}" {
+			return false
+		}
+	case tokIdent:
+		switch prev.text {
+		case "in", "instanceof", "typeof", "new", "delete", "void":
+			return false
+		}
+	}
+
+	switch next.kind {
+	case tokPunct:
+		return next.text == "{" || next.text == "!" || next.text == "~"
+	case tokIdent:
+		return next.text != "in" && next.text != "instanceof"
+	}
+
+	return true
+}
+
+/*
+Tokenizer, only good enough to find the top level declarations.
+*/
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokTemplate
+	tokRegexp
+	tokPunct
+)
+
+type token struct {
+	kind       tokenKind
+	text       string
+	value      string
+	start, end int
+	line       int
+	depth      int
+	nl         bool
+}
+
+type tokenizer struct {
+	src      string
+	filename string
+	pos      int
+	line     int
+	depth    int
+	nl       bool
+	tokens   []token
+}
+
+func tokenize(src, filename string) ([]token, error) {
+	l := &tokenizer{src: src, filename: filename, line: 1}
+	if err := l.run(-1); err != nil {
+		return nil, err
+	}
+	return l.tokens, nil
+}
+
+// Scan tokens until the end, or until the closing brace of a template
+// substitution at depth stop.
+func (l *tokenizer) run(stop int) error {
+	for {
+		l.skipSpace()
+
+		if l.pos >= len(l.src) {
+			if stop >= 0 {
+				return l.errorf("unterminated template literal")
+			}
+			return nil
+		}
+
+		start := l.pos
+		ch := l.src[l.pos]
+
+		switch {
+		case ch == '"' || ch == '\'':
+			value, err := l.scanString(ch)
+			if err != nil {
+				return err
+			}
+			l.add(tokString, start, value)
+		case ch == '`':
+			if err := l.scanTemplate(); err != nil {
+				return err
+			}
+			l.add(tokTemplate, start, "")
+		case isIdentStart(ch):
+			for l.pos < len(l.src) && isIdentPart(l.src[l.pos]) {
+				l.pos++
+			}
+			l.add(tokIdent, start, l.src[start:l.pos])
+		case ch >= '0' && ch <= '9' || ch == '.' && l.pos+1 < len(l.src) && l.src[l.pos+1] >= '0' && l.src[l.pos+1] <= '9':
+			for l.pos < len(l.src) && (isIdentPart(l.src[l.pos]) || l.src[l.pos] == '.' ||
+				(l.src[l.pos] == '+' || l.src[l.pos] == '-') && (l.src[l.pos-1] == 'e' || l.src[l.pos-1] == 'E')) {
+				l.pos++
+			}
+			l.add(tokNumber, start, "")
+		case ch == '/' && l.regexpAllowed():
+			if err := l.scanRegexp(); err != nil {
+				return err
+			}
+			l.add(tokRegexp, start, "")
+		default:
+			l.pos++
+			switch ch {
+			case '(', '[', '{':
+				l.add(tokPunct, start, "")
+				l.depth++
+				continue
+			case ')', ']', '}':
+				l.depth--
+				if ch == '}' && l.depth == stop {
+					return nil
+				}
+			}
+			l.add(tokPunct, start, "")
+		}
+	}
+}
+
+func (l *tokenizer) add(kind tokenKind, start int, value string) {
+	l.tokens = append(l.tokens, token{
+		kind:  kind,
+		text:  l.src[start:l.pos],
+		value: value,
+		start: start,
+		end:   l.pos,
+		line:  l.line - strings.Count(l.src[start:l.pos], "\n"),
+		depth: l.depth,
+		nl:    l.nl,
+	})
+	l.nl = false
+}
+
+func (l *tokenizer) errorf(format string, args ...interface{}) error {
+	return &ModuleSyntaxError{l.filename, l.line, fmt.Sprintf(format, args...)}
+}
+
+func (l *tokenizer) skipSpace() {
+	for l.pos < len(l.src) {
+		switch ch := l.src[l.pos]; {
+		case ch == '\n':
+			l.line++
+			l.nl = true
+			l.pos++
+		case ch == ' ' || ch == '\t' || ch == '\r' || ch == '\f' || ch == '\v':
+			l.pos++
+		case strings.HasPrefix(l.src[l.pos:], "//"):
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+		case strings.HasPrefix(l.src[l.pos:], "/*"):
+			end := strings.Index(l.src[l.pos+2:], "*/")
+			if end < 0 {
+				end = len(l.src) - l.pos - 2
+			}
+			comment := l.src[l.pos : l.pos+2+end]
+			if n := strings.Count(comment, "\n"); n > 0 {
+				l.line += n
+				l.nl = true
+			}
+			l.pos = l.pos + 2 + end + 2
+			if l.pos > len(l.src) {
+				l.pos = len(l.src)
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (l *tokenizer) scanString(quote byte) (string, error) {
+	var value strings.Builder
+	l.pos++
+
+	for l.pos < len(l.src) {
+		ch := l.src[l.pos]
+		switch {
+		case ch == quote:
+			l.pos++
+			return value.String(), nil
+		case ch == '\n':
+			return "", l.errorf("unterminated string literal")
+		case ch == '\\' && l.pos+1 < len(l.src):
+			l.pos++
+			switch esc := l.src[l.pos]; esc {
+			case 'n':
+				value.WriteByte('\n')
+			case 't':
+				value.WriteByte('\t')
+			case 'r':
+				value.WriteByte('\r')
+			case '\n':
+				l.line++
+			default:
+				value.WriteByte(esc)
+			}
+			l.pos++
+		default:
+			value.WriteByte(ch)
+			l.pos++
+		}
+	}
+
+	return "", l.errorf("unterminated string literal")
+}
+
+func (l *tokenizer) scanTemplate() error {
+	l.pos++
+
+	for l.pos < len(l.src) {
+		switch ch := l.src[l.pos]; {
+		case ch == '`':
+			l.pos++
+			return nil
+		case ch == '\\':
+			l.pos += 2
+		case ch == '$' && l.pos+1 < len(l.src) && l.src[l.pos+1] == '{':
+			// The substitution is tokenized as code, its tokens are kept
+			// below the template at a deeper level.
+			l.pos += 2
+			l.depth++
+			if err := l.run(l.depth - 1); err != nil {
+				return err
+			}
+		default:
+			if ch == '\n' {
+				l.line++
+			}
+			l.pos++
+		}
+	}
+
+	return l.errorf("unterminated template literal")
+}
+
+func (l *tokenizer) scanRegexp() error {
+	l.pos++
+	inClass := false
+
+	for l.pos < len(l.src) {
+		switch ch := l.src[l.pos]; {
+		case ch == '\n':
+			return l.errorf("unterminated regular expression")
+		case ch == '\\':
+			l.pos += 2
+			continue
+		case ch == '[':
+			inClass = true
+		case ch == ']':
+			inClass = false
+		case ch == '/' && !inClass:
+			l.pos++
+			for l.pos < len(l.src) && isIdentPart(l.src[l.pos]) {
+				l.pos++
+			}
+			return nil
+		}
+		l.pos++
+	}
+
+	return l.errorf("unterminated regular expression")
+}
+
+// A slash after an operand is a division, otherwise it starts a regular expression.
+func (l *tokenizer) regexpAllowed() bool {
+	if len(l.tokens) == 0 {
+		return true
+	}
+
+	prev := l.tokens[len(l.tokens)-1]
+
+	switch prev.kind {
+	case tokNumber, tokString, tokTemplate, tokRegexp:
+		return false
+	case tokIdent:
+		switch prev.text {
+		case "return", "typeof", "instanceof", "in", "of", "new", "delete", "void", "throw", "case", "do", "else", "yield", "await":
+			return true
+		}
+		return false
+	case tokPunct:
+		return prev.text != ")" && prev.text != "]"
+	}
+
+	return true
+}
+
+func isIdentStart(ch byte) bool {
+	return ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch == '_' || ch == '$' || ch == '\\' || ch >= 0x80
+}
+
+func isIdentPart(ch byte) bool {
+	return isIdentStart(ch) || ch >= '0' && ch <= '9'
+}
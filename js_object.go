@@ -5,8 +5,8 @@ package monkey
 */
 import "C"
 import (
-	"reflect"
 	"runtime"
+	"runtime/cgo"
 	"unsafe"
 )
 
@@ -14,8 +14,15 @@ type JsObjectFunc func(obj *Object, name string, argv []*Value) *Value
 
 // JavaScript Object
 type Object struct {
-	cx      *Context
-	obj     *C.JSObject
+	cx   *Context
+	obj  *C.JSObject
+	data *objectData
+	ref  *rootRef
+}
+
+// Go side data of the objects created by Context.NewObject().
+// JavaScript object keeps it by a cgo handle until the object finalized.
+type objectData struct {
 	gval    interface{}
 	funcs   map[string]JsObjectFunc
 	getters map[string]JsPropertyGetter
@@ -24,24 +31,78 @@ type Object struct {
 
 // Add the JSObject to the garbage collector's root set.
 // See: https://developer.mozilla.org/en-US/docs/Mozilla/Projects/SpiderMonkey/JSAPI_reference/JS_AddRoot
-func newObject(cx *Context, obj *C.JSObject, gval interface{}) *Object {
-	gobj := (*Object)(C.JS_GetPrivate(cx.jscx, obj))
-	if gobj != nil {
-		return gobj
+func newObject(cx *Context, obj *C.JSObject) *Object {
+	// User defined property and function object use this to find callback.
+	result := &Object{cx, obj, cx.objectData(obj), cx.rt.addObjectRoot(cx, obj, "object")}
+
+	runtime.SetFinalizer(result, func(o *Object) {
+		o.ref.finalize()
+	})
+
+	return result
+}
+
+// Create a JSObject which can hold Go data, functions and properties.
+func newGoObject(cx *Context, gval interface{}) *Object {
+	obj := C.JS_NewObject(cx.jscx, &C.go_object_class, nil, nil)
+	if obj == nil {
+		return nil
 	}
 
-	result := &Object{cx, obj, gval, nil, nil, nil}
+	data := &objectData{gval: gval}
+	C.set_private_handle(cx.jscx, obj, C.uintptr_t(cgo.NewHandle(data)))
 
-	C.JS_AddObjectRoot(cx.jscx, &result.obj)
+	return newObject(cx, obj)
+}
 
-	runtime.SetFinalizer(result, func(o *Object) {
-		cx.rt.objDisposeChan <- o
-	})
+// Find the Go side data of an object, must be called in the runtime thread.
+func (c *Context) objectData(obj *C.JSObject) *objectData {
+	if h := C.get_private_handle(c.jscx, obj); h != 0 {
+		return cgo.Handle(h).Value().(*objectData)
+	}
+	return c.foreign[obj]
+}
 
-	// User defined property and function object use this to find callback.
-	C.JS_SetPrivate(cx.jscx, result.obj, unsafe.Pointer(result))
+// Attach the Go side data to an object which isn't created by NewObject(), like
+// the global object. The object is rooted until the context is disposed, so its
+// address stays its own. Must be called in the runtime thread.
+func (c *Context) attachData(obj *C.JSObject, data *objectData) *objectData {
+	if found := c.objectData(obj); found != nil {
+		return found
+	}
+	if data == nil {
+		data = &objectData{}
+	}
 
-	return result
+	scope := c.scope
+	c.scope = nil
+	c.rt.addObjectRoot(c, obj, "object")
+	c.scope = scope
+
+	if c.foreign == nil {
+		c.foreign = make(map[*C.JSObject]*objectData)
+	}
+	c.foreign[obj] = data
+
+	return data
+}
+
+//export call_go_object_finalize
+func call_go_object_finalize(h C.uintptr_t) {
+	cgo.Handle(h).Delete()
+}
+
+// Release the object's GC root. Its methods return zero values after this.
+// Releasing the global object does nothing.
+func (o *Object) Release() {
+	if o == nil {
+		return
+	}
+	o.ref.release()
+}
+
+func (o *Object) root() *rootRef {
+	return o.ref
 }
 
 func (o *Object) Runtime() *Runtime {
@@ -72,17 +133,26 @@ func (o *Object) ToGo() map[string]interface{} {
 	return ret
 }
 
+// Get the Go value attached to the object.
 func (o *Object) GetPrivate() interface{} {
-	return o.gval
+	if o.data == nil {
+		return nil
+	}
+	return o.data.gval
 }
 
+// Attach a Go value to the object.
+// Only the objects created by Context.NewObject() share the value between handles.
 func (o *Object) SetPrivate(gval interface{}) {
-	o.gval = gval
+	if o.data == nil {
+		o.data = &objectData{}
+	}
+	o.data.gval = gval
 }
 
 func (o *Object) ToValue() *Value {
 	var result *Value
-	o.cx.rt.Use(func() {
+	o.cx.useHandle(o.ref, func() {
 		result = newValue(o.cx, C.OBJECT_TO_JSVAL(o.obj))
 	})
 	return result
@@ -91,58 +161,88 @@ func (o *Object) ToValue() *Value {
 func (o *Object) GetProperty(name string) *Value {
 	var result *Value
 
-	o.cx.rt.Use(func() {
-		cname := C.CString(name)
-		defer C.free(unsafe.Pointer(cname))
-
-		var rval C.jsval
-		if C.JS_GetProperty(o.cx.jscx, o.obj, cname, &rval) == C.JS_TRUE {
-			result = newValue(o.cx, rval)
-		}
+	o.cx.useHandle(o.ref, func() {
+		result, _ = o.getValue(name)
 	})
 
 	return result
 }
 
+// Must be called in the runtime thread. The result isn't rooted.
+func (o *Object) getProperty(name string) (C.jsval, bool) {
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+
+	var rval C.jsval
+	ok := C.JS_GetProperty(o.cx.jscx, o.obj, cname, &rval) == C.JS_TRUE
+	return rval, ok
+}
+
+// Must be called in the runtime thread. The result is rooted before any
+// conversion can run the GC, the caller removes the root.
+func (o *Object) getValue(name string) (*Value, bool) {
+	if rval, ok := o.getProperty(name); ok {
+		return newValue(o.cx, rval), true
+	}
+	return nil, false
+}
+
+// Must be called in the runtime thread.
+func (o *Object) setProperty(name string, val C.jsval) bool {
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+
+	return C.JS_SetProperty(o.cx.jscx, o.obj, cname, &val) == C.JS_TRUE
+}
+
 func (o *Object) Keys() []string {
 	var result []string
 
-	o.cx.rt.Use(func() {
-		ids := C.JS_Enumerate(o.cx.jscx, o.obj)
-		if ids == nil {
-			panic("enumerate failed")
-		}
-		defer C.JS_free(o.cx.jscx, unsafe.Pointer(ids))
+	o.cx.useHandle(o.ref, func() {
+		result = o.keys()
+	})
 
-		keys := make([]string, ids.length)
-		head := unsafe.Pointer(&ids.vector[0])
+	return result
+}
 
-		sl := &reflect.SliceHeader{
-			uintptr(head), len(keys), len(keys),
-		}
-		vector := *(*[]C.jsid)(unsafe.Pointer(sl))
-		for i := 0; i < len(keys); i++ {
-			id := vector[i]
-			ckey := C.JS_EncodeString(o.cx.jscx, C.JSID_TO_STRING(id))
-			gkey := C.GoString(ckey)
-			C.JS_free(o.cx.jscx, unsafe.Pointer(ckey))
-			keys[i] = gkey
+// Must be called in the runtime thread.
+func (o *Object) keys() []string {
+	ids := C.JS_Enumerate(o.cx.jscx, o.obj)
+	if ids == nil {
+		panic("enumerate failed")
+	}
+	defer C.JS_free(o.cx.jscx, unsafe.Pointer(ids))
+
+	keys := make([]string, ids.length)
+	if len(keys) == 0 {
+		return keys
+	}
+
+	vector := unsafe.Slice(&ids.vector[0], len(keys))
+	for i := 0; i < len(keys); i++ {
+		id := vector[i]
+		if C.JSID_IS_STRING(id) == C.JS_TRUE {
+			keys[i] = o.cx.jsstringToString(C.JSID_TO_STRING(id))
+			continue
 		}
 
-		result = keys
-	})
+		// Integer ids, like the ones of {0: 'a'} and the array likes.
+		var val C.jsval
+		if C.JS_IdToValue(o.cx.jscx, id, &val) == C.JS_TRUE {
+			keys[i] = o.cx.jsvalToString(val)
+		}
+	}
 
-	return result
+	return keys
 }
 
 func (o *Object) SetProperty(name string, v *Value) bool {
 	var result bool
 
-	o.cx.rt.Use(func() {
-		cname := C.CString(name)
-		defer C.free(unsafe.Pointer(cname))
-
-		result = C.JS_SetProperty(o.cx.jscx, o.obj, cname, &v.val) == C.JS_TRUE
+	o.cx.useHandle(o.ref, func() {
+		if v.live() {
+			result = o.setProperty(name, v.val)
+		}
 	})
 
 	return result
@@ -202,47 +302,58 @@ type JsPropertyGetter func(g *Getter)
 type JsPropertySetter func(s *Setter)
 
 //export call_go_getter
-func call_go_getter(obj unsafe.Pointer, name *C.char, val *C.jsval) C.JSBool {
-	o := (*Object)(obj)
-	if o.getters != nil {
-		gname := C.GoString(name)
-		getter := Getter{
-			object: o,
-			name:   gname,
-		}
-		o.getters[gname](&getter)
-		if getter.result != nil {
-			*val = getter.result.val
-			return C.JS_TRUE
-		}
+func call_go_getter(c C.uintptr_t, obj *C.JSObject, name *C.char, val *C.jsval) C.JSBool {
+	o := newObject(contextOf(c), obj)
+	gname := C.GoString(name)
+
+	// The objects which inherit the property keep its value.
+	if o.data == nil || o.data.getters[gname] == nil {
+		return C.JS_TRUE
+	}
+
+	getter := Getter{
+		object: o,
+		name:   gname,
+	}
+	o.data.getters[gname](&getter)
+	if getter.result != nil {
+		*val = getter.result.val
+		return C.JS_TRUE
 	}
 	return C.JS_FALSE
 }
 
 //export call_go_setter
-func call_go_setter(obj unsafe.Pointer, name *C.char, val *C.jsval) C.JSBool {
-	o := (*Object)(obj)
-	if o.setters != nil {
-		gname := C.GoString(name)
-		setter := Setter{
-			object: o,
-			name:   gname,
-			value:  newValue(o.cx, *val),
-		}
-		o.setters[gname](&setter)
+func call_go_setter(c C.uintptr_t, obj *C.JSObject, name *C.char, val *C.jsval) C.JSBool {
+	o := newObject(contextOf(c), obj)
+	gname := C.GoString(name)
+
+	if o.data == nil || o.data.setters[gname] == nil {
 		return C.JS_TRUE
 	}
-	return C.JS_FALSE
+
+	setter := Setter{
+		object: o,
+		name:   gname,
+		value:  newValue(o.cx, *val),
+	}
+	o.data.setters[gname](&setter)
+	return C.JS_TRUE
 }
 
+// Define a property by Go callbacks.
+// The objects which aren't created by Context.NewObject(), like the global
+// object, keep the callbacks and stay alive until the context is disposed.
 func (o *Object) DefineProperty(name string, value *Value, getter JsPropertyGetter, setter JsPropertySetter, attrs JsPropertyAttrs) bool {
 	var result bool
 
-	o.cx.rt.Use(func() {
+	o.cx.useHandle(o.ref, func() {
 		if C.JS_IsArrayObject(o.cx.jscx, o.obj) == C.JS_TRUE {
 			panic("Could't define property on array.")
 		}
 
+		o.data = o.cx.attachData(o.obj, o.data)
+
 		cname := C.CString(name)
 		defer C.free(unsafe.Pointer(cname))
 
@@ -260,17 +371,17 @@ func (o *Object) DefineProperty(name string, value *Value, getter JsPropertyGett
 
 		if r == C.JS_TRUE {
 			if getter != nil {
-				if o.getters == nil {
-					o.getters = make(map[string]JsPropertyGetter)
+				if o.data.getters == nil {
+					o.data.getters = make(map[string]JsPropertyGetter)
 				}
-				o.getters[name] = getter
+				o.data.getters[name] = getter
 			}
 
 			if setter != nil {
-				if o.setters == nil {
-					o.setters = make(map[string]JsPropertySetter)
+				if o.data.setters == nil {
+					o.data.setters = make(map[string]JsPropertySetter)
 				}
-				o.setters[name] = setter
+				o.data.setters[name] = setter
 			}
 
 			result = true
@@ -281,17 +392,25 @@ func (o *Object) DefineProperty(name string, value *Value, getter JsPropertyGett
 }
 
 //export call_go_obj_func
-func call_go_obj_func(op unsafe.Pointer, name *C.char, argc C.uintN, vp *C.jsval) C.JSBool {
-	var o = (*Object)(op)
+func call_go_obj_func(c C.uintptr_t, obj *C.JSObject, name *C.char, argc C.uintN, vp *C.jsval) C.JSBool {
+	var o = newObject(contextOf(c), obj)
+
+	var gname = C.GoString(name)
+	var callback JsObjectFunc
+	if o.data != nil {
+		callback = o.data.funcs[gname]
+	}
+	if callback == nil {
+		o.cx.throwError(gname + " called on incompatible object")
+		return C.JS_FALSE
+	}
 
 	var argv = make([]*Value, int(argc))
 
 	for i := 0; i < len(argv); i++ {
 		argv[i] = newValue(o.cx, C.GET_ARGV(o.cx.jscx, vp, C.int(i)))
 	}
-
-	var gname = C.GoString(name)
-	var result = o.funcs[gname](o, gname, argv)
+	var result = callback(o, gname, argv)
 
 	if result != nil {
 		C.SET_RVAL(o.cx.jscx, vp, result.val)
@@ -304,22 +423,25 @@ func call_go_obj_func(op unsafe.Pointer, name *C.char, argc C.uintN, vp *C.jsval
 // Define a function into object
 // @name     The function name
 // @callback The function implement
+// The objects which aren't created by Context.NewObject() keep the callback until the context is disposed.
 func (o *Object) DefineFunction(name string, callback JsObjectFunc) bool {
 	var result bool
 
-	o.cx.rt.Use(func() {
+	o.cx.useHandle(o.ref, func() {
+		o.data = o.cx.attachData(o.obj, o.data)
+
 		cname := C.CString(name)
 		defer C.free(unsafe.Pointer(cname))
 
 		if C.JS_DefineFunction(o.cx.jscx, o.obj, cname, C.the_go_obj_func_callback, 0, 0) == nil {
-			result = false
+			return
 		}
 
-		if o.funcs == nil {
-			o.funcs = make(map[string]JsObjectFunc)
+		if o.data.funcs == nil {
+			o.data.funcs = make(map[string]JsObjectFunc)
 		}
 
-		o.funcs[name] = callback
+		o.data.funcs[name] = callback
 
 		result = true
 	})
@@ -329,70 +451,129 @@ func (o *Object) DefineFunction(name string, callback JsObjectFunc) bool {
 
 /*
 Utilities
+Each of them takes one hop to the runtime thread.
 */
 
 func (o *Object) GetInt(name string) (int32, bool) {
-	if v := o.GetProperty(name); v != nil {
-		return v.ToInt()
-	}
-	return 0, false
+	var result1 int32
+	var result2 bool
+	o.cx.useHandle(o.ref, func() {
+		if v, ok := o.getValue(name); ok {
+			defer v.ref.remove()
+			result1, result2 = o.cx.jsvalToInt(v.val)
+		}
+	})
+	return result1, result2
 }
 
 func (o *Object) SetInt(name string, v int32) bool {
-	return o.SetProperty(name, o.cx.Int(v))
+	var result bool
+	o.cx.useHandle(o.ref, func() {
+		result = o.setProperty(name, C.INT_TO_JSVAL(C.int32(v)))
+	})
+	return result
 }
 
 func (o *Object) GetNumber(name string) (float64, bool) {
-	if v := o.GetProperty(name); v != nil {
-		return v.ToNumber()
-	}
-	return 0, false
+	var result1 float64
+	var result2 bool
+	o.cx.useHandle(o.ref, func() {
+		if v, ok := o.getValue(name); ok {
+			defer v.ref.remove()
+			result1, result2 = o.cx.jsvalToNumber(v.val)
+		}
+	})
+	return result1, result2
 }
 
 func (o *Object) SetNumber(name string, v float64) bool {
-	return o.SetProperty(name, o.cx.Number(v))
+	var result bool
+	o.cx.useHandle(o.ref, func() {
+		result = o.setProperty(name, C.DOUBLE_TO_JSVAL(C.jsdouble(v)))
+	})
+	return result
 }
 
 func (o *Object) GetBoolean(name string) (bool, bool) {
-	if v := o.GetProperty(name); v != nil {
-		return v.ToBoolean()
-	}
-	return false, false
+	var result1 bool
+	var result2 bool
+	o.cx.useHandle(o.ref, func() {
+		if v, ok := o.getValue(name); ok {
+			defer v.ref.remove()
+			result1, result2 = o.cx.jsvalToBoolean(v.val)
+		}
+	})
+	return result1, result2
 }
 
 func (o *Object) SetBoolean(name string, v bool) bool {
-	return o.SetProperty(name, o.cx.Boolean(v))
+	var result bool
+	o.cx.useHandle(o.ref, func() {
+		result = o.setProperty(name, boolToJsval(v))
+	})
+	return result
 }
 
 func (o *Object) GetString(name string) (string, bool) {
-	if v := o.GetProperty(name); v != nil {
-		return v.ToString(), true
-	}
-	return "", false
+	var result1 string
+	var result2 bool
+	o.cx.useHandle(o.ref, func() {
+		if v, ok := o.getValue(name); ok {
+			defer v.ref.remove()
+			result1, result2 = o.cx.jsvalToString(v.val), true
+		}
+	})
+	return result1, result2
 }
 
 func (o *Object) SetString(name string, v string) bool {
-	return o.SetProperty(name, o.cx.String(v))
+	var result bool
+	o.cx.useHandle(o.ref, func() {
+		tmp := newValue(o.cx, o.cx.newString(v))
+		defer tmp.ref.remove()
+		result = o.setProperty(name, tmp.val)
+	})
+	return result
 }
 
 func (o *Object) GetObject(name string) *Object {
-	if v := o.GetProperty(name); v != nil {
-		return v.ToObject()
-	}
-	return nil
+	var result *Object
+	o.cx.useHandle(o.ref, func() {
+		if v, ok := o.getValue(name); ok {
+			defer v.ref.remove()
+			result = o.cx.jsvalToObject(v.val)
+		}
+	})
+	return result
 }
 
 func (o *Object) SetObject(name string, o2 *Object) bool {
-	return o.SetProperty(name, o2.ToValue())
+	var result bool
+	o.cx.useHandle(o.ref, func() {
+		if !o2.ref.isReleased() {
+			result = o.setProperty(name, C.OBJECT_TO_JSVAL(o2.obj))
+		}
+	})
+	return result
 }
 
 func (o *Object) GetArray(name string) *Array {
-	if v := o.GetProperty(name); v != nil {
-		return v.ToArray()
-	}
-	return nil
+	var result *Array
+	o.cx.useHandle(o.ref, func() {
+		if v, ok := o.getValue(name); ok {
+			defer v.ref.remove()
+			result = o.cx.jsvalToArray(v.val)
+		}
+	})
+	return result
 }
 
 func (o *Object) SetArray(name string, o2 *Array) bool {
-	return o.SetProperty(name, o2.ToValue())
+	var result bool
+	o.cx.useHandle(o.ref, func() {
+		if !o2.ref.isReleased() {
+			result = o.setProperty(name, C.OBJECT_TO_JSVAL(o2.obj))
+		}
+	})
+	return result
 }
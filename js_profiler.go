@@ -0,0 +1,193 @@
+package monkey
+
+/*
+#include "monkey.h"
+*/
+import "C"
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
+
+// Profile is a CPU profile of scripts in the pprof format,
+// Write() saves it for "go tool pprof".
+type Profile = profile.Profile
+
+// ErrProfiling is returned by StartProfiling() when the context is already profiled.
+var ErrProfiling = errors.New("monkey: context is already profiled")
+
+// The interval of the samples of the profiler.
+const profilingInterval = 10 * time.Millisecond
+
+type profileFrame struct {
+	function string
+	file     string
+	line     int
+}
+
+type profileSample struct {
+	frames []profileFrame
+	count  int64
+}
+
+type profiler struct {
+	start   time.Time
+	samples map[string]*profileSample
+	pending int32
+	stop    chan struct{}
+}
+
+// StartProfiling samples the call stacks of the scripts running in the
+// context, until StopProfiling() is called.
+func (c *Context) StartProfiling() error {
+	var err error
+
+	if err2 := c.use(func() {
+		if c.profiler != nil {
+			err = ErrProfiling
+			return
+		}
+
+		p := &profiler{
+			start:   time.Now(),
+			samples: make(map[string]*profileSample),
+			stop:    make(chan struct{}),
+		}
+		c.profiler = p
+
+		go func() {
+			ticker := time.NewTicker(profilingInterval)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-ticker.C:
+					atomic.StoreInt32(&p.pending, 1)
+					c.triggerOperationCallback()
+				case <-p.stop:
+					return
+				}
+			}
+		}()
+	}); err2 != nil {
+		return err2
+	}
+
+	return err
+}
+
+// StopProfiling stops the profiler and returns the profile,
+// nil when the context isn't profiled.
+func (c *Context) StopProfiling() *Profile {
+	var result *Profile
+
+	c.use(func() {
+		if p := c.stopProfiling(); p != nil {
+			result = p.profile()
+		}
+	})
+
+	return result
+}
+
+// Must be called in the runtime thread.
+func (c *Context) stopProfiling() *profiler {
+	p := c.profiler
+	if p != nil {
+		close(p.stop)
+		c.profiler = nil
+	}
+	return p
+}
+
+// Record the call stack if a sample is due, called by the operation callback.
+func (p *profiler) sample(c *Context) {
+	if !atomic.CompareAndSwapInt32(&p.pending, 1, 0) {
+		return
+	}
+
+	frames := c.scriptFrames()
+	if len(frames) == 0 {
+		return
+	}
+
+	stack := make([]profileFrame, len(frames))
+	var key []byte
+	for i, f := range frames {
+		function, file, line := c.frameLocation(f)
+		if function == "" {
+			if C.JS_GetFrameFunction(c.jscx, f.fp) == nil {
+				function = "(top level)"
+			} else {
+				function = "(anonymous)"
+			}
+		}
+		stack[i] = profileFrame{function, file, line}
+		key = append(key, function...)
+		key = append(key, 0)
+		key = append(key, file...)
+		key = append(key, 0, byte(line), byte(line>>8), byte(line>>16), byte(line>>24))
+	}
+
+	if s, ok := p.samples[string(key)]; ok {
+		s.count++
+	} else {
+		p.samples[string(key)] = &profileSample{stack, 1}
+	}
+}
+
+// Build the pprof profile of the samples.
+func (p *profiler) profile() *Profile {
+	prof := &profile.Profile{
+		SampleType: []*profile.ValueType{
+			{Type: "samples", Unit: "count"},
+			{Type: "cpu", Unit: "nanoseconds"},
+		},
+		PeriodType:    &profile.ValueType{Type: "cpu", Unit: "nanoseconds"},
+		Period:        int64(profilingInterval),
+		TimeNanos:     p.start.UnixNano(),
+		DurationNanos: int64(time.Since(p.start)),
+	}
+
+	type functionKey struct{ name, file string }
+	functions := make(map[functionKey]*profile.Function)
+	locations := make(map[profileFrame]*profile.Location)
+
+	for _, s := range p.samples {
+		sample := &profile.Sample{
+			Value: []int64{s.count, s.count * int64(profilingInterval)},
+		}
+
+		for _, f := range s.frames {
+			loc, ok := locations[f]
+			if !ok {
+				fn, ok := functions[functionKey{f.function, f.file}]
+				if !ok {
+					fn = &profile.Function{
+						ID:         uint64(len(prof.Function) + 1),
+						Name:       f.function,
+						SystemName: f.function,
+						Filename:   f.file,
+					}
+					functions[functionKey{f.function, f.file}] = fn
+					prof.Function = append(prof.Function, fn)
+				}
+
+				loc = &profile.Location{
+					ID:   uint64(len(prof.Location) + 1),
+					Line: []profile.Line{{Function: fn, Line: int64(f.line)}},
+				}
+				locations[f] = loc
+				prof.Location = append(prof.Location, loc)
+			}
+			sample.Location = append(sample.Location, loc)
+		}
+
+		prof.Sample = append(prof.Sample, sample)
+	}
+
+	return prof
+}
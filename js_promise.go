@@ -0,0 +1,448 @@
+package monkey
+
+/*
+#include "monkey.h"
+*/
+import "C"
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrAwaitInRuntime is returned by Value.Await() when it's called in the runtime thread,
+// where waiting would block the work which settles the promise.
+var ErrAwaitInRuntime = errors.New("monkey: can't await in the runtime thread")
+
+// PromiseError is the error of a rejected promise.
+type PromiseError struct {
+	Reason  *Value
+	message string
+}
+
+func (e *PromiseError) Error() string {
+	return e.message
+}
+
+// Promise of ES2015, the engine doesn't have it.
+// The reactions are queued as microtasks by the native queueMicrotask().
+// The script returns the helpers used by Go.
+const promiseScript = `(function(global, enqueue) {
+	var PENDING = 0, FULFILLED = 1, REJECTED = 2;
+
+	function isObject(x) {
+		return x !== null && (typeof x == 'object' || typeof x == 'function');
+	}
+
+	function hide(obj, name, value) {
+		Object.defineProperty(obj, name, {value: value, writable: true, configurable: true});
+	}
+
+	function isPromise(x) {
+		return isObject(x) && Object.prototype.hasOwnProperty.call(x, '__state');
+	}
+
+	function createResolvingFunctions(promise) {
+		var done = false;
+		return {
+			resolve: function(x) {
+				if (done) return;
+				done = true;
+				resolvePromise(promise, x);
+			},
+			reject: function(r) {
+				if (done) return;
+				done = true;
+				settle(promise, REJECTED, r);
+			}
+		};
+	}
+
+	function resolvePromise(promise, x) {
+		if (x === promise) {
+			settle(promise, REJECTED, new TypeError('Chaining cycle detected for promise'));
+			return;
+		}
+		if (!isObject(x)) {
+			settle(promise, FULFILLED, x);
+			return;
+		}
+		var then;
+		try {
+			then = x.then;
+		} catch (e) {
+			settle(promise, REJECTED, e);
+			return;
+		}
+		if (typeof then != 'function') {
+			settle(promise, FULFILLED, x);
+			return;
+		}
+		enqueue(function() {
+			var fns = createResolvingFunctions(promise);
+			try {
+				then.call(x, fns.resolve, fns.reject);
+			} catch (e) {
+				fns.reject(e);
+			}
+		});
+	}
+
+	function settle(promise, state, value) {
+		var reactions = promise.__reactions;
+		promise.__state = state;
+		promise.__value = value;
+		promise.__reactions = undefined;
+		for (var i = 0; i < reactions.length; i++) {
+			schedule(reactions[i], state, value);
+		}
+	}
+
+	function schedule(reaction, state, value) {
+		enqueue(function() {
+			var handler = state == FULFILLED ? reaction.onFulfilled : reaction.onRejected;
+			if (typeof handler != 'function') {
+				if (state == FULFILLED) reaction.resolve(value);
+				else reaction.reject(value);
+				return;
+			}
+			var result;
+			try {
+				result = handler(value);
+			} catch (e) {
+				reaction.reject(e);
+				return;
+			}
+			reaction.resolve(result);
+		});
+	}
+
+	function Promise(executor) {
+		if (!(this instanceof Promise)) {
+			throw new TypeError('Promise must be called with new');
+		}
+		if (typeof executor != 'function') {
+			throw new TypeError('Promise resolver is not a function');
+		}
+		hide(this, '__state', PENDING);
+		hide(this, '__value', undefined);
+		hide(this, '__reactions', []);
+		var fns = createResolvingFunctions(this);
+		try {
+			executor(fns.resolve, fns.reject);
+		} catch (e) {
+			fns.reject(e);
+		}
+	}
+
+	function deferred(C) {
+		var d = {};
+		d.promise = new C(function(resolve, reject) {
+			d.resolve = resolve;
+			d.reject = reject;
+		});
+		return d;
+	}
+
+	hide(Promise.prototype, 'then', function(onFulfilled, onRejected) {
+		if (!isPromise(this)) {
+			throw new TypeError('Promise.prototype.then called on incompatible receiver');
+		}
+		var d = deferred(Promise);
+		var reaction = {
+			onFulfilled: onFulfilled,
+			onRejected: onRejected,
+			resolve: d.resolve,
+			reject: d.reject
+		};
+		if (this.__state === PENDING) {
+			this.__reactions.push(reaction);
+		} else {
+			schedule(reaction, this.__state, this.__value);
+		}
+		return d.promise;
+	});
+
+	hide(Promise.prototype, 'catch', function(onRejected) {
+		return this.then(undefined, onRejected);
+	});
+
+	hide(Promise.prototype, 'finally', function(onFinally) {
+		if (typeof onFinally != 'function') {
+			return this.then(onFinally, onFinally);
+		}
+		return this.then(function(value) {
+			return Promise.resolve(onFinally()).then(function() { return value; });
+		}, function(reason) {
+			return Promise.resolve(onFinally()).then(function() { throw reason; });
+		});
+	});
+
+	hide(Promise, 'resolve', function(x) {
+		var C = typeof this == 'function' ? this : Promise;
+		if (isPromise(x) && x.constructor === C) return x;
+		var d = deferred(C);
+		d.resolve(x);
+		return d.promise;
+	});
+
+	hide(Promise, 'reject', function(r) {
+		var d = deferred(typeof this == 'function' ? this : Promise);
+		d.reject(r);
+		return d.promise;
+	});
+
+	function combine(C, items, onItem) {
+		var d = deferred(C);
+		var results = new Array(items.length);
+		var remaining = items.length + 1;
+		function done() {
+			if (--remaining === 0) d.resolve(results);
+		}
+		try {
+			for (var i = 0; i < items.length; i++) {
+				onItem(C.resolve(items[i]), i, results, done, d);
+			}
+		} catch (e) {
+			d.reject(e);
+		}
+		done();
+		return d.promise;
+	}
+
+	hide(Promise, 'all', function(items) {
+		return combine(this, items, function(p, i, results, done, d) {
+			p.then(function(value) {
+				results[i] = value;
+				done();
+			}, d.reject);
+		});
+	});
+
+	hide(Promise, 'allSettled', function(items) {
+		return combine(this, items, function(p, i, results, done) {
+			p.then(function(value) {
+				results[i] = {status: 'fulfilled', value: value};
+				done();
+			}, function(reason) {
+				results[i] = {status: 'rejected', reason: reason};
+				done();
+			});
+		});
+	});
+
+	hide(Promise, 'race', function(items) {
+		var C = this;
+		var d = deferred(C);
+		try {
+			for (var i = 0; i < items.length; i++) {
+				C.resolve(items[i]).then(d.resolve, d.reject);
+			}
+		} catch (e) {
+			d.reject(e);
+		}
+		return d.promise;
+	});
+
+	hide(global, 'Promise', Promise);
+
+	return {
+		deferred: function() {
+			return deferred(Promise);
+		}
+	};
+})`
+
+// Subscribe the Go target to a thenable, returns false for other values.
+// Works with the thenables of async functions without Promise too.
+const awaitScript = `(function(x, target) {
+	if (x === null || (typeof x != 'object' && typeof x != 'function') || typeof x.then != 'function') {
+		return false;
+	}
+	x.then(function(value) {
+		target.resolved(value);
+	}, function(reason) {
+		target.rejected(reason);
+	});
+	return true;
+})`
+
+// InitPromise installs Promise and queueMicrotask into the global object.
+// The reactions run as microtasks, which are drained when the outermost call of
+// Eval, Execute or Call returns, or by RunLoop().
+func (c *Context) InitPromise() bool {
+	var result bool
+
+	c.use(func() {
+		if c.promise != nil {
+			result = true
+			return
+		}
+
+		if !c.defineQueueMicrotask() {
+			return
+		}
+
+		enqueue, _ := c.GlobalObject().getProperty("queueMicrotask")
+
+		enqueueValue := newValue(c, enqueue)
+		defer enqueueValue.ref.remove()
+
+		helpers, err := c.install(promiseScript, "promise.js", enqueueValue)
+		if err != nil {
+			return
+		}
+
+		c.promise = newPinnedValue(c, helpers.val)
+		helpers.ref.remove()
+
+		result = true
+	})
+
+	return result
+}
+
+// Call a helper of the Promise script, must be called in the runtime thread.
+func (c *Context) promiseHelper(name string, argv ...*Value) (*Value, error) {
+	helpers := &Object{c, C.JSVAL_TO_OBJECT(c.promise.val), nil, nil}
+	fn, _ := helpers.getProperty(name)
+	return c.callFunction(helpers.obj, fn, argv)
+}
+
+// NewPromise creates a pending promise, which is settled by the first call of
+// resolve or reject. They can be called from any goroutine.
+// Returns nil when InitPromise() wasn't called.
+func (c *Context) NewPromise() (promise *Object, resolve, reject func(*Value)) {
+	var fresolve, freject *Value
+
+	c.use(func() {
+		if c.promise == nil {
+			return
+		}
+
+		d, err := c.promiseHelper("deferred")
+		if err != nil {
+			return
+		}
+		defer d.ref.remove()
+
+		obj := c.jsvalToObject(d.val)
+		defer obj.ref.remove()
+
+		val, _ := obj.getProperty("promise")
+		promise = newObject(c, C.JSVAL_TO_OBJECT(val))
+
+		val, _ = obj.getProperty("resolve")
+		fresolve = newPinnedValue(c, val)
+
+		val, _ = obj.getProperty("reject")
+		freject = newPinnedValue(c, val)
+	})
+
+	if promise == nil {
+		return nil, nil, nil
+	}
+
+	var once sync.Once
+
+	settle := func(fn *Value, v *Value) {
+		once.Do(func() {
+			c.use(func() {
+				if v == nil {
+					v = newValue(c, C.GET_VOID())
+				}
+				c.callFunction(nil, fn.val, []*Value{v})
+				fresolve.ref.remove()
+				freject.ref.remove()
+			})
+		})
+	}
+
+	resolve = func(v *Value) {
+		settle(fresolve, v)
+	}
+
+	reject = func(v *Value) {
+		settle(freject, v)
+	}
+
+	return
+}
+
+// Await blocks until the promise settles or ctx is done.
+// A value which isn't a thenable is returned as it is.
+// A rejection is returned as *PromiseError. Timers and async functions only
+// settle while RunLoop() is running in another goroutine.
+func (v *Value) Await(ctx context.Context) (*Value, error) {
+	c := v.cx
+
+	if c.rt.inThread() {
+		return nil, ErrAwaitInRuntime
+	}
+
+	type outcome struct {
+		value *Value
+		err   error
+	}
+
+	done := make(chan outcome, 1)
+	thenable := false
+	var failure error
+
+	if err := c.useHandle(v.ref, func() {
+		target := newGoObject(c, nil)
+		defer target.ref.remove()
+
+		target.DefineFunction("resolved", func(o *Object, name string, argv []*Value) *Value {
+			select {
+			case done <- outcome{argv[0], nil}:
+			default:
+			}
+			return newValue(c, C.GET_VOID())
+		})
+
+		target.DefineFunction("rejected", func(o *Object, name string, argv []*Value) *Value {
+			select {
+			case done <- outcome{nil, &PromiseError{argv[0], c.jsvalToString(argv[0].val)}}:
+			default:
+			}
+			return newValue(c, C.GET_VOID())
+		})
+
+		watch, err := c.evaluate(awaitScript, "", 0)
+		if err != nil {
+			failure = err
+			return
+		}
+		defer watch.ref.remove()
+
+		targetValue := newValue(c, C.OBJECT_TO_JSVAL(target.obj))
+		defer targetValue.ref.remove()
+
+		// The then getter or the then method can throw.
+		r, err := c.callFunction(nil, watch.val, []*Value{v, targetValue})
+		if err != nil {
+			failure = err
+			return
+		}
+		thenable = C.JSVAL_TO_BOOLEAN(r.val) == C.JS_TRUE
+		r.ref.remove()
+	}); err != nil {
+		return nil, err
+	}
+
+	if failure != nil {
+		return nil, failure
+	}
+
+	if !thenable {
+		return v, nil
+	}
+
+	select {
+	case r := <-done:
+		return r.value, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,278 @@
+package monkey
+
+/*
+#include "monkey.h"
+*/
+import "C"
+import (
+	"encoding/json"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// ModuleLoader creates the exports of a native module.
+// It's called in the runtime thread when the module is required the first time.
+type ModuleLoader func(cx *Context) (*Value, error)
+
+// Modules of a context.
+type moduleSystem struct {
+	fsys    fs.FS
+	natives map[string]ModuleLoader
+}
+
+// The require() of CommonJS, the modules are cached by the resolved file name.
+// Cycles get the unfinished exports of the module which is loading, like Node.js.
+// Go does the resolving and reading by the host object.
+const requireScript = `(function(global, host) {
+	var cache = {};
+
+	function makeRequire(from) {
+		function require(id) {
+			if (typeof id != 'string' || id === '') {
+				throw new TypeError('The module id must be a non-empty string');
+			}
+
+			var key = host.resolve(id, from);
+			if (key in cache) return cache[key].exports;
+
+			var module = {id: key, filename: key, exports: {}, loaded: false};
+			cache[key] = module;
+
+			try {
+				if (key.charAt(0) == ':') {
+					module.exports = host.native(key.slice(1));
+				} else if (/\.json$/.test(key)) {
+					module.exports = JSON.parse(host.read(key));
+				} else {
+					var fn = host.compile(key);
+					module.require = makeRequire(key);
+					fn.call(module.exports, module.exports, module.require, module, key, key.replace(/\/?[^\/]*$/, ''));
+				}
+			} catch (e) {
+				delete cache[key];
+				throw e;
+			}
+
+			module.loaded = true;
+			return module.exports;
+		}
+
+		require.resolve = function(id) {
+			return host.resolve(String(id), from);
+		};
+		require.cache = cache;
+
+		return require;
+	}
+
+	global.require = makeRequire('');
+})`
+
+// InitRequire installs require() into the global object.
+// The modules are read from fsys, nil means only the native modules.
+// Relative ids are resolved from the requiring module. The others are native
+// modules, or are resolved from the node_modules directories and then from the
+// root of fsys. Files, .js, .json, package.json main and index files are tried
+// in this order.
+func (c *Context) InitRequire(fsys fs.FS) bool {
+	var result bool
+
+	c.use(func() {
+		m := c.moduleSystem()
+		m.fsys = fsys
+
+		host := newGoObject(c, nil)
+		defer host.ref.remove()
+
+		host.DefineFunction("resolve", func(o *Object, name string, argv []*Value) *Value {
+			id := c.jsvalToString(argv[0].val)
+			key, ok := m.resolve(id, c.jsvalToString(argv[1].val))
+			if !ok {
+				c.throwError("Cannot find module '" + id + "'")
+				return nil
+			}
+			return newValue(c, c.newString(key))
+		})
+
+		host.DefineFunction("read", func(o *Object, name string, argv []*Value) *Value {
+			key := c.jsvalToString(argv[0].val)
+			data, err := fs.ReadFile(m.fsys, key)
+			if err != nil {
+				c.throwError(err.Error())
+				return nil
+			}
+			return newValue(c, c.newString(string(data)))
+		})
+
+		host.DefineFunction("compile", func(o *Object, name string, argv []*Value) *Value {
+			key := c.jsvalToString(argv[0].val)
+			data, err := fs.ReadFile(m.fsys, key)
+			if err != nil {
+				c.throwError(err.Error())
+				return nil
+			}
+
+			source := string(data)
+			if strings.HasPrefix(source, "#!") {
+				source = "//" + source
+			}
+
+			// Keep the first line of the source in the first line of the wrapper,
+			// so the line numbers of errors are right.
+			fn, err := c.evaluate("(function (exports, require, module, __filename, __dirname) {"+source+"\n})", key, 1)
+			c.coverSource(key, 1, source)
+			if err != nil {
+				// Nested in require(), the SyntaxError is usually pending already.
+				if C.JS_IsExceptionPending(c.jscx) != C.JS_TRUE {
+					c.throwError(err.Error())
+				}
+				return nil
+			}
+			return fn
+		})
+
+		host.DefineFunction("native", func(o *Object, name string, argv []*Value) *Value {
+			id := c.jsvalToString(argv[0].val)
+			loader, ok := m.natives[id]
+			if !ok {
+				c.throwError("Cannot find module '" + id + "'")
+				return nil
+			}
+			exports, err := loader(c)
+			if err != nil {
+				c.throwError(err.Error())
+				return nil
+			}
+			if exports == nil {
+				return newValue(c, C.GET_VOID())
+			}
+			return exports
+		})
+
+		hostValue := newValue(c, C.OBJECT_TO_JSVAL(host.obj))
+		defer hostValue.ref.remove()
+
+		v, err := c.install(requireScript, "require.js", hostValue)
+		if err != nil {
+			return
+		}
+		v.ref.remove()
+
+		result = true
+	})
+
+	return result
+}
+
+// RegisterModule registers a native module, which is found by its name
+// before the files. It can be called before or after InitRequire().
+func (c *Context) RegisterModule(name string, loader ModuleLoader) bool {
+	if name == "" || loader == nil {
+		return false
+	}
+
+	return c.use(func() {
+		c.moduleSystem().natives[name] = loader
+	}) == nil
+}
+
+// Must be called in the runtime thread.
+func (c *Context) moduleSystem() *moduleSystem {
+	if c.modules == nil {
+		c.modules = &moduleSystem{natives: make(map[string]ModuleLoader)}
+	}
+	return c.modules
+}
+
+// Resolve a module id to the cache key, from is the file name of the requiring module.
+// Native modules are keyed by ":name".
+func (m *moduleSystem) resolve(id, from string) (string, bool) {
+	if id == "." || id == ".." || strings.HasPrefix(id, "./") || strings.HasPrefix(id, "../") || strings.HasPrefix(id, "/") {
+		var p string
+		if strings.HasPrefix(id, "/") {
+			p = path.Clean(id[1:])
+		} else {
+			p = path.Join(path.Dir(from), id)
+		}
+
+		if p == ".." || strings.HasPrefix(p, "../") {
+			return "", false
+		}
+
+		return m.resolvePath(p)
+	}
+
+	if _, ok := m.natives[id]; ok {
+		return ":" + id, true
+	}
+
+	for dir := path.Dir(from); ; dir = path.Dir(dir) {
+		if key, ok := m.resolvePath(path.Join(dir, "node_modules", id)); ok {
+			return key, true
+		}
+		if dir == "." || dir == "/" {
+			break
+		}
+	}
+
+	// The root of fsys is the last directory of the bare ids.
+	if p := path.Clean(id); p != ".." && !strings.HasPrefix(p, "../") {
+		return m.resolvePath(p)
+	}
+
+	return "", false
+}
+
+func (m *moduleSystem) resolvePath(p string) (string, bool) {
+	if m.fsys == nil {
+		return "", false
+	}
+
+	if key, ok := m.resolveFile(p); ok {
+		return key, true
+	}
+
+	if data, err := fs.ReadFile(m.fsys, path.Join(p, "package.json")); err == nil {
+		var pkg struct {
+			Main string `json:"main"`
+		}
+		if json.Unmarshal(data, &pkg) == nil && pkg.Main != "" {
+			main := path.Join(p, pkg.Main)
+			if key, ok := m.resolveFile(main); ok {
+				return key, true
+			}
+			if key, ok := m.resolveIndex(main); ok {
+				return key, true
+			}
+		}
+	}
+
+	return m.resolveIndex(p)
+}
+
+func (m *moduleSystem) resolveFile(p string) (string, bool) {
+	for _, name := range []string{p, p + ".js", p + ".json"} {
+		if m.isFile(name) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+func (m *moduleSystem) resolveIndex(p string) (string, bool) {
+	for _, name := range []string{"index.js", "index.json"} {
+		if name := path.Join(p, name); m.isFile(name) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+func (m *moduleSystem) isFile(name string) bool {
+	if !fs.ValidPath(name) {
+		return false
+	}
+	info, err := fs.Stat(m.fsys, name)
+	return err == nil && !info.IsDir()
+}
@@ -0,0 +1,254 @@
+package monkey
+
+/*
+#include "monkey.h"
+*/
+import "C"
+import (
+	"runtime/debug"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Handle is a Go reference to a JavaScript thing which holds a GC root.
+// Value, Object, Array and Script are handles.
+type Handle interface {
+	// Release removes the GC root immediately. It's safe to call it many times.
+	Release()
+
+	root() *rootRef
+}
+
+// rootRef is a GC root owned by a handle.
+// The rooted slot is allocated in C memory, so SpiderMonkey never keeps pointers into Go memory.
+// Fields except released are only touched in the runtime thread.
+type rootRef struct {
+	cx       *Context
+	kind     string
+	val      *C.jsval
+	obj      **C.JSObject
+	scope    *Scope
+	stack    []byte
+	released int32
+}
+
+func (r *Runtime) addRoot(cx *Context, kind string) *rootRef {
+	ref := &rootRef{cx: cx, kind: kind, scope: cx.scope}
+
+	if r.getLeakReporter() != nil {
+		ref.stack = debug.Stack()
+	}
+
+	if ref.scope != nil {
+		ref.scope.refs = append(ref.scope.refs, ref)
+	}
+
+	r.roots[ref] = struct{}{}
+
+	return ref
+}
+
+func (r *Runtime) addValueRoot(cx *Context, val C.jsval) *rootRef {
+	ref := r.addRoot(cx, "value")
+	ref.val = (*C.jsval)(C.malloc(C.size_t(unsafe.Sizeof(val))))
+	*ref.val = val
+	C.JS_AddValueRoot(cx.jscx, ref.val)
+	return ref
+}
+
+func (r *Runtime) addObjectRoot(cx *Context, obj *C.JSObject, kind string) *rootRef {
+	ref := r.addRoot(cx, kind)
+	ref.obj = (**C.JSObject)(C.malloc(C.size_t(unsafe.Sizeof(obj))))
+	*ref.obj = obj
+	C.JS_AddObjectRoot(cx.jscx, ref.obj)
+	return ref
+}
+
+// Remove the root. Must be called in the runtime thread.
+func (ref *rootRef) remove() {
+	if !atomic.CompareAndSwapInt32(&ref.released, 0, 1) {
+		return
+	}
+
+	jscx := ref.cx.jscx
+
+	if ref.val != nil {
+		C.JS_RemoveValueRoot(jscx, ref.val)
+		C.free(unsafe.Pointer(ref.val))
+		ref.val = nil
+	}
+
+	if ref.obj != nil {
+		C.JS_RemoveObjectRoot(jscx, ref.obj)
+		C.free(unsafe.Pointer(ref.obj))
+		ref.obj = nil
+	}
+
+	delete(ref.cx.rt.roots, ref)
+}
+
+func (ref *rootRef) isReleased() bool {
+	return ref != nil && atomic.LoadInt32(&ref.released) == 1
+}
+
+// Release the root from any goroutine.
+func (ref *rootRef) release() {
+	if ref == nil || ref.isReleased() {
+		return
+	}
+	ref.cx.use(func() {
+		ref.remove()
+	})
+}
+
+// Executes the callback in the runtime thread if the context is still alive and
+// the handle isn't released, so the methods of released handles return zero values.
+func (c *Context) useHandle(ref *rootRef, callback func()) error {
+	var err error
+	if err2 := c.use(func() {
+		if ref.isReleased() {
+			err = ErrDisposed
+			return
+		}
+		callback()
+	}); err2 != nil {
+		return err2
+	}
+	return err
+}
+
+// Called by the Go garbage collector when a handle was dropped without Release.
+// Finalizers never block: the root is queued and removed later by the runtime thread.
+func (ref *rootRef) finalize() {
+	if atomic.LoadInt32(&ref.released) == 1 {
+		return
+	}
+
+	rt := ref.cx.rt
+
+	if atomic.LoadInt32(&rt.closed) == 1 {
+		return
+	}
+
+	if reporter := rt.getLeakReporter(); reporter != nil && ref.stack != nil {
+		reporter(&LeakReport{
+			Runtime: rt,
+			Kind:    ref.kind,
+			Stack:   string(ref.stack),
+		})
+	}
+
+	rt.releaseMutex.Lock()
+	rt.releaseQueue = append(rt.releaseQueue, ref)
+	rt.releaseMutex.Unlock()
+
+	select {
+	case rt.releaseWake <- struct{}{}:
+	default:
+	}
+}
+
+// Remove the roots queued by finalizers. Must be called in the runtime thread.
+func (r *Runtime) drainReleaseQueue() {
+	r.releaseMutex.Lock()
+	queue := r.releaseQueue
+	r.releaseQueue = nil
+	r.releaseMutex.Unlock()
+
+	for _, ref := range queue {
+		ref.remove()
+	}
+}
+
+// LiveRoots returns the number of GC roots currently held by Go handles.
+func (r *Runtime) LiveRoots() int {
+	var result int
+	r.Use(func() {
+		result = len(r.roots)
+	})
+	return result
+}
+
+// LeakReport describes a handle collected by Go without being released.
+type LeakReport struct {
+	Runtime *Runtime
+	Kind    string // "value", "object", "array" or "script"
+	Stack   string // The stack trace of the handle's allocation
+}
+
+type LeakReporter func(report *LeakReport)
+
+// SetLeakReporter turns on the leak debug mode.
+// Every handle created after this call records its allocation stack trace,
+// and the reporter is called from the finalizer goroutine when a handle is
+// garbage collected without Release. Pass nil to turn it off.
+// The debug mode is slow, don't use it in production.
+func (r *Runtime) SetLeakReporter(reporter LeakReporter) {
+	r.leakReporter.Store(reporter)
+}
+
+func (r *Runtime) getLeakReporter() LeakReporter {
+	reporter, _ := r.leakReporter.Load().(LeakReporter)
+	return reporter
+}
+
+// Scope is an arena of handles.
+// Every handle created in the scope's context while the scope is active
+// is released when the scope ends.
+type Scope struct {
+	cx     *Context
+	parent *Scope
+	refs   []*rootRef
+}
+
+// Scope runs the callback in the runtime thread and releases all the handles
+// created in it when the callback returns.
+// Use Escape() to keep a handle alive after the scope.
+func (c *Context) Scope(callback func(s *Scope)) {
+	c.use(func() {
+		s := &Scope{cx: c, parent: c.scope}
+		c.scope = s
+		defer func() {
+			c.scope = s.parent
+			s.release()
+		}()
+		callback(s)
+	})
+}
+
+func (s *Scope) Context() *Context {
+	return s.cx
+}
+
+// Escape moves the handle out of the scope to its parent scope,
+// or makes it unscoped when this is the outermost scope.
+func (s *Scope) Escape(h Handle) {
+	ref := h.root()
+	if ref == nil || ref.scope != s {
+		return
+	}
+	ref.scope = s.parent
+	if s.parent != nil {
+		s.parent.refs = append(s.parent.refs, ref)
+	}
+}
+
+func (s *Scope) release() {
+	for _, ref := range s.refs {
+		if ref.scope == s {
+			ref.remove()
+		}
+	}
+	s.refs = nil
+}
+
+// Create a value which doesn't belong to any scope, for the values kept by Monkey itself.
+// Must be called in the runtime thread.
+func newPinnedValue(cx *Context, val C.jsval) *Value {
+	scope := cx.scope
+	cx.scope = nil
+	defer func() {
+		cx.scope = scope
+	}()
+	return newValue(cx, val)
+}
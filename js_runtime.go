@@ -8,33 +8,37 @@ package monkey
 */
 import "C"
 import (
-	"runtime"
+	"errors"
+	"sync"
 	"sync/atomic"
-
-	"github.com/huandu/goroutine"
 )
 
 var defaultRuntime Runtime
 
+// ErrDisposed is returned by calls on a closed runtime or disposed context.
+var ErrDisposed = errors.New("monkey: runtime or context disposed")
+
+// ErrCloseInRuntime is returned when Close is called in the runtime thread.
+var ErrCloseInRuntime = errors.New("monkey: can't close runtime in its own thread")
+
 // Runtime describes JavaScript runtime
 type Runtime struct {
-	maxbytes       uint32
-	jsrt           *C.JSRuntime
-	goid           int64
-	disposed       int64
-	initChan       chan bool
-	workChan       chan jswork
-	closeChan      chan int
-	ctxDisposeChan chan *Context
-	objDisposeChan chan *Object
-	aryDisposeChan chan *Array
-	valDisposeChan chan *Value
-	sptDisposeChan chan *Script
-}
-
-type jswork struct {
-	callback   func()
-	resultChan chan int
+	maxbytes     uint32
+	jsrt         *C.JSRuntime
+	exec         executor
+	closed       int32
+	initChan     chan bool
+	works        *workQueue
+	closeChan    chan int
+	done         chan struct{}
+	contexts     []*Context
+	roots        map[*rootRef]struct{}
+	releaseMutex sync.Mutex
+	releaseQueue []*rootRef
+	releaseWake  chan struct{}
+	leakReporter atomic.Value
+	debugHooks   bool
+	budgets      int
 }
 
 // NewRuntime initializes the JavaScript runtime.
@@ -58,10 +62,8 @@ func NewRuntime(maxbytes uint32) *Runtime {
 }
 
 func (r *Runtime) init() {
-	runtime.LockOSThread()
-	defer runtime.UnlockOSThread()
-
-	r.goid = goroutine.GoroutineId()
+	r.exec.lock()
+	defer r.exec.unlock()
 
 	r.jsrt = C.JS_NewRuntime(C.uint32(r.maxbytes))
 	if r.jsrt == nil {
@@ -69,70 +71,138 @@ func (r *Runtime) init() {
 		return
 	}
 
-	r.workChan = make(chan jswork, 20)
+	r.works = newWorkQueue()
 	r.closeChan = make(chan int, 1)
-	r.ctxDisposeChan = make(chan *Context, 50)
-	r.objDisposeChan = make(chan *Object, 100)
-	r.aryDisposeChan = make(chan *Array, 100)
-	r.valDisposeChan = make(chan *Value, 100)
-	r.sptDisposeChan = make(chan *Script, 100)
-
-	runtime.SetFinalizer(r, func(r *Runtime) {
-		r.Dispose()
-	})
+	r.done = make(chan struct{})
+	r.roots = make(map[*rootRef]struct{})
+	r.releaseWake = make(chan struct{}, 1)
 
 	r.initChan <- true
 
 L:
 	for {
+		if work, ok := r.works.pop(); ok {
+			work.run()
+
+			select {
+			case _ = <-r.releaseWake:
+				r.drainReleaseQueue()
+			default:
+			}
+
+			continue
+		}
+
 		select {
-		case work := <-r.workChan:
-			work.callback()
-			work.resultChan <- 1
-		case ctx := <-r.ctxDisposeChan:
-			C.JS_DestroyContext(ctx.jscx)
-		case obj := <-r.objDisposeChan:
-			C.JS_RemoveObjectRoot(obj.cx.jscx, &obj.obj)
-		case ary := <-r.aryDisposeChan:
-			C.JS_RemoveObjectRoot(ary.cx.jscx, &ary.obj)
-		case val := <-r.valDisposeChan:
-			C.JS_RemoveValueRoot(val.cx.jscx, &val.val)
-		case spt := <-r.sptDisposeChan:
-			C.JS_RemoveObjectRoot(spt.cx.jscx, &spt.obj)
+		case _ = <-r.works.wake:
+		case _ = <-r.releaseWake:
+			r.drainReleaseQueue()
 		case _ = <-r.closeChan:
 			break L
 		}
 	}
 
+	r.shutdown()
+}
+
+// Finish the pending work, destroy the contexts in creation order and then the runtime.
+func (r *Runtime) shutdown() {
+	for {
+		work, ok := r.works.pop()
+		if !ok {
+			break
+		}
+		work.run()
+	}
+
+	// Work posted during the last round runs before the contexts destroyed.
+	for _, work := range r.works.close() {
+		work.run()
+	}
+
+	r.drainReleaseQueue()
+
+	for len(r.contexts) > 0 {
+		r.contexts[0].destroy()
+	}
+
 	C.JS_DestroyRuntime(r.jsrt)
+	r.jsrt = nil
+
+	close(r.done)
+}
+
+func (r *Runtime) inThread() bool {
+	return r.exec.inThread()
 }
 
 // Use executes the callback in runtime creator thread.
+// Calling Use in the runtime thread, e.g. in a Go function called by JavaScript
+// or in another Use callback, executes the callback in place.
 // Use this method to avoid Monkey internal call it many times.
 // See the benchmarks in "monkey_test.go".
-func (r *Runtime) Use(callback func()) {
-	if goroutine.GoroutineId() == r.goid {
+// Returns ErrDisposed without calling the callback when the runtime is closed.
+func (r *Runtime) Use(callback func()) error {
+	return r.UsePriority(PriorityNormal, callback)
+}
+
+// UsePriority is the same as Use, but the callback jumps ahead of
+// the pending work of lower priority.
+func (r *Runtime) UsePriority(priority Priority, callback func()) error {
+	if r.inThread() {
 		callback()
-	} else {
-		work := jswork{
-			callback:   callback,
-			resultChan: make(chan int, 1),
-		}
+		return nil
+	}
+
+	if atomic.LoadInt32(&r.closed) == 1 {
+		return ErrDisposed
+	}
 
-		r.workChan <- work
-		<-work.resultChan
+	work := jswork{
+		callback:   callback,
+		resultChan: make(chan int, 1),
 	}
+
+	if !r.works.push(priority, work) {
+		return ErrDisposed
+	}
+
+	<-work.resultChan
+	return nil
 }
 
-// Dispose is to manually free runtime
-func (r *Runtime) Dispose() {
-	if r == nil || r.disposed == 1 || &r.disposed == nil {
-		return
+// Post the callback to the runtime thread without waiting.
+// Returns false when the runtime is closed.
+func (r *Runtime) post(priority Priority, callback func()) bool {
+	if atomic.LoadInt32(&r.closed) == 1 {
+		return false
 	}
-	if _, ok := <-r.closeChan; !ok {
-		return
+	return r.works.push(priority, jswork{callback: callback})
+}
+
+// Close finishes the pending work, destroys all the contexts in creation order
+// and frees the runtime. Handles derived from the runtime stay safe to use
+// after Close, their methods return zero values and ErrDisposed.
+// Close returns ErrDisposed when the runtime already closed.
+func (r *Runtime) Close() error {
+	if r.inThread() {
+		return ErrCloseInRuntime
 	}
-	if atomic.CompareAndSwapInt64(&r.disposed, 0, 1) {
-		r.closeChan <- 1
+
+	if !atomic.CompareAndSwapInt32(&r.closed, 0, 1) {
+		return ErrDisposed
+	}
+
+	r.closeChan <- 1
+	<-r.done
+
+	return nil
+}
+
+// Dispose is to manually free runtime, same as Close() but ignores the error.
+func (r *Runtime) Dispose() {
+	if r == nil {
+		return
 	}
+	r.Close()
 }
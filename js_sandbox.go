@@ -0,0 +1,245 @@
+package monkey
+
+/*
+#include "monkey.h"
+*/
+import "C"
+import (
+	"errors"
+	"strings"
+	"unsafe"
+)
+
+// SandboxOptions configures a context for untrusted code. The zero value denies
+// what it controls: the scripts can't compile strings nor define new globals.
+type SandboxOptions struct {
+	// Allow eval(), the Function constructor and setTimeout() of strings.
+	AllowDynamicCode bool
+
+	// Allow the scripts to define new global variables and functions. Otherwise
+	// only Go, like DefineFunction() and the Init functions, can define them.
+	AllowNewGlobals bool
+
+	// Globals to delete, like "eval", "Function", "Date" or "Math.random".
+	Remove []string
+
+	// Globals to define or replace, like "Math.random". The values are
+	// converted like the results of async functions, a JsObjectFunc or a func of
+	// its signature is a function.
+	Replace map[string]interface{}
+
+	// Soft limits of the length of the strings and the arrays made by some
+	// standard functions and constructors, 0 means no limit. They catch the
+	// runaway scripts, but they are not a security boundary: the + operator,
+	// the assignments of length and indexes, and the native methods applied to
+	// array-likes, like Array.prototype.slice.call({length: n}), skip them.
+	// The heap of the runtime and the budgets bound the untrusted code.
+	SoftMaxStringLength int
+	SoftMaxArrayLength  int
+
+	// Host functions installed by InitCapabilities() with the grants.
+	Capabilities *Capabilities
+	Grants       []string
+}
+
+// ErrSandbox is returned when a global of the sandbox options can't be found.
+var ErrSandbox = errors.New("monkey: sandbox global not found")
+
+// The soft limits are checked by wrapping the functions which make strings and arrays.
+const sandboxScript = `(function(global, maxString, maxArray) {
+	function checkString(s) {
+		if (maxString > 0 && typeof s == 'string' && s.length > maxString) {
+			throw new RangeError('string longer than ' + maxString);
+		}
+		return s;
+	}
+
+	function checkArray(a) {
+		if (maxArray > 0 && a != null && a.length > maxArray) {
+			throw new RangeError('array longer than ' + maxArray);
+		}
+		return a;
+	}
+
+	function wrap(obj, name, check) {
+		var f = obj[name];
+		Object.defineProperty(obj, name, {
+			value: function() {
+				return check(f.apply(this, arguments));
+			},
+			writable: true,
+			configurable: true
+		});
+	}
+
+	// The methods which grow the array itself restore the length on failure.
+	function wrapGrow(name) {
+		var f = Array.prototype[name];
+		Object.defineProperty(Array.prototype, name, {
+			value: function() {
+				var n = this.length;
+				var result = f.apply(this, arguments);
+				if (maxArray > 0 && this.length > maxArray) {
+					this.length = n;
+					throw new RangeError('array longer than ' + maxArray);
+				}
+				return result;
+			},
+			writable: true,
+			configurable: true
+		});
+	}
+
+	if (maxString > 0) {
+		['concat', 'replace'].forEach(function(name) {
+			wrap(String.prototype, name, checkString);
+		});
+		wrap(Array.prototype, 'join', checkString);
+		wrap(String, 'fromCharCode', checkString);
+	}
+
+	if (maxArray > 0) {
+		wrap(Array.prototype, 'concat', checkArray);
+		['push', 'unshift', 'splice'].forEach(wrapGrow);
+
+		var NativeArray = Array;
+		var SandboxArray = function Array() {
+			return checkArray(NativeArray.apply(null, arguments));
+		};
+		SandboxArray.prototype = NativeArray.prototype;
+		SandboxArray.isArray = NativeArray.isArray;
+		Object.defineProperty(NativeArray.prototype, 'constructor', {
+			value: SandboxArray,
+			writable: true,
+			configurable: true
+		});
+		global.Array = SandboxArray;
+	}
+})`
+
+// NewSandboxContext creates a context for untrusted code, see SandboxOptions.
+// The globals of the Init functions are defined by Go, so they can be called
+// after this.
+func (r *Runtime) NewSandboxContext(opts SandboxOptions) (*Context, error) {
+	var result *Context
+	var err error
+
+	if err2 := r.Use(func() {
+		c := r.newContext(&C.sandbox_global_class)
+		if c == nil {
+			err = ErrExecutionFailed
+			return
+		}
+
+		c.sandbox = &opts
+		if !opts.AllowDynamicCode {
+			C.JS_SetContextSecurityCallbacks(c.jscx, &C.sandbox_security_callbacks)
+		}
+
+		if err = c.setupSandbox(&opts); err == nil && opts.Capabilities != nil && !c.InitCapabilities(opts.Capabilities, opts.Grants...) {
+			err = ErrExecutionFailed
+		}
+		if err != nil {
+			c.destroy()
+			return
+		}
+
+		result = c
+	}); err2 != nil {
+		return nil, err2
+	}
+
+	return result, err
+}
+
+// Must be called in the runtime thread.
+func (c *Context) setupSandbox(opts *SandboxOptions) error {
+	if opts.SoftMaxStringLength > 0 || opts.SoftMaxArrayLength > 0 {
+		maxString := newValue(c, C.INT_TO_JSVAL(C.int32(opts.SoftMaxStringLength)))
+		maxArray := newValue(c, C.INT_TO_JSVAL(C.int32(opts.SoftMaxArrayLength)))
+		defer maxString.ref.remove()
+		defer maxArray.ref.remove()
+
+		v, err := c.install(sandboxScript, "sandbox.js", maxString, maxArray)
+		if err != nil {
+			return err
+		}
+		v.ref.remove()
+	}
+
+	for _, path := range opts.Remove {
+		parent, name, ok := c.sandboxGlobal(path)
+		if !ok {
+			return ErrSandbox
+		}
+
+		cname := C.CString(name)
+		ok = C.JS_DeleteProperty(c.jscx, parent.obj, cname) == C.JS_TRUE
+		C.free(unsafe.Pointer(cname))
+		if !ok {
+			return c.takeError()
+		}
+	}
+
+	for path, v := range opts.Replace {
+		parent, name, ok := c.sandboxGlobal(path)
+		if !ok {
+			return ErrSandbox
+		}
+
+		var fn JsObjectFunc
+		switch x := v.(type) {
+		case JsObjectFunc:
+			fn = x
+		case func(*Object, string, []*Value) *Value:
+			fn = x
+		}
+
+		if fn != nil {
+			if !parent.DefineFunction(name, fn) {
+				return c.takeError()
+			}
+			continue
+		}
+
+		value, err := c.valueOf(v)
+		if err != nil {
+			return err
+		}
+		ok = parent.setProperty(name, value.val)
+		value.ref.remove()
+		if !ok {
+			return c.takeError()
+		}
+	}
+
+	return nil
+}
+
+// Find the object of a dotted path of a global and the name in it,
+// must be called in the runtime thread.
+func (c *Context) sandboxGlobal(path string) (*Object, string, bool) {
+	parent := &Object{cx: c, obj: c.jsglobal}
+
+	names := strings.Split(path, ".")
+	for _, name := range names[:len(names)-1] {
+		val, ok := parent.getProperty(name)
+		if !ok || C.JSVAL_IS_PRIMITIVE(val) == C.JS_TRUE {
+			return nil, "", false
+		}
+		parent = &Object{cx: c, obj: C.JSVAL_TO_OBJECT(val)}
+	}
+
+	return parent, names[len(names)-1], true
+}
+
+//export call_sandbox_add_property
+func call_sandbox_add_property(h C.uintptr_t, name C.jsval) C.JSBool {
+	c := contextOf(h)
+	if c.sandbox == nil || c.sandbox.AllowNewGlobals || c.trusted > 0 {
+		return C.JS_TRUE
+	}
+
+	c.throwError("sandbox: can't define the global " + c.jsvalToString(name))
+	return C.JS_FALSE
+}
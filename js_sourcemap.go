@@ -0,0 +1,306 @@
+package monkey
+
+import (
+	"encoding/json"
+	"errors"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SourceMap is a parsed source map of version 3.
+type SourceMap struct {
+	File    string
+	Sources []string
+	Names   []string
+
+	// Segments of every generated line, ordered by column.
+	lines [][]mapping
+}
+
+type mapping struct {
+	column       int
+	source       int
+	sourceLine   int
+	sourceColumn int
+	name         int
+}
+
+// SourcePosition is a position in the original sources.
+// Line is 1-based, Column is 0-based.
+type SourcePosition struct {
+	Source string
+	Line   int
+	Column int
+	Name   string
+}
+
+// ParseSourceMap parses the JSON of a source map, index maps are not supported.
+func ParseSourceMap(data []byte) (*SourceMap, error) {
+	var raw struct {
+		Version    int      `json:"version"`
+		File       string   `json:"file"`
+		SourceRoot string   `json:"sourceRoot"`
+		Sources    []string `json:"sources"`
+		Names      []string `json:"names"`
+		Mappings   string   `json:"mappings"`
+	}
+
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	if raw.Version != 3 {
+		return nil, errors.New("monkey: unsupported source map version " + strconv.Itoa(raw.Version))
+	}
+
+	sm := &SourceMap{
+		File:    raw.File,
+		Sources: make([]string, len(raw.Sources)),
+		Names:   raw.Names,
+	}
+
+	for i, source := range raw.Sources {
+		if raw.SourceRoot != "" && !strings.Contains(source, "://") && !path.IsAbs(source) {
+			source = strings.TrimSuffix(raw.SourceRoot, "/") + "/" + source
+		}
+		sm.Sources[i] = source
+	}
+
+	if err := sm.parseMappings(raw.Mappings); err != nil {
+		return nil, err
+	}
+
+	return sm, nil
+}
+
+const base64Digits = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+
+var errInvalidMappings = errors.New("monkey: invalid source map mappings")
+
+func (sm *SourceMap) parseMappings(mappings string) error {
+	var source, sourceLine, sourceColumn, name int
+
+	for _, line := range strings.Split(mappings, ";") {
+		var segments []mapping
+		column := 0
+
+		for _, segment := range strings.Split(line, ",") {
+			if segment == "" {
+				continue
+			}
+
+			var fields []int
+			for len(segment) > 0 {
+				value, rest, err := decodeVLQ(segment)
+				if err != nil {
+					return err
+				}
+				fields = append(fields, value)
+				segment = rest
+			}
+
+			column += fields[0]
+			m := mapping{column: column, source: -1, name: -1}
+
+			switch len(fields) {
+			case 1:
+			case 4, 5:
+				source += fields[1]
+				sourceLine += fields[2]
+				sourceColumn += fields[3]
+				m.source, m.sourceLine, m.sourceColumn = source, sourceLine, sourceColumn
+				if len(fields) == 5 {
+					name += fields[4]
+					m.name = name
+				}
+			default:
+				return errInvalidMappings
+			}
+
+			segments = append(segments, m)
+		}
+
+		sort.SliceStable(segments, func(i, j int) bool {
+			return segments[i].column < segments[j].column
+		})
+
+		sm.lines = append(sm.lines, segments)
+	}
+
+	return nil
+}
+
+func decodeVLQ(s string) (int, string, error) {
+	var value, shift int
+
+	for i := 0; i < len(s); i++ {
+		digit := strings.IndexByte(base64Digits, s[i])
+		if digit < 0 {
+			return 0, "", errInvalidMappings
+		}
+
+		value += (digit & 31) << shift
+		shift += 5
+
+		if digit&32 == 0 {
+			if value&1 != 0 {
+				return -(value >> 1), s[i+1:], nil
+			}
+			return value >> 1, s[i+1:], nil
+		}
+	}
+
+	return 0, "", errInvalidMappings
+}
+
+// Lookup finds the original position of a generated position.
+// Line is 1-based, column is 0-based. A column before the first segment of
+// the line maps to the first segment.
+func (sm *SourceMap) Lookup(line, column int) (SourcePosition, bool) {
+	if line < 1 || line > len(sm.lines) {
+		return SourcePosition{}, false
+	}
+
+	segments := sm.lines[line-1]
+	if len(segments) == 0 {
+		return SourcePosition{}, false
+	}
+
+	i := sort.Search(len(segments), func(i int) bool {
+		return segments[i].column > column
+	}) - 1
+	if i < 0 {
+		i = 0
+	}
+
+	m := segments[i]
+	if m.source < 0 || m.source >= len(sm.Sources) {
+		return SourcePosition{}, false
+	}
+
+	pos := SourcePosition{
+		Source: sm.Sources[m.source],
+		Line:   m.sourceLine + 1,
+		Column: m.sourceColumn,
+	}
+
+	if m.name >= 0 && m.name < len(sm.Names) {
+		pos.Name = sm.Names[m.name]
+	}
+
+	return pos, true
+}
+
+// Find the original position of a generated line when the column isn't known,
+// like the one of a runtime error. False when the segments of the line come
+// from different original lines, like the ones of minified code, because any
+// of them could be wrong. The column is the one of the first segment.
+func (sm *SourceMap) lookupLine(line int) (SourcePosition, bool) {
+	if line < 1 || line > len(sm.lines) {
+		return SourcePosition{}, false
+	}
+
+	var pos SourcePosition
+	var found bool
+
+	for _, m := range sm.lines[line-1] {
+		if m.source < 0 || m.source >= len(sm.Sources) {
+			continue
+		}
+		if found {
+			if sm.Sources[m.source] != pos.Source || m.sourceLine+1 != pos.Line {
+				return SourcePosition{}, false
+			}
+			continue
+		}
+
+		pos = SourcePosition{
+			Source: sm.Sources[m.source],
+			Line:   m.sourceLine + 1,
+			Column: m.sourceColumn,
+		}
+		if m.name >= 0 && m.name < len(sm.Names) {
+			pos.Name = sm.Names[m.name]
+		}
+		found = true
+	}
+
+	return pos, found
+}
+
+// A source map attached to a file name, line is the first line of the script.
+type attachedSourceMap struct {
+	sm   *SourceMap
+	line int
+}
+
+// Attach a source map to the scripts of the file name, must be called in the runtime thread.
+func (c *Context) attachSourceMap(filename string, line int, sm *SourceMap) {
+	if sm == nil {
+		return
+	}
+	if c.sourceMaps == nil {
+		c.sourceMaps = make(map[string]attachedSourceMap)
+	}
+	if line < 1 {
+		line = 1
+	}
+	c.sourceMaps[filename] = attachedSourceMap{sm, line}
+}
+
+// Map a generated position to the original one, must be called in the runtime thread.
+// A negative column means it isn't known, see lookupLine().
+func (c *Context) lookupSource(filename string, line, column int) (SourcePosition, bool) {
+	a, ok := c.sourceMaps[filename]
+	if !ok {
+		return SourcePosition{}, false
+	}
+	if column < 0 {
+		return a.sm.lookupLine(line - a.line + 1)
+	}
+	return a.sm.Lookup(line-a.line+1, column)
+}
+
+// Rewrite the location of an error report, must be called in the runtime thread.
+func (c *Context) remapReport(r *ErrorReport) {
+	column := r.Column
+	if !r.hasColumn {
+		column = -1
+	}
+	if pos, ok := c.lookupSource(r.FileName, r.LineNum, column); ok {
+		r.FileName, r.LineNum, r.Column = pos.Source, pos.Line, pos.Column
+	}
+	r.Stack = c.remapStack(r.Stack)
+	c.remapFrames(r.Frames)
+}
+
+// RemapStack rewrites the file names and line numbers of a stack trace,
+// like Error.stack, by the attached source maps.
+func (c *Context) RemapStack(stack string) string {
+	var result string
+	c.use(func() {
+		result = c.remapStack(stack)
+	})
+	return result
+}
+
+// Must be called in the runtime thread.
+func (c *Context) remapStack(stack string) string {
+	if len(c.sourceMaps) == 0 {
+		return stack
+	}
+
+	lines := strings.Split(stack, "\n")
+	for i, line := range lines {
+		at, file, lineno, ok := splitStackLine(line)
+		if !ok {
+			continue
+		}
+		if pos, ok := c.lookupSource(file, lineno, -1); ok {
+			lines[i] = line[:at] + "@" + pos.Source + ":" + strconv.Itoa(pos.Line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
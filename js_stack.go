@@ -0,0 +1,124 @@
+package monkey
+
+import (
+	"strconv"
+	"strings"
+)
+
+// StackFrame is a frame of a JavaScript stack, the function is empty for
+// anonymous functions and the top level code.
+type StackFrame struct {
+	Function string
+	File     string
+	Line     int
+}
+
+// String formats the frame like Error.stack: function@file:line
+func (f StackFrame) String() string {
+	return f.Function + "@" + f.File + ":" + strconv.Itoa(f.Line)
+}
+
+// StackTrace returns the frames of the running scripts from the innermost,
+// e.g. in a Go function called by JavaScript. It's nil when no script is running.
+// The locations are remapped by the source maps.
+func (c *Context) StackTrace() []StackFrame {
+	var result []StackFrame
+	c.use(func() {
+		result = c.stackTrace()
+		c.remapFrames(result)
+	})
+	return result
+}
+
+// Must be called in the runtime thread.
+func (c *Context) stackTrace() []StackFrame {
+	var result []StackFrame
+	for _, f := range c.scriptFrames() {
+		function, file, line := c.frameLocation(f)
+		result = append(result, StackFrame{function, file, line})
+	}
+	return result
+}
+
+// Must be called in the runtime thread.
+func (c *Context) remapFrames(frames []StackFrame) {
+	for i, f := range frames {
+		if pos, ok := c.lookupSource(f.File, f.Line, -1); ok {
+			frames[i].File, frames[i].Line = pos.Source, pos.Line
+		}
+	}
+}
+
+// Parse a stack of SpiderMonkey like Error.stack, the lines are
+// function(arguments)@file:line and the top level code is @file:line.
+// The native frames like the Error constructor's have no location and are skipped.
+func parseStack(stack string) []StackFrame {
+	var result []StackFrame
+
+	for _, line := range strings.Split(stack, "\n") {
+		at, file, lineno, ok := splitStackLine(line)
+		if !ok || file == "" && lineno == 0 {
+			continue
+		}
+
+		function := line[:at]
+		if i := strings.IndexByte(function, '('); i >= 0 {
+			function = function[:i]
+		}
+
+		result = append(result, StackFrame{function, file, lineno})
+	}
+
+	return result
+}
+
+// Split a line of a stack at the @ before the location.
+// The file and the arguments can both have any characters, e.g. a scoped package
+// node_modules/@scope/pkg.js, so the @ is found from the left: it follows the
+// parenthesis which closes the arguments. The strings in the arguments are quoted.
+func splitStackLine(line string) (at int, file string, lineno int, ok bool) {
+	at = -1
+	if strings.HasPrefix(line, "@") {
+		at = 0
+	} else if open := strings.IndexByte(line, '('); open >= 0 {
+		depth, quoted := 0, false
+	scan:
+		for i := open; i < len(line); i++ {
+			switch c := line[i]; {
+			case quoted:
+				if c == '\\' {
+					i++
+				} else if c == '"' {
+					quoted = false
+				}
+			case c == '"':
+				quoted = true
+			case c == '(':
+				depth++
+			case c == ')':
+				depth--
+				if depth == 0 {
+					if i+1 < len(line) && line[i+1] == '@' {
+						at = i + 1
+					}
+					break scan
+				}
+			}
+		}
+	}
+	if at < 0 {
+		return
+	}
+
+	location := line[at+1:]
+	colon := strings.LastIndexByte(location, ':')
+	if colon < 0 {
+		return
+	}
+	lineno, err := strconv.Atoi(location[colon+1:])
+	if err != nil {
+		return
+	}
+
+	return at, location[:colon], lineno, true
+}
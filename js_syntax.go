@@ -0,0 +1,132 @@
+package monkey
+
+/*
+#include "monkey.h"
+*/
+import "C"
+import (
+	"strings"
+	"unicode"
+	"unsafe"
+)
+
+// SyntaxError is a parse error found by CheckSyntax().
+// Token is the text at TokenIndex of LineBuf.
+type SyntaxError struct {
+	ErrorReport
+	Token string
+}
+
+// CheckSyntax has a limit, the later errors are often caused by the earlier ones.
+const maxSyntaxErrors = 10
+
+// CheckSyntax parses the code without running it and returns the syntax errors,
+// nil means the code is valid. The engine stops at the first error, so the line
+// of every error is blanked and the code is parsed again to find the next one.
+// The error reporter is not called.
+func (c *Context) CheckSyntax(code, filename string) []*SyntaxError {
+	var result []*SyntaxError
+
+	c.use(func() {
+		// The parsed scripts are not covered.
+		reporter, sourceMaps, coverage := c.errorReporter, c.sourceMaps, c.coverage
+		c.errorReporter, c.sourceMaps, c.coverage = nil, nil, nil
+		defer func() {
+			c.errorReporter, c.sourceMaps, c.coverage = reporter, sourceMaps, coverage
+		}()
+
+		lines := strings.SplitAfter(code, "\n")
+		blanked := make(map[int]bool)
+
+		for len(result) < maxSyntaxErrors {
+			r := c.parse(code, filename)
+			if r == nil {
+				break
+			}
+
+			result = append(result, newSyntaxError(r))
+
+			if r.LineNum < 1 || r.LineNum > len(lines) || blanked[r.LineNum] {
+				break
+			}
+			blanked[r.LineNum] = true
+
+			if strings.HasSuffix(lines[r.LineNum-1], "\n") {
+				lines[r.LineNum-1] = "\n"
+			} else {
+				lines[r.LineNum-1] = ""
+			}
+			code = strings.Join(lines, "")
+		}
+
+		c.sourceMaps = sourceMaps
+		for _, e := range result {
+			c.remapReport(&e.ErrorReport)
+		}
+	})
+
+	return result
+}
+
+// Compile the code and drop it, must be called in the runtime thread.
+// The result is the report of the first syntax error.
+func (c *Context) parse(code, filename string) *ErrorReport {
+	ccode := C.CString(code)
+	defer C.free(unsafe.Pointer(ccode))
+
+	cfilename := C.CString(filename)
+	defer C.free(unsafe.Pointer(cfilename))
+
+	c.lastError = nil
+
+	if C.JS_CompileScript(c.jscx, c.jsglobal, ccode, C.size_t(len(code)), cfilename, 1) != nil {
+		return nil
+	}
+
+	// Called by JavaScript, the error is pending instead of reported.
+	if C.JS_IsExceptionPending(c.jscx) == C.JS_TRUE {
+		C.JS_ReportPendingException(c.jscx)
+		C.JS_ClearPendingException(c.jscx)
+	}
+
+	r := c.lastError
+	c.lastError = nil
+	if r == nil {
+		r = &ErrorReport{Context: c, Message: ErrExecutionFailed.Error(), FileName: filename}
+	}
+	return r
+}
+
+func newSyntaxError(r *ErrorReport) *SyntaxError {
+	e := &SyntaxError{ErrorReport: *r}
+
+	if r.TokenIndex >= 0 && r.TokenIndex < len(r.LineBuf) {
+		rest := []rune(r.LineBuf[r.TokenIndex:])
+		n := 0
+		for n < len(rest) && (unicode.IsLetter(rest[n]) || unicode.IsDigit(rest[n]) || rest[n] == '_' || rest[n] == '$') {
+			n++
+		}
+		if n == 0 && !unicode.IsSpace(rest[0]) {
+			n = 1
+		}
+		e.Token = string(rest[:n])
+	}
+
+	return e
+}
+
+// IsCompilableUnit tells whether the code is a complete unit, e.g. false for
+// an unclosed block, so a REPL can wait for more lines.
+func (c *Context) IsCompilableUnit(code string) bool {
+	var result bool
+
+	c.use(func() {
+		ccode := C.CString(code)
+		defer C.free(unsafe.Pointer(ccode))
+
+		result = C.JS_BufferIsCompilableUnit(c.jscx, c.jsglobal, ccode, C.size_t(len(code))) == C.JS_TRUE
+		C.JS_ClearPendingException(c.jscx)
+	})
+
+	return result
+}
@@ -5,7 +5,6 @@ package monkey
 */
 import "C"
 import (
-	"reflect"
 	"runtime"
 	"unsafe"
 )
@@ -14,20 +13,38 @@ import (
 type Value struct {
 	cx  *Context
 	val C.jsval
+	ref *rootRef
 }
 
+// Add the value to the garbage collector's root set.
+// Must be called in the runtime thread.
 func newValue(cx *Context, val C.jsval) *Value {
-	result := &Value{cx, val}
-
-	C.JS_AddValueRoot(cx.jscx, &result.val)
+	result := &Value{cx, val, cx.rt.addValueRoot(cx, val)}
 
 	runtime.SetFinalizer(result, func(v *Value) {
-		cx.rt.valDisposeChan <- v
+		v.ref.finalize()
 	})
 
 	return result
 }
 
+// Release the value's GC root. Its methods return zero values after this.
+func (v *Value) Release() {
+	if v == nil {
+		return
+	}
+	v.ref.release()
+}
+
+// The raw value of a released handle can be collected already.
+func (v *Value) live() bool {
+	return !v.ref.isReleased()
+}
+
+func (v *Value) root() *rootRef {
+	return v.ref
+}
+
 func (v *Value) Runtime() *Runtime {
 	return v.cx.rt
 }
@@ -42,43 +59,43 @@ func (v *Value) String() string {
 
 func (v *Value) TypeName() string {
 	var result string
-	v.cx.rt.Use(func() {
+	v.cx.useHandle(v.ref, func() {
 		result = C.GoString(C.JS_GetTypeName(v.cx.jscx, C.JS_TypeOfValue(v.cx.jscx, v.val)))
 	})
 	return result
 }
 
 func (v *Value) IsNull() bool {
-	return C.JSVAL_IS_NULL(v.val) == C.JS_TRUE
+	return v.live() && C.JSVAL_IS_NULL(v.val) == C.JS_TRUE
 }
 
 func (v *Value) IsVoid() bool {
-	return C.JSVAL_IS_VOID(v.val) == C.JS_TRUE
+	return v.live() && C.JSVAL_IS_VOID(v.val) == C.JS_TRUE
 }
 
 func (v *Value) IsInt() bool {
-	return C.JSVAL_IS_INT(v.val) == C.JS_TRUE
+	return v.live() && C.JSVAL_IS_INT(v.val) == C.JS_TRUE
 }
 
 func (v *Value) IsNumber() bool {
-	return C.JSVAL_IS_NUMBER(v.val) == C.JS_TRUE
+	return v.live() && C.JSVAL_IS_NUMBER(v.val) == C.JS_TRUE
 }
 
 func (v *Value) IsBoolean() bool {
-	return C.JSVAL_IS_BOOLEAN(v.val) == C.JS_TRUE
+	return v.live() && C.JSVAL_IS_BOOLEAN(v.val) == C.JS_TRUE
 }
 
 func (v *Value) IsString() bool {
-	return C.JSVAL_IS_STRING(v.val) == C.JS_TRUE
+	return v.live() && C.JSVAL_IS_STRING(v.val) == C.JS_TRUE
 }
 
 func (v *Value) IsObject() bool {
-	return C.JSVAL_IS_OBJECT(v.val) == C.JS_TRUE
+	return v.live() && C.JSVAL_IS_OBJECT(v.val) == C.JS_TRUE
 }
 
 func (v *Value) IsArray() bool {
 	var result bool
-	v.cx.rt.Use(func() {
+	v.cx.useHandle(v.ref, func() {
 		result = v.IsObject() && C.JS_IsArrayObject(
 			v.cx.jscx, C.JSVAL_TO_OBJECT(v.val),
 		) == C.JS_TRUE
@@ -88,7 +105,7 @@ func (v *Value) IsArray() bool {
 
 func (v *Value) IsFunction() bool {
 	var result bool
-	v.cx.rt.Use(func() {
+	v.cx.useHandle(v.ref, func() {
 		result = v.IsObject() && C.JS_ObjectIsFunction(
 			v.cx.jscx, C.JSVAL_TO_OBJECT(v.val),
 		) == C.JS_TRUE
@@ -101,11 +118,8 @@ func (v *Value) ToInt() (int32, bool) {
 	var result1 int32
 	var result2 bool
 
-	v.cx.rt.Use(func() {
-		var r C.int32
-		if C.JS_ValueToInt32(v.cx.jscx, v.val, &r) == C.JS_TRUE {
-			result1, result2 = int32(r), true
-		}
+	v.cx.useHandle(v.ref, func() {
+		result1, result2 = v.cx.jsvalToInt(v.val)
 	})
 
 	return result1, result2
@@ -116,11 +130,8 @@ func (v *Value) ToNumber() (float64, bool) {
 	var result1 float64
 	var result2 bool
 
-	v.cx.rt.Use(func() {
-		var r C.jsdouble
-		if C.JS_ValueToNumber(v.cx.jscx, v.val, &r) == C.JS_TRUE {
-			result1, result2 = float64(r), true
-		}
+	v.cx.useHandle(v.ref, func() {
+		result1, result2 = v.cx.jsvalToNumber(v.val)
 	})
 
 	return result1, result2
@@ -131,15 +142,8 @@ func (v *Value) ToBoolean() (bool, bool) {
 	var result1 bool
 	var result2 bool
 
-	v.cx.rt.Use(func() {
-		var r C.JSBool
-		if C.JS_ValueToBoolean(v.cx.jscx, v.val, &r) == C.JS_TRUE {
-			if r == C.JS_TRUE {
-				result1, result2 = true, true
-			} else {
-				result1, result2 = false, true
-			}
-		}
+	v.cx.useHandle(v.ref, func() {
+		result1, result2 = v.cx.jsvalToBoolean(v.val)
 	})
 
 	return result1, result2
@@ -149,12 +153,8 @@ func (v *Value) ToBoolean() (bool, bool) {
 func (v *Value) ToString() string {
 	var result string
 
-	v.cx.rt.Use(func() {
-		cstring := C.JS_EncodeString(v.cx.jscx, C.JS_ValueToString(v.cx.jscx, v.val))
-		gostring := C.GoString(cstring)
-		C.JS_free(v.cx.jscx, unsafe.Pointer(cstring))
-
-		result = gostring
+	v.cx.useHandle(v.ref, func() {
+		result = v.cx.jsvalToString(v.val)
 	})
 
 	return result
@@ -164,11 +164,8 @@ func (v *Value) ToString() string {
 func (v *Value) ToObject() *Object {
 	var result *Object
 
-	v.cx.rt.Use(func() {
-		var obj *C.JSObject
-		if C.JS_ValueToObject(v.cx.jscx, v.val, &obj) == C.JS_TRUE {
-			result = newObject(v.cx, obj, nil)
-		}
+	v.cx.useHandle(v.ref, func() {
+		result = v.cx.jsvalToObject(v.val)
 	})
 
 	return result
@@ -178,13 +175,8 @@ func (v *Value) ToObject() *Object {
 func (v *Value) ToArray() *Array {
 	var result *Array
 
-	v.cx.rt.Use(func() {
-		var obj *C.JSObject
-		if C.JS_ValueToObject(v.cx.jscx, v.val, &obj) == C.JS_TRUE {
-			if C.JS_IsArrayObject(v.cx.jscx, obj) == C.JS_TRUE {
-				result = newArray(v.cx, obj)
-			}
-		}
+	v.cx.useHandle(v.ref, func() {
+		result = v.cx.jsvalToArray(v.val)
 	})
 
 	return result
@@ -195,6 +187,8 @@ func (v *Value) ToGo() interface{} {
 	var ret interface{}
 
 	switch {
+	case !v.live(), v.IsNull(), v.IsVoid():
+		ret = nil
 	case v.IsBoolean():
 		ret, _ = v.ToBoolean()
 	case v.IsInt():
@@ -203,8 +197,6 @@ func (v *Value) ToGo() interface{} {
 		ret, _ = v.ToNumber()
 	case v.IsString():
 		ret = v.String()
-	case v.IsObject():
-		ret = v.ToObject().ToGo()
 	case v.IsArray():
 		arr := v.ToArray()
 		goArr := make([]interface{}, arr.GetLength())
@@ -212,8 +204,8 @@ func (v *Value) ToGo() interface{} {
 			goArr[i] = arr.GetElement(i).ToGo()
 		}
 		ret = goArr
-	case v.IsNull():
-		ret = nil
+	case v.IsObject():
+		ret = v.ToObject().ToGo()
 	default:
 		panic("unsupported js type")
 	}
@@ -225,20 +217,87 @@ func (v *Value) ToGo() interface{} {
 func (v *Value) Call(argv []*Value) *Value {
 	var result *Value
 
-	v.cx.rt.Use(func() {
-		argv2 := make([]C.jsval, len(argv))
-		for i := 0; i < len(argv); i++ {
-			argv2[i] = argv[i].val
-		}
-		argv3 := unsafe.Pointer(&argv2)
-		argv4 := (*reflect.SliceHeader)(argv3).Data
-		argv5 := (*C.jsval)(unsafe.Pointer(argv4))
-
-		var rval C.jsval
-		if C.JS_CallFunctionValue(v.cx.jscx, nil, v.val, C.uintN(len(argv)), argv5, &rval) == C.JS_TRUE {
-			result = newValue(v.cx, rval)
-		}
+	v.cx.useHandle(v.ref, func() {
+		result, _ = v.cx.callFunction(nil, v.val, argv)
 	})
 
 	return result
 }
+
+/*
+Conversions of raw values, must be called in the runtime thread.
+*/
+
+func (c *Context) jsvalToInt(val C.jsval) (int32, bool) {
+	var r C.int32
+	if C.JS_ValueToInt32(c.jscx, val, &r) == C.JS_TRUE {
+		return int32(r), true
+	}
+	return 0, false
+}
+
+func (c *Context) jsvalToNumber(val C.jsval) (float64, bool) {
+	var r C.jsdouble
+	if C.JS_ValueToNumber(c.jscx, val, &r) == C.JS_TRUE {
+		return float64(r), true
+	}
+	return 0, false
+}
+
+func (c *Context) jsvalToBoolean(val C.jsval) (bool, bool) {
+	var r C.JSBool
+	if C.JS_ValueToBoolean(c.jscx, val, &r) == C.JS_TRUE {
+		return r == C.JS_TRUE, true
+	}
+	return false, false
+}
+
+func (c *Context) jsvalToString(val C.jsval) string {
+	return c.jsstringToString(C.JS_ValueToString(c.jscx, val))
+}
+
+func (c *Context) jsstringToString(str *C.JSString) string {
+	if str == nil {
+		return ""
+	}
+	cstring := C.JS_EncodeString(c.jscx, str)
+	gostring := C.GoString(cstring)
+	C.JS_free(c.jscx, unsafe.Pointer(cstring))
+	return gostring
+}
+
+func (c *Context) jsvalToObject(val C.jsval) *Object {
+	var obj *C.JSObject
+	if C.JS_ValueToObject(c.jscx, val, &obj) == C.JS_TRUE && obj != nil {
+		return newObject(c, obj)
+	}
+	return nil
+}
+
+func (c *Context) jsvalToArray(val C.jsval) *Array {
+	var obj *C.JSObject
+	if C.JS_ValueToObject(c.jscx, val, &obj) == C.JS_TRUE && obj != nil {
+		if C.JS_IsArrayObject(c.jscx, obj) == C.JS_TRUE {
+			return newArray(c, obj)
+		}
+	}
+	return nil
+}
+
+func (c *Context) callFunction(this *C.JSObject, fval C.jsval, argv []*Value) (*Value, error) {
+	argv2 := make([]C.jsval, len(argv)+1)
+	for i := 0; i < len(argv); i++ {
+		argv2[i] = argv[i].val
+	}
+
+	c.enter()
+	defer c.leave()
+
+	c.lastError = nil
+
+	var rval C.jsval
+	if C.JS_CallFunctionValue(c.jscx, this, fval, C.uintN(len(argv)), &argv2[0], &rval) == C.JS_TRUE {
+		return newValue(c, rval), nil
+	}
+	return nil, c.takeError()
+}
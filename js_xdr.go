@@ -0,0 +1,134 @@
+package monkey
+
+/*
+#include "monkey.h"
+*/
+import "C"
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"runtime"
+	"unsafe"
+)
+
+// The header of compiled scripts: magic, bytecode version, pointer size,
+// debug flag, architecture and engine version.
+const compiledMagic = "MNKX"
+
+var (
+	// ErrInvalidCompiled is returned when the data is not a compiled script.
+	ErrInvalidCompiled = errors.New("monkey: invalid compiled script")
+
+	// ErrCompiledVersion is returned when the compiled script is from another engine build.
+	ErrCompiledVersion = errors.New("monkey: compiled script is from another engine build")
+)
+
+func compiledHeader() []byte {
+	version := C.GoString(C.JS_GetImplementationVersion())
+
+	var header bytes.Buffer
+	header.WriteString(compiledMagic)
+	binary.Write(&header, binary.BigEndian, uint32(C.JSXDR_BYTECODE_VERSION))
+
+	// The engine is linked in the binary, so it's built for the same architecture.
+	header.WriteByte(byte(unsafe.Sizeof(uintptr(0))))
+	header.WriteByte(byte(C.debug_build()))
+	header.WriteByte(byte(len(runtime.GOARCH)))
+	header.WriteString(runtime.GOARCH)
+
+	binary.Write(&header, binary.BigEndian, uint16(len(version)))
+	header.WriteString(version)
+	return header.Bytes()
+}
+
+// MarshalBinary serializes the bytecode of the script, so it can be cached and
+// loaded by LoadCompiled() without parsing the source again.
+func (s *Script) MarshalBinary() ([]byte, error) {
+	var data []byte
+	var err error
+
+	if err2 := s.cx.use(func() {
+		if s.ref.isReleased() {
+			err = ErrDisposed
+			return
+		}
+
+		xdr := C.JS_XDRNewMem(s.cx.jscx, C.JSXDR_ENCODE)
+		if xdr == nil {
+			err = ErrExecutionFailed
+			return
+		}
+		defer C.JS_XDRDestroy(xdr)
+
+		s.cx.lastError = nil
+
+		obj := s.obj
+		if C.JS_XDRScriptObject(xdr, &obj) != C.JS_TRUE {
+			err = s.cx.takeError()
+			return
+		}
+
+		var length C.uint32
+		ptr := C.JS_XDRMemGetData(xdr, &length)
+
+		data = append(compiledHeader(), C.GoBytes(ptr, C.int(length))...)
+	}); err2 != nil {
+		return nil, err2
+	}
+
+	return data, err
+}
+
+// LoadCompiled loads a script serialized by Script.MarshalBinary().
+// Scripts of another engine build are rejected by ErrCompiledVersion.
+func (c *Context) LoadCompiled(data []byte) (*Script, error) {
+	var result *Script
+	var err error
+
+	if err2 := c.use(func() {
+		header := compiledHeader()
+
+		if !bytes.HasPrefix(data, []byte(compiledMagic)) || len(data) < len(header) {
+			err = ErrInvalidCompiled
+			return
+		}
+		if !bytes.Equal(data[:len(header)], header) {
+			err = ErrCompiledVersion
+			return
+		}
+
+		code := data[len(header):]
+		if len(code) == 0 {
+			err = ErrInvalidCompiled
+			return
+		}
+
+		xdr := C.JS_XDRNewMem(c.jscx, C.JSXDR_DECODE)
+		if xdr == nil {
+			err = ErrExecutionFailed
+			return
+		}
+		defer C.JS_XDRDestroy(xdr)
+
+		// The state frees its data, so it's cleared before destroyed.
+		ptr := C.CBytes(code)
+		defer C.free(ptr)
+		C.JS_XDRMemSetData(xdr, ptr, C.uint32(len(code)))
+		defer C.JS_XDRMemSetData(xdr, nil, 0)
+
+		c.lastError = nil
+
+		var obj *C.JSObject
+		if C.JS_XDRScriptObject(xdr, &obj) != C.JS_TRUE || obj == nil {
+			err = c.takeError()
+			return
+		}
+
+		result = c.newScript(obj)
+	}); err2 != nil {
+		return nil, err2
+	}
+
+	return result, err
+}
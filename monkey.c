@@ -12,9 +12,116 @@ JSClass global_class = {
     JSCLASS_NO_OPTIONAL_MEMBERS
 };
 
+/* The global of sandboxes, Go decides whether a running script can add a global. */
+static JSBool sandbox_add_property(JSContext *cx, JSObject *obj, jsid id, jsval *vp) {
+	uintptr_t h = (uintptr_t)JS_GetContextPrivate(cx);
+	jsval name;
+	if (h == 0 || !JS_IsRunning(cx) || !JS_IdToValue(cx, id, &name)) {
+		return JS_TRUE;
+	}
+	return call_sandbox_add_property(h, name);
+}
+
+JSClass sandbox_global_class = {
+    "global", JSCLASS_GLOBAL_FLAGS,
+    sandbox_add_property, JS_PropertyStub, JS_PropertyStub, JS_StrictPropertyStub,
+    JS_EnumerateStub, JS_ResolveStub, JS_ConvertStub, JS_FinalizeStub,
+    JSCLASS_NO_OPTIONAL_MEMBERS
+};
+
+/* The scripts of sandboxes can't compile strings by eval() and Function(). */
+static JSBool deny_dynamic_code(JSContext *cx) {
+	return JS_FALSE;
+}
+
+JSSecurityCallbacks sandbox_security_callbacks = {
+    NULL, NULL, NULL, deny_dynamic_code
+};
+
+/* Finalize the Go private data of objects created by Context.NewObject(). */
+static void go_object_finalize(JSContext *cx, JSObject *obj) {
+	uintptr_t h = (uintptr_t)JS_GetPrivate(cx, obj);
+	if (h != 0) {
+		call_go_object_finalize(h);
+	}
+}
+
+JSClass go_object_class = {
+    "Object", JSCLASS_HAS_PRIVATE,
+    JS_PropertyStub, JS_PropertyStub, JS_PropertyStub, JS_StrictPropertyStub,
+    JS_EnumerateStub, JS_ResolveStub, JS_ConvertStub, go_object_finalize,
+    JSCLASS_NO_OPTIONAL_MEMBERS
+};
+
 /* The error reporter callback. */
 void error_callback(JSContext *cx, const char *message, JSErrorReport *report) {
-	call_error_func(JS_GetContextPrivate(cx), (char*)message, report);
+	call_error_func((uintptr_t)JS_GetContextPrivate(cx), (char*)message, report);
+}
+
+/* The operation callback, it stops the script when the context is interrupted. */
+JSBool operation_callback(JSContext *cx) {
+	uintptr_t h = (uintptr_t)JS_GetContextPrivate(cx);
+	if (h == 0) {
+		return JS_TRUE;
+	}
+	return call_operation_callback(h);
+}
+
+/* The debugger hooks, Go finds the Debugger by the context handle. */
+JSTrapStatus debug_trap(JSContext *cx, JSScript *script, jsbytecode *pc, jsval *rval, jsval closure) {
+	uintptr_t h = (uintptr_t)JS_GetContextPrivate(cx);
+	if (h != 0) {
+		call_debug_hook(h, script, pc, 1);
+	}
+	return JSTRAP_CONTINUE;
+}
+
+/* The budget of the evaluation running in the thread of the runtime. */
+static __thread budget *current_budget = NULL;
+
+budget *set_budget(budget *b) {
+	budget *prev = current_budget;
+	current_budget = b;
+	return prev;
+}
+
+/* The closure of the interrupt hook while a debugger steps. */
+static int debug_stepping;
+
+/* The interrupt hook counts the bytecodes of the budget in C, Go is only
+   called while a debugger steps. */
+JSTrapStatus debug_interrupt(JSContext *cx, JSScript *script, jsbytecode *pc, jsval *rval, void *closure) {
+	budget *b = current_budget;
+	if (b != NULL && b->cx == cx) {
+		b->used++;
+		if (b->limit != 0 && b->used > b->limit) {
+			return JSTRAP_ERROR;
+		}
+	}
+
+	uintptr_t h = (uintptr_t)JS_GetContextPrivate(cx);
+	if (closure == &debug_stepping && h != 0) {
+		call_debug_hook(h, script, pc, 0);
+	}
+	return JSTRAP_CONTINUE;
+}
+
+void set_interrupt(JSRuntime *rt, int stepping) {
+	JS_SetInterrupt(rt, debug_interrupt, stepping ? &debug_stepping : NULL);
+}
+
+void new_script_hook(JSContext *cx, const char *filename, uintN lineno, JSScript *script, JSFunction *fun, void *callerdata) {
+	uintptr_t h = (uintptr_t)JS_GetContextPrivate(cx);
+	if (h != 0) {
+		call_debug_new_script(h, script);
+	}
+}
+
+void destroy_script_hook(JSContext *cx, JSScript *script, void *callerdata) {
+	uintptr_t h = (uintptr_t)JS_GetContextPrivate(cx);
+	if (h != 0) {
+		call_debug_destroy_script(h, script);
+	}
 }
 
 /* The function callback. */
@@ -26,7 +133,7 @@ JSBool go_func_callback(JSContext *cx, uintN argc, jsval *vp) {
 
 	char* cname = JS_EncodeString(cx, JS_ValueToString(cx, name));
 
-	JSBool result = call_go_func(JS_GetContextPrivate(cx), cname, argc, vp);
+	JSBool result = call_go_func((uintptr_t)JS_GetContextPrivate(cx), cname, argc, vp);
 
 	JS_free(cx, (void*)cname);
 
@@ -36,13 +143,20 @@ JSBool go_func_callback(JSContext *cx, uintN argc, jsval *vp) {
 /* The object function callback. */
 JSBool go_obj_func_callback(JSContext *cx, uintN argc, jsval *vp) {
 	JSObject *callee = JSVAL_TO_OBJECT(JS_CALLEE(cx, vp));
+	JSObject *obj = JS_THIS_OBJECT(cx, vp);
 
 	jsval name;
 	JS_GetProperty(cx, callee, "name", &name);
 
 	char* cname = JS_EncodeString(cx, JS_ValueToString(cx, name));
 
-	JSBool result = call_go_obj_func(JS_GetPrivate(cx, JS_THIS_OBJECT(cx, vp)), cname, argc, vp);
+	JSBool result = JS_FALSE;
+
+	if (obj != NULL) {
+		result = call_go_obj_func((uintptr_t)JS_GetContextPrivate(cx), obj, cname, argc, vp);
+	} else {
+		JS_ReportError(cx, "%s called on incompatible object", cname);
+	}
 
 	JS_free(cx, (void*)cname);
 
@@ -51,9 +165,13 @@ JSBool go_obj_func_callback(JSContext *cx, uintN argc, jsval *vp) {
 
 /* The property getter callback */
 JSBool go_getter_callback(JSContext *cx, JSObject *obj, jsid id, jsval *vp) {
+	if (!JSID_IS_STRING(id)) {
+		return JS_TRUE;
+	}
+
 	char* cname = JS_EncodeString(cx, JSID_TO_STRING(id));
 
-	JSBool result = call_go_getter(JS_GetPrivate(cx, obj), cname, vp);
+	JSBool result = call_go_getter((uintptr_t)JS_GetContextPrivate(cx), obj, cname, vp);
 
 	JS_free(cx, (void*)cname);
 
@@ -62,9 +180,13 @@ JSBool go_getter_callback(JSContext *cx, JSObject *obj, jsid id, jsval *vp) {
 
 /* The property setter callback */
 JSBool go_setter_callback(JSContext *cx, JSObject *obj, jsid id, JSBool strict, jsval *vp) {
+	if (!JSID_IS_STRING(id)) {
+		return JS_TRUE;
+	}
+
 	char* cname = JS_EncodeString(cx, JSID_TO_STRING(id));
 
-	JSBool result = call_go_setter(JS_GetPrivate(cx, obj), cname, vp);
+	JSBool result = call_go_setter((uintptr_t)JS_GetContextPrivate(cx), obj, cname, vp);
 
 	JS_free(cx, (void*)cname);
 
@@ -88,9 +210,41 @@ jsval GET_VOID() {
 	return JSVAL_VOID;
 }
 
+void report_error(JSContext *cx, const char *message) {
+	JS_ReportError(cx, "%s", message);
+}
+
+/* Go objects are referenced by cgo handles instead of Go pointers. */
+int debug_build() {
+#if defined(DEBUG) || defined(JS_DEBUG)
+	return 1;
+#else
+	return 0;
+#endif
+}
+
+void set_context_handle(JSContext *cx, uintptr_t h) {
+	JS_SetContextPrivate(cx, (void*)h);
+}
+
+void set_private_handle(JSContext *cx, JSObject *obj, uintptr_t h) {
+	JS_SetPrivate(cx, obj, (void*)h);
+}
+
+uintptr_t get_private_handle(JSContext *cx, JSObject *obj) {
+	if (!JS_InstanceOf(cx, obj, &go_object_class, NULL)) {
+		return 0;
+	}
+	return (uintptr_t)JS_GetPrivate(cx, obj);
+}
+
 /* Function pointers to avoid CGO warnning. */
 JSErrorReporter    the_error_callback = &error_callback;
 JSNative           the_go_func_callback = &go_func_callback;
 JSNative           the_go_obj_func_callback = &go_obj_func_callback;
 JSPropertyOp       the_go_getter_callback = &go_getter_callback;
 JSStrictPropertyOp the_go_setter_callback = &go_setter_callback;
+JSOperationCallback the_operation_callback = &operation_callback;
+JSTrapHandler      the_debug_trap = &debug_trap;
+JSNewScriptHook    the_new_script_hook = &new_script_hook;
+JSDestroyScriptHook the_destroy_script_hook = &destroy_script_hook;
@@ -1,15 +1,27 @@
 #ifndef _MONKEY_H_
 #define _MONKEY_H_
 
+#include <stdlib.h>
+#include <stdint.h>
+#include <pthread.h>
 #include "js/jsapi.h"
+#include "js/jsxdrapi.h"
+#include "js/jsdbgapi.h"
 
 /* Function pointers to avoid CGO warnning. */
 extern JSClass            global_class;
+extern JSClass            sandbox_global_class;
+extern JSSecurityCallbacks sandbox_security_callbacks;
+extern JSClass            go_object_class;
 extern JSErrorReporter    the_error_callback;
 extern JSNative           the_go_func_callback;
 extern JSNative           the_go_obj_func_callback;
 extern JSPropertyOp       the_go_getter_callback;
 extern JSStrictPropertyOp the_go_setter_callback;
+extern JSOperationCallback the_operation_callback;
+extern JSTrapHandler      the_debug_trap;
+extern JSNewScriptHook    the_new_script_hook;
+extern JSDestroyScriptHook the_destroy_script_hook;
 
 /* File name for evaluate script. */
 extern const char* eval_filename;
@@ -20,4 +32,27 @@ extern jsval GET_ARGV(JSContext *cx, jsval* vp, int n);
 extern jsval GET_NULL();
 extern jsval GET_VOID();
 
+/* JS_ReportError is variadic, which CGO can't call. */
+extern void report_error(JSContext *cx, const char *message);
+
+/* Whether the engine is a debug build, its bytecode differs. */
+extern int debug_build();
+
+/* The bytecodes of an evaluation, counted by the interrupt hook. */
+typedef struct budget {
+	JSContext *cx;
+	uint64_t   limit;
+	uint64_t   used;
+} budget;
+
+extern budget *set_budget(budget *b);
+
+/* Set the interrupt hook, stepping tells whether it calls the debugger. */
+extern void set_interrupt(JSRuntime *rt, int stepping);
+
+/* Go objects are referenced by cgo handles instead of Go pointers. */
+extern void      set_context_handle(JSContext *cx, uintptr_t h);
+extern void      set_private_handle(JSContext *cx, JSObject *obj, uintptr_t h);
+extern uintptr_t get_private_handle(JSContext *cx, JSObject *obj);
+
 #endif
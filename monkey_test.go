@@ -1,6 +1,16 @@
 package monkey
 
-import "testing"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+)
 
 var rt *Runtime
 var cx *Context
@@ -226,3 +236,1560 @@ func Benchmark_OOXX_BY_GO_IN_USE(b *testing.B) {
 		}
 	})
 }
+
+func Test_Release(t *testing.T) {
+	rt := NewRuntime(8 * 1024 * 1024)
+	cx := rt.NewContext()
+
+	base := rt.LiveRoots()
+
+	v := cx.Eval("({a:1})")
+	o := v.ToObject()
+	a := cx.Eval("[1,2,3]").ToArray()
+
+	if rt.LiveRoots() != base+4 {
+		t.Fatal(rt.LiveRoots())
+	}
+
+	v.Release()
+	o.Release()
+	a.Release()
+	a.Release()
+
+	if rt.LiveRoots() != base+1 {
+		t.Fatal(rt.LiveRoots())
+	}
+
+	if v.IsObject() || v.ToGo() != nil || v.ToString() != "" {
+		t.Fatal()
+	}
+	if o.GetProperty("a") != nil || len(o.Keys()) != 0 {
+		t.Fatal()
+	}
+	if cx.GlobalObject().SetProperty("v", v) {
+		t.Fatal()
+	}
+
+	var nv *Value
+	var no *Object
+	var na *Array
+	nv.Release()
+	no.Release()
+	na.Release()
+}
+
+func Test_Scope(t *testing.T) {
+	rt := NewRuntime(8 * 1024 * 1024)
+	cx := rt.NewContext()
+
+	base := rt.LiveRoots()
+
+	var kept *Value
+
+	cx.Scope(func(s *Scope) {
+		for i := 0; i < 100; i++ {
+			cx.Eval("({a:1})").ToObject().GetProperty("a")
+		}
+		kept = cx.Int(123)
+		s.Escape(kept)
+	})
+
+	if rt.LiveRoots() != base+1 {
+		t.Fatal(rt.LiveRoots())
+	}
+
+	if i, ok := kept.ToInt(); !ok || i != 123 {
+		t.Fatal(i, ok)
+	}
+}
+
+func Test_ForeignObject(t *testing.T) {
+	cx := rt.NewContext()
+	defer cx.Dispose()
+
+	ok := cx.GlobalObject().DefineFunction("twice", func(o *Object, name string, argv []*Value) *Value {
+		i, _ := argv[0].ToInt()
+		return cx.Int(i * 2)
+	})
+	if !ok {
+		t.Fatal()
+	}
+
+	obj := cx.Eval("var obj = {}; obj").ToObject()
+	ok = obj.DefineProperty("answer", cx.Void(), func(g *Getter) {
+		g.Return(cx.Int(42))
+	}, nil, 0)
+	if !ok {
+		t.Fatal()
+	}
+
+	if v, err := cx.EvalWith("twice(21) + obj.answer", EvalOptions{}); err != nil || v.ToString() != "84" {
+		t.Fatal(v, err)
+	}
+
+	// Another handle of the same object finds the callbacks.
+	obj.Release()
+	if v := cx.Eval("obj").ToObject().GetProperty("answer"); v == nil || v.ToString() != "42" {
+		t.Fatal(v)
+	}
+}
+
+func Test_LeakReporter(t *testing.T) {
+	rt := NewRuntime(8 * 1024 * 1024)
+	cx := rt.NewContext()
+
+	leaks := make(chan *LeakReport, 100)
+
+	rt.SetLeakReporter(func(report *LeakReport) {
+		select {
+		case leaks <- report:
+		default:
+		}
+	})
+
+	func() {
+		cx.Eval("'leaked'")
+	}()
+
+	for i := 0; i < 50; i++ {
+		runtime.GC()
+		select {
+		case report := <-leaks:
+			if report.Kind != "value" || !strings.Contains(report.Stack, "Test_LeakReporter") {
+				t.Fatal(report.Kind, report.Stack)
+			}
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	t.Fatal("leak not reported")
+}
+
+func Test_CloseWithLiveHandles(t *testing.T) {
+	rt := NewRuntime(8 * 1024 * 1024)
+
+	var values []*Value
+	var objects []*Object
+	var scripts []*Script
+
+	for i := 0; i < 4; i++ {
+		cx := rt.NewContext()
+		for j := 0; j < 1000; j++ {
+			values = append(values, cx.Int(int32(j)))
+			objects = append(objects, cx.NewObject(nil))
+		}
+		scripts = append(scripts, cx.Compile("1 + 1", "close", 0))
+	}
+
+	cx := rt.NewContext()
+
+	stop := make(chan struct{})
+	wg := new(sync.WaitGroup)
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if cx.Eval("1 + 1") == nil {
+					return
+				}
+			}
+		}()
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	if err := rt.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	close(stop)
+	wg.Wait()
+
+	if err := rt.Close(); err != ErrDisposed {
+		t.Fatal(err)
+	}
+
+	if err := rt.Use(func() {}); err != ErrDisposed {
+		t.Fatal(err)
+	}
+
+	for _, v := range values {
+		if _, ok := v.ToInt(); ok {
+			t.Fatal("value still usable")
+		}
+		v.Release()
+	}
+
+	for _, o := range objects {
+		if o.SetInt("a", 1) {
+			t.Fatal("object still usable")
+		}
+	}
+
+	for _, s := range scripts {
+		if s.Execute() != nil {
+			t.Fatal("script still usable")
+		}
+	}
+
+	if cx.Eval("1") != nil || rt.NewContext() != nil {
+		t.Fatal("context still usable")
+	}
+
+	// Finalizers of the dropped handles must not block.
+	values, objects, scripts = nil, nil, nil
+	runtime.GC()
+	runtime.GC()
+}
+
+func Test_NestedUse(t *testing.T) {
+	rt := NewRuntime(8 * 1024 * 1024)
+	cx := rt.NewContext()
+
+	cx.DefineFunction("nested", func(f *Func) {
+		var result *Value
+		rt.Use(func() {
+			rt.Use(func() {
+				result = f.Context().Eval("1 + 2")
+			})
+		})
+		f.Return(result)
+	})
+
+	done := make(chan *Value, 1)
+
+	go func() {
+		var result *Value
+		rt.Use(func() {
+			result = cx.Eval("nested() + nested()")
+		})
+		done <- result
+	}()
+
+	select {
+	case v := <-done:
+		if i, ok := v.ToInt(); !ok || i != 6 {
+			t.Fatal(i, ok)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("nested Use deadlocked")
+	}
+}
+
+func Test_Batch(t *testing.T) {
+	obj := cx.Eval("({a: 1, b: 'x', f: function(n) { return this.a + n; }})").ToObject()
+
+	var escaped *Batch
+
+	err := rt.Batch(func(b *Batch) {
+		escaped = b
+
+		if i, ok := b.ToInt(b.Get(obj, "a")); !ok || i != 1 {
+			t.Fatal(i, ok)
+		}
+
+		if !b.Set(obj, "a", b.Int(cx, 10)) {
+			t.Fatal()
+		}
+
+		if s := b.ToString(b.Get(obj, "b")); s != "x" {
+			t.Fatal(s)
+		}
+
+		if i, ok := b.ToInt(b.CallMethod(obj, "f", b.Int(cx, 5))); !ok || i != 15 {
+			t.Fatal(i, ok)
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if i, ok := obj.GetInt("a"); !ok || i != 10 {
+		t.Fatal(i, ok)
+	}
+
+	// Out of the runtime thread the batch does nothing.
+	if escaped.Get(obj, "a") != nil || escaped.Set(obj, "a", cx.Int(1)) {
+		t.Fatal()
+	}
+
+	// Nil and released handles are refused.
+	released := cx.Int(1)
+	released.Release()
+	rt.Batch(func(b *Batch) {
+		if i, ok := b.ToInt(nil); ok || i != 0 {
+			t.Fatal(i, ok)
+		}
+		if _, ok := b.ToInt(released); ok || b.Set(obj, "a", released) || b.Get(nil, "a") != nil {
+			t.Fatal()
+		}
+		if b.CallMethod(obj, "f", released) != nil {
+			t.Fatal()
+		}
+	})
+	if i, ok := obj.GetInt("a"); !ok || i != 10 {
+		t.Fatal(i, ok)
+	}
+}
+
+func Benchmark_GET_INT(b *testing.B) {
+	obj := cx.Eval("({a: 1})").ToObject()
+	for i := 0; i < b.N; i++ {
+		obj.GetInt("a")
+	}
+}
+
+func Benchmark_GET_INT_IN_BATCH(b *testing.B) {
+	obj := cx.Eval("({a: 1})").ToObject()
+	rt.Batch(func(batch *Batch) {
+		for i := 0; i < b.N; i++ {
+			v := batch.Get(obj, "a")
+			batch.ToInt(v)
+			v.Release()
+		}
+	})
+}
+
+func Test_EvalAsync(t *testing.T) {
+	f := cx.EvalAsync("1 + 2")
+
+	v, err := f.Wait(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if i, ok := v.ToInt(); !ok || i != 3 {
+		t.Fatal(i, ok)
+	}
+
+	<-f.Done()
+
+	if f.Value() != v || f.Err() != nil {
+		t.Fatal()
+	}
+
+	_, err = cx.EvalAsync("throw new Error('boom')").Wait(context.Background())
+	if report, ok := err.(*ErrorReport); !ok || !strings.Contains(report.Message, "boom") {
+		t.Fatal(err)
+	}
+
+	fn := cx.Eval("(function(a, b) { return a * b; })")
+	v, err = fn.CallAsync([]*Value{cx.Int(6), cx.Int(7)}).Wait(context.Background())
+	if i, ok := v.ToInt(); err != nil || !ok || i != 42 {
+		t.Fatal(i, ok, err)
+	}
+
+	fn2 := cx.Eval("(function() { return 1; })")
+	fn2.Release()
+	if v, err := fn2.CallAsync(nil).Wait(context.Background()); v != nil || err != ErrDisposed {
+		t.Fatal(v, err)
+	}
+
+	v, err = script1.ExecuteAsync().Wait(context.Background())
+	if i, ok := v.ToInt(); err != nil || !ok || i != 2 {
+		t.Fatal(i, ok, err)
+	}
+
+	v, err = script1.ExecuteAsyncPriority(PriorityInteractive).Wait(context.Background())
+	if i, ok := v.ToInt(); err != nil || !ok || i != 2 {
+		t.Fatal(i, ok, err)
+	}
+}
+
+func Test_EvalAsyncPriority(t *testing.T) {
+	rt := NewRuntime(8 * 1024 * 1024)
+	cx := rt.NewContext()
+	cx.Eval("var order = [];")
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	go rt.Use(func() {
+		close(started)
+		<-release
+	})
+
+	<-started
+
+	background := cx.EvalAsyncPriority("order.push('background')", PriorityBackground)
+	normal := cx.EvalAsync("order.push('normal')")
+	interactive := cx.EvalAsyncPriority("order.push('interactive')", PriorityInteractive)
+
+	close(release)
+
+	for _, f := range []*Future{background, normal, interactive} {
+		if _, err := f.Wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if order := cx.Eval("order.join(',')").ToString(); order != "interactive,normal,background" {
+		t.Fatal(order)
+	}
+
+	rt.Close()
+
+	if _, err := cx.EvalAsync("1").Wait(context.Background()); err != ErrDisposed {
+		t.Fatal(err)
+	}
+}
+
+func Test_EventLoop(t *testing.T) {
+	rt := NewRuntime(8 * 1024 * 1024)
+	defer rt.Close()
+	cx := rt.NewContext()
+
+	if err := cx.RunLoop(context.Background()); err != ErrNoEventLoop {
+		t.Fatal(err)
+	}
+
+	clock := NewFakeClock(time.Unix(0, 0))
+	clock.AutoAdvance = true
+
+	if !cx.InitEventLoop(clock) {
+		t.Fatal()
+	}
+
+	cx.Eval(`
+		var order = [];
+		setTimeout(function(x) { order.push('timeout ' + x); }, 20, 20);
+		setTimeout(function(x) { order.push('timeout ' + x); }, 10, 10);
+		var n = 0, interval = setInterval(function() {
+			order.push('interval');
+			if (++n == 3) clearInterval(interval);
+		}, 5);
+		clearTimeout(setTimeout(function() { order.push('cleared'); }, 1));
+		setImmediate(function() {
+			order.push('immediate');
+			queueMicrotask(function() { order.push('microtask'); });
+		});
+		queueMicrotask(function() { order.push('first'); });
+	`)
+
+	if err := cx.RunLoop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	order := cx.Eval("order.join(',')").ToString()
+	if order != "first,immediate,microtask,interval,timeout 10,interval,interval,timeout 20" {
+		t.Fatal(order)
+	}
+
+	if elapsed := clock.Now().Sub(time.Unix(0, 0)); elapsed != 20*time.Millisecond {
+		t.Fatal(elapsed)
+	}
+
+	cx.Eval("setTimeout(function() { throw new Error('boom'); }, 1)")
+
+	if err := cx.RunLoop(context.Background()); err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Fatal(err)
+	}
+}
+
+func Test_EventLoopCancel(t *testing.T) {
+	rt := NewRuntime(8 * 1024 * 1024)
+	defer rt.Close()
+	cx := rt.NewContext()
+	cx.InitEventLoop(nil)
+
+	cx.Eval("var ticks = 0; setInterval(function() { ticks++; }, 1);")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := cx.RunLoop(ctx); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+
+	if ticks, _ := cx.Eval("ticks").ToInt(); ticks == 0 {
+		t.Fatal(ticks)
+	}
+}
+
+func Test_EventLoopMicrotaskError(t *testing.T) {
+	rt := NewRuntime(8 * 1024 * 1024)
+	defer rt.Close()
+	cx := rt.NewContext()
+	cx.InitEventLoop(nil)
+
+	cx.Eval(`setTimeout(function() {
+		queueMicrotask(function() { throw new Error('microtask failed'); });
+	}, 0);`)
+
+	err := cx.RunLoop(context.Background())
+	if report, ok := err.(*ErrorReport); !ok || !strings.Contains(report.Message, "microtask failed") {
+		t.Fatal(err)
+	}
+}
+
+func Test_AsyncFunction(t *testing.T) {
+	rt := NewRuntime(8 * 1024 * 1024)
+	defer rt.Close()
+	cx := rt.NewContext()
+
+	if cx.DefineAsyncFunction("fetch", nil) {
+		t.Fatal("defined without event loop")
+	}
+
+	cx.InitEventLoop(nil)
+
+	ok := cx.DefineAsyncFunction("fetch", func(argv []*Value) (interface{}, error) {
+		name := argv[0].ToString()
+		if name == "bad" {
+			return nil, errors.New("not found")
+		}
+		time.Sleep(10 * time.Millisecond)
+		return map[string]interface{}{"name": name, "size": []int{1, 2}}, nil
+	})
+	if !ok {
+		t.Fatal()
+	}
+
+	cx.Eval(`
+		var results = [];
+		fetch('a', function(err, v) { results.push(v.name + v.size.length); });
+		fetch('bad', function(err, v) { results.push(err.message); });
+		fetch('b').then(function(v) { results.push(v.name); });
+		fetch('bad').then(null, function(e) { results.push(e instanceof Error); });
+	`)
+
+	if err := cx.RunLoop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	results := cx.Eval("results.sort().join(',')").ToString()
+	if results != "a2,b,not found,true" {
+		t.Fatal(results)
+	}
+}
+
+func Test_Channel(t *testing.T) {
+	rt := NewRuntime(8 * 1024 * 1024)
+	defer rt.Close()
+	cx := rt.NewContext()
+	cx.InitEventLoop(nil)
+
+	in := make(chan string)
+	out := make(chan int, 3)
+
+	cx.GlobalObject().SetObject("input", cx.NewChannel(in))
+	cx.GlobalObject().SetObject("output", cx.NewChannel(out))
+
+	go func() {
+		in <- "abc"
+		in <- "de"
+		close(in)
+	}()
+
+	cx.Eval(`
+		function next() {
+			input.recv(function(v, ok) {
+				if (!ok) { output.close(); return; }
+				output.send(v.length, next);
+			});
+		}
+		next();
+	`)
+
+	if err := cx.RunLoop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var lengths []int
+	for n := range out {
+		lengths = append(lengths, n)
+	}
+
+	if len(lengths) != 2 || lengths[0] != 3 || lengths[1] != 2 {
+		t.Fatal(lengths)
+	}
+
+	if cx.Eval("try { output.send('x'); false } catch (e) { true }").ToString() != "true" {
+		t.Fatal()
+	}
+
+	objects := make(chan map[string]interface{}, 1)
+	cx.GlobalObject().SetObject("objects", cx.NewChannel(objects))
+
+	if s := cx.Eval("var a = {}; a.self = a; try { objects.send(a); '' } catch (e) { e.message }").ToString(); !strings.Contains(s, "cyclic") {
+		t.Fatal(s)
+	}
+
+	cx.Eval("objects.send({0: 'a', b: [1, 2]})")
+	if m := <-objects; fmt.Sprint(m) != "map[0:a b:[1 2]]" {
+		t.Fatal(m)
+	}
+}
+
+func Test_Promise(t *testing.T) {
+	rt := NewRuntime(8 * 1024 * 1024)
+	defer rt.Close()
+	cx := rt.NewContext()
+
+	if !cx.InitPromise() {
+		t.Fatal()
+	}
+
+	cx.Eval(`
+		var log = [];
+		Promise.resolve(1).then(function(v) { log.push('then ' + v); return v + 1; })
+			.then(function(v) { throw new Error('e' + v); })
+			.catch(function(e) { log.push('catch ' + e.message); })
+			.finally(function() { log.push('finally'); });
+		Promise.all([1, Promise.resolve(2), {then: function(r) { r(3); }}])
+			.then(function(v) { log.push('all ' + v.join('')); });
+		Promise.race([new Promise(function() {}), Promise.reject('x')])
+			.then(null, function(r) { log.push('race ' + r); });
+		Promise.allSettled([Promise.reject(1), 2]).then(function(v) {
+			log.push('settled ' + v[0].status + ' ' + v[1].value);
+		});
+		log.push('sync');
+	`)
+
+	log := cx.Eval("log.join(',')").ToString()
+	if log != "sync,then 1,race x,settled rejected 2,catch e2,all 123,finally" {
+		t.Fatal(log)
+	}
+
+	promise, resolve, _ := cx.NewPromise()
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		resolve(cx.Int(42))
+	}()
+
+	v, err := promise.ToValue().Await(context.Background())
+	if i, ok := v.ToInt(); err != nil || !ok || i != 42 {
+		t.Fatal(i, ok, err)
+	}
+
+	_, err = cx.Eval("Promise.reject(new Error('boom'))").Await(context.Background())
+	if perr, ok := err.(*PromiseError); !ok || !strings.Contains(perr.Error(), "boom") {
+		t.Fatal(err)
+	}
+
+	if v, err := cx.Int(7).Await(context.Background()); err != nil || v.ToString() != "7" {
+		t.Fatal(v, err)
+	}
+
+	// A thenable of which the then getter throws isn't fulfilled.
+	thrower := cx.Eval("({get then() { throw new Error('no then'); }})")
+	if v, err := thrower.Await(context.Background()); v != nil || err == nil || !strings.Contains(err.Error(), "no then") {
+		t.Fatal(v, err)
+	}
+
+	promise, _, _ = cx.NewPromise()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := promise.ToValue().Await(ctx); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+}
+
+func Test_Console(t *testing.T) {
+	rt := NewRuntime(8 * 1024 * 1024)
+	defer rt.Close()
+	cx := rt.NewContext()
+
+	var messages []string
+
+	ok := cx.InitConsole(ConsoleHandlerFunc(func(level ConsoleLevel, message string) {
+		messages = append(messages, level.String()+" "+message)
+	}))
+	if !ok {
+		t.Fatal()
+	}
+
+	cx.Eval(`
+		console.log('%s has %d items', 'list', 3.7, {a: [1, 'x']});
+		console.warn(null, undefined, function foo() {});
+		var o = {}; o.self = o;
+		console.error(o);
+		console.assert(1 == 2, 'bad %o', 'v');
+		console.debug('%j', {b: 1});
+		console.table([{a: 1}, {b: 'y'}]);
+	`)
+
+	expected := []string{
+		"log list has 3 items { a: [ 1, 'x' ] }",
+		"warn null undefined [Function: foo]",
+		"error { self: [Circular] }",
+		"error Assertion failed: bad 'v'",
+		`debug {"b":1}`,
+		"log ┌─────────┬───┬─────┐\n" +
+			"│ (index) │ a │  b  │\n" +
+			"├─────────┼───┼─────┤\n" +
+			"│    0    │ 1 │     │\n" +
+			"│    1    │   │ 'y' │\n" +
+			"└─────────┴───┴─────┘",
+	}
+
+	if len(messages) != len(expected) {
+		t.Fatal(messages)
+	}
+
+	for i := range expected {
+		if messages[i] != expected[i] {
+			t.Fatalf("%q != %q", messages[i], expected[i])
+		}
+	}
+
+	var buf strings.Builder
+	cx.SetConsoleHandler(NewConsoleWriter(&buf))
+	cx.Eval("console.info('a', 1)")
+
+	if buf.String() != "a 1\n" {
+		t.Fatal(buf.String())
+	}
+}
+
+func Test_Require(t *testing.T) {
+	rt := NewRuntime(8 * 1024 * 1024)
+	defer rt.Close()
+	cx := rt.NewContext()
+
+	fsys := fstest.MapFS{
+		"main.js":                       {Data: []byte("exports.sum = require('./lib/math').add(1, 2);")},
+		"lib/math.js":                   {Data: []byte("var cfg = require('../config'); exports.add = function(a, b) { return a + b + cfg.offset; };")},
+		"config.json":                   {Data: []byte(`{"offset": 10}`)},
+		"a.js":                          {Data: []byte("exports.early = 'a'; exports.fromB = require('./b').value; exports.done = true;")},
+		"b.js":                          {Data: []byte("var a = require('./a'); exports.value = a.early + (a.done ? '!' : '?');")},
+		"node_modules/pkg/package.json": {Data: []byte(`{"main": "src/main"}`)},
+		"node_modules/pkg/src/main.js":  {Data: []byte("module.exports = __filename + ' ' + __dirname;")},
+		"node_modules/other/index.js":   {Data: []byte("module.exports = require('pkg');")},
+		"broken.js":                     {Data: []byte("exports.x = ;")},
+	}
+
+	cx.RegisterModule("native", func(cx *Context) (*Value, error) {
+		return cx.ValueOf(map[string]interface{}{"name": "go"})
+	})
+
+	if !cx.InitRequire(fsys) {
+		t.Fatal()
+	}
+
+	tests := map[string]string{
+		"require('./main').sum":                                "13",
+		"require('/main') === require('./main.js')":            "true",
+		"require('./a').fromB":                                 "a?",
+		"require('pkg')":                                       "node_modules/pkg/src/main.js node_modules/pkg/src",
+		"require('other') === require('pkg')":                  "true",
+		"require('native').name":                               "go",
+		"require('lib/math').add(1, 2)":                        "13",
+		"require('lib/math') === require('./lib/math')":        "true",
+		"require.resolve('./config')":                          "config.json",
+		"try { require('./missing') } catch (e) { e.message }": "Cannot find module './missing'",
+		"try { require('../outside') } catch (e) { 'caught' }": "caught",
+		"try { require('./broken') } catch (e) { 'caught' }":   "caught",
+		"'broken.js' in require.cache":                         "false",
+	}
+
+	for script, expected := range tests {
+		if v := cx.Eval(script); v == nil || v.ToString() != expected {
+			t.Fatal(script, v)
+		}
+	}
+}
+
+func Test_Modules(t *testing.T) {
+	rt := NewRuntime(8 * 1024 * 1024)
+	defer rt.Close()
+	cx := rt.NewContext()
+
+	fsys := fstest.MapFS{
+		"lib/math.js":  {Data: []byte("export var base = 10;\nexport function add(a, b) {\n  return a + b + base;\n}\nexport default 'math';")},
+		"lib/index.js": {Data: []byte("export * from './math';\nexport { add as plus } from './math';\nimport data from '../data.json';\nexport const size = data.size;")},
+		"data.json":    {Data: []byte(`{"size": 3}`)},
+	}
+
+	if !cx.EnableModules(NewFSModuleResolver(fsys)) {
+		t.Fatal()
+	}
+
+	script := cx.Compile("import name, { add } from './lib/math';\nimport * as lib from './lib';\nexport const result = name + ':' + add(1, 2) + ':' + lib.plus(0, 0) + ':' + lib.size;", "main.js", 1)
+	if script == nil {
+		t.Fatal()
+	}
+
+	ns := script.Execute()
+	if result, _ := ns.ToObject().GetString("result"); result != "math:13:10:3" {
+		t.Fatal(result)
+	}
+
+	// Plain scripts are not changed.
+	if v := cx.Compile("1 + 1", "plain.js", 1).Execute(); v.ToString() != "2" {
+		t.Fatal(v)
+	}
+
+	var report *ErrorReport
+	cx.SetErrorReporter(func(r *ErrorReport) {
+		report = r
+	})
+
+	if cx.Compile("var a;\nimport { x } from './missing';", "bad.js", 1) != nil {
+		t.Fatal()
+	}
+
+	if report == nil || report.LineNum != 2 || !strings.Contains(report.Message, "Cannot find module") {
+		t.Fatal(report)
+	}
+}
+
+func Test_SourceMap(t *testing.T) {
+	cx := rt.NewContext()
+
+	sm, err := ParseSourceMap([]byte(`{"version":3,"file":"bundle.js","sourceRoot":"src","sources":["a.js"],"names":["f"],"mappings":"AAEA,SAAIA;AACA;;AAMA"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pos, ok := sm.Lookup(1, 12); !ok || pos != (SourcePosition{"src/a.js", 3, 4, "f"}) {
+		t.Fatal(pos)
+	}
+
+	if _, ok := sm.Lookup(3, 0); ok {
+		t.Fatal()
+	}
+
+	bundle := "function f() {\n  throw new Error('boom');\n}\nf();"
+
+	_, err = cx.EvalWith(bundle, EvalOptions{FileName: "bundle.js", SourceMap: sm})
+	if r, ok := err.(*ErrorReport); !ok || r.FileName != "src/a.js" || r.LineNum != 4 {
+		t.Fatal(err)
+	}
+
+	stack := cx.Eval("try { f() } catch (e) { e.stack }").ToString()
+	if remapped := cx.RemapStack(stack); !strings.Contains(remapped, "f()@src/a.js:4") {
+		t.Fatal(remapped)
+	}
+
+	sm, _ = ParseSourceMap([]byte(`{"version":3,"sources":["b.js"],"names":[],"mappings":"AAAA;AAIA"}`))
+
+	if _, err := cx.CompileWith("var a = 1;\nvar b = ;", EvalOptions{FileName: "min.js", SourceMap: sm}); err == nil {
+		t.Fatal()
+	} else if r := err.(*ErrorReport); r.FileName != "b.js" || r.LineNum != 5 {
+		t.Fatal(r)
+	}
+
+	if _, err := cx.EvalWith("1", EvalOptions{SourceMap: sm}); err != ErrSourceMapFileName {
+		t.Fatal(err)
+	}
+
+	// The column of a runtime error isn't known, a line of many original lines isn't remapped.
+	sm, _ = ParseSourceMap([]byte(`{"version":3,"sources":["c.js"],"names":[],"mappings":"AAAA,MACA"}`))
+
+	_, err = cx.EvalWith("var x = 1; throw new Error('min');", EvalOptions{FileName: "c.min.js", SourceMap: sm})
+	if r, ok := err.(*ErrorReport); !ok || r.FileName != "c.min.js" || r.LineNum != 1 {
+		t.Fatal(err)
+	}
+}
+
+func Test_Compiled(t *testing.T) {
+	cx := rt.NewContext()
+
+	script := cx.Compile("function twice(x) { return x * 2; }\ntwice(21);", "twice.js", 1)
+	data, err := script.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := rt.NewContext().LoadCompiled(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if v := loaded.Execute(); v == nil || v.ToString() != "42" {
+			t.Fatal(v)
+		}
+	}
+
+	// The bytecode version, the pointer size, the debug flag and the architecture.
+	for _, i := range []int{4, 8, 9, 11} {
+		stale := append([]byte(nil), data...)
+		stale[i]++
+		if _, err := cx.LoadCompiled(stale); err != ErrCompiledVersion {
+			t.Fatal(i, err)
+		}
+	}
+
+	if _, err := cx.LoadCompiled([]byte("twice(21)")); err != ErrInvalidCompiled {
+		t.Fatal(err)
+	}
+}
+
+func Test_CompileFunction(t *testing.T) {
+	cx := rt.NewContext()
+
+	add, err := cx.CompileFunction("add", []string{"a", "b"}, "return a + b + (this.base || 0);", "add.js", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if v, err := add.Call(i, 10); err != nil || v.ToString() != fmt.Sprint(i+10) {
+			t.Fatal(v, err)
+		}
+	}
+
+	// Not defined in the global object.
+	if v := cx.Eval("typeof add"); v.ToString() != "undefined" {
+		t.Fatal(v)
+	}
+
+	this := cx.Eval("({base: 100})").ToObject()
+	if v, err := add.Bind(this).Call(1, 2); err != nil || v.ToString() != "103" {
+		t.Fatal(v, err)
+	}
+
+	cx.GlobalObject().SetProperty("add", add.Value())
+	if v := cx.Eval("add(1, 1)"); v.ToString() != "2" {
+		t.Fatal(v)
+	}
+
+	fail, _ := cx.CompileFunction("", nil, "throw new Error('boom');", "fail.js", 1)
+	if _, err := fail.Call(); err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Fatal(err)
+	}
+
+	if _, err := cx.CompileFunction("bad", nil, "return ;;)", "bad.js", 1); err == nil {
+		t.Fatal()
+	}
+}
+
+func Test_FunctionRoots(t *testing.T) {
+	rt := NewRuntime(8 * 1024 * 1024)
+	defer rt.Close()
+	cx := rt.NewContext()
+
+	get, _ := cx.CompileFunction("get", []string{"name"}, "return this[name];", "get.js", 1)
+
+	// The bound function roots its this object.
+	obj := cx.Eval("({base: 100})")
+	this := obj.ToObject()
+	bound := get.Bind(this)
+	obj.Release()
+	this.Release()
+
+	base := rt.LiveRoots()
+
+	v, err := bound.Call("base")
+	if err != nil || v.ToString() != "100" {
+		t.Fatal(v, err)
+	}
+	v.Release()
+
+	// The roots of the arguments are removed after the call.
+	if rt.LiveRoots() != base {
+		t.Fatal(rt.LiveRoots(), base)
+	}
+
+	bound.Release()
+	if rt.LiveRoots() != base-2 {
+		t.Fatal(rt.LiveRoots(), base)
+	}
+
+	if bound.Value() != nil {
+		t.Fatal("value of a released function")
+	}
+}
+
+func Test_CheckSyntax(t *testing.T) {
+	cx := rt.NewContext()
+
+	if errs := cx.CheckSyntax("var ran = true;", "ok.js"); errs != nil {
+		t.Fatal(errs)
+	}
+
+	if v := cx.Eval("typeof ran"); v.ToString() != "undefined" {
+		t.Fatal(v)
+	}
+
+	errs := cx.CheckSyntax("var a = ;\nvar ok = 1;\nvar b = );", "bad.js")
+	if len(errs) != 2 || errs[0].LineNum != 1 || errs[1].LineNum != 3 || errs[0].FileName != "bad.js" {
+		t.Fatal(errs)
+	}
+
+	if errs[0].Token != ";" || errs[1].Token != ")" {
+		t.Fatal(errs[0].Token, errs[1].Token)
+	}
+
+	tests := map[string]bool{
+		"1 + 1":              true,
+		"function f() {":     false,
+		"function f() {\n}":  true,
+		"if (x) {\n  y();\n": false,
+	}
+
+	for code, expected := range tests {
+		if cx.IsCompilableUnit(code) != expected {
+			t.Fatal(code)
+		}
+	}
+}
+
+func Test_ToGo(t *testing.T) {
+	cx := rt.NewContext()
+
+	v := cx.Eval("({list: [1, 'a', null], nested: {u: undefined}, f: function() {}})").ToGo()
+	if fmt.Sprint(v) != "map[list:[1 a <nil>] nested:map[u:<nil>]]" {
+		t.Fatal(v)
+	}
+}
+
+func Test_Interrupt(t *testing.T) {
+	cx := rt.NewContext()
+
+	timer := time.AfterFunc(100*time.Millisecond, cx.Interrupt)
+	defer timer.Stop()
+
+	if _, err := cx.EvalWith("try { for (;;) {} } catch (e) {}", EvalOptions{FileName: "loop.js"}); err != ErrInterrupted {
+		t.Fatal(err)
+	}
+
+	// Only the running script is stopped.
+	if v, err := cx.EvalWith("1 + 1", EvalOptions{}); err != nil || v.ToString() != "2" {
+		t.Fatal(v, err)
+	}
+
+	// Without a running script it does nothing.
+	cx.Interrupt()
+	if v, err := cx.EvalWith("1 + 2", EvalOptions{}); err != nil || v.ToString() != "3" {
+		t.Fatal(v, err)
+	}
+
+	cx.Dispose()
+	cx.Interrupt()
+}
+
+func Test_UncaughtStack(t *testing.T) {
+	cx := rt.NewContext()
+
+	var reported *ErrorReport
+	cx.SetErrorReporter(func(r *ErrorReport) {
+		reported = r
+	})
+
+	_, err := cx.EvalWith("function fail() {\n  throw new Error('boom');\n}\nfail();", EvalOptions{FileName: "fail.js"})
+
+	r, ok := err.(*ErrorReport)
+	if !ok || r != reported || r.LineNum != 2 || !strings.Contains(r.Message, "boom") {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(r.Stack, "fail()@fail.js:2") {
+		t.Fatal(r.Stack)
+	}
+
+	// Nested calls keep the exception for the caller.
+	if v := cx.Eval("try { fail() } catch (e) { e.message }"); v.ToString() != "boom" {
+		t.Fatal(v)
+	}
+}
+
+func Test_Debugger(t *testing.T) {
+	cx := rt.NewContext()
+
+	var lines []int
+	var locals map[string]*Value
+	var frames []*Frame
+	var evaluated *Value
+	var evalErr error
+
+	d, err := cx.NewDebugger(func(p *Pause) StepMode {
+		lines = append(lines, p.Line)
+		if p.Reason == PauseBreakpoint {
+			frames = p.Frames()
+			locals, _ = frames[0].Locals()
+			evaluated, _ = p.EvalInFrame(0, "a * 10 + sum")
+			_, evalErr = p.EvalInFrame(0, "throw new Error('in frame')")
+		}
+		if len(lines) < 3 {
+			return StepOver
+		}
+		return Continue
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	d.SetBreakpoint("dbg.js", 3)
+
+	code := "function add(a, b) {\n  var sum = a + b;\n  return sum;\n}\nvar x = add(1, 2);\nx * 2;"
+	v, err := cx.EvalWith(code, EvalOptions{FileName: "dbg.js"})
+	if err != nil || v.ToString() != "6" {
+		t.Fatal(v, err)
+	}
+
+	if fmt.Sprint(lines) != "[3 5 6]" {
+		t.Fatal(lines)
+	}
+
+	if len(frames) != 2 || frames[0].Function != "add" || frames[0].Line != 3 || frames[1].Line != 5 {
+		t.Fatal(frames)
+	}
+
+	if len(locals) != 3 || locals["a"].ToString() != "1" || locals["sum"].ToString() != "3" {
+		t.Fatal(locals)
+	}
+
+	if evaluated == nil || evaluated.ToString() != "13" || evalErr == nil || !strings.Contains(evalErr.Error(), "in frame") {
+		t.Fatal(evaluated, evalErr)
+	}
+
+	if bps := d.Breakpoints(); len(bps) != 1 || bps[0] != (Breakpoint{"dbg.js", 3}) {
+		t.Fatal(bps)
+	}
+
+	d.ClearBreakpoint("dbg.js", 3)
+	lines = nil
+	if v := cx.Eval("add(2, 2)"); v.ToString() != "4" || lines != nil {
+		t.Fatal(v, lines)
+	}
+}
+
+func Test_DebuggerDispose(t *testing.T) {
+	rt := NewRuntime(8 * 1024 * 1024)
+	defer rt.Dispose()
+
+	cx1 := rt.NewContext()
+	cx2 := rt.NewContext()
+
+	pauses := 0
+	d, err := cx1.NewDebugger(func(p *Pause) StepMode {
+		pauses++
+		return StepIn
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.SetBreakpoint("step.js", 1)
+
+	if _, err := cx1.EvalWith("var a = 1;\na + 1;", EvalOptions{FileName: "step.js"}); err != nil || pauses == 0 {
+		t.Fatal(pauses, err)
+	}
+
+	// The debugger is still stepping when its context is disposed.
+	cx1.Dispose()
+	d.Close()
+
+	before := pauses
+	if v := cx2.Eval("var n = 0; for (var i = 0; i < 1000; i++) n += i; n"); v.ToString() != "499500" || pauses != before {
+		t.Fatal(v, pauses)
+	}
+}
+
+func Test_Profiler(t *testing.T) {
+	cx := rt.NewContext()
+
+	if cx.StopProfiling() != nil {
+		t.Fatal("not profiled")
+	}
+
+	if err := cx.StartProfiling(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cx.StartProfiling(); err != ErrProfiling {
+		t.Fatal(err)
+	}
+
+	_, err := cx.EvalWith(`function hot() {
+  var end = Date.now() + 200, n = 0;
+  while (Date.now() < end) n++;
+  return n;
+}
+hot();`, EvalOptions{FileName: "hot.js"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prof := cx.StopProfiling()
+	if prof == nil {
+		t.Fatal("no profile")
+	}
+	if err := prof.CheckValid(); err != nil {
+		t.Fatal(err)
+	}
+
+	var hot int64
+	for _, s := range prof.Sample {
+		fn := s.Location[0].Line[0].Function
+		if fn.Name == "hot" && fn.Filename == "hot.js" {
+			hot += s.Value[0]
+		}
+	}
+	if hot == 0 {
+		t.Fatal("no samples of hot()")
+	}
+}
+
+func Test_Coverage(t *testing.T) {
+	cx := rt.NewContext()
+
+	if err := cx.StartCoverage(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cx.StartCoverage(); err != ErrCoverage {
+		t.Fatal(err)
+	}
+
+	script, err := cx.CompileWith(`function grade(n) {
+  if (n > 50) {
+    return "pass";
+  }
+  return "fail";
+}
+grade(80);`, EvalOptions{FileName: "rules.js"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := script.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Eval() without a file name is not covered.
+	cx.Eval("grade(90)")
+
+	cov := cx.StopCoverage()
+	if cov == nil || cx.StopCoverage() != nil {
+		t.Fatal("no coverage")
+	}
+
+	if files := cov.Files(); len(files) != 1 || files[0] != "rules.js" {
+		t.Fatal(files)
+	}
+
+	hits := make(map[int]int64)
+	for _, l := range cov.Lines("rules.js") {
+		hits[l.Line] = l.Hits
+	}
+	if hits[3] != 2 || hits[7] != 1 {
+		t.Fatal(hits)
+	}
+	if h, ok := hits[5]; !ok || h != 0 {
+		t.Fatal(hits)
+	}
+	if p := cov.Percent(); p <= 0 || p >= 100 {
+		t.Fatal(p)
+	}
+
+	var lcov strings.Builder
+	if err := cov.WriteLCOV(&lcov); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"SF:rules.js\n", "DA:3,2\n", "DA:5,0\n", "end_of_record\n"} {
+		if !strings.Contains(lcov.String(), s) {
+			t.Fatal(lcov.String())
+		}
+	}
+
+	var html strings.Builder
+	if err := cov.WriteHTML(&html); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(html.String(), `<span class="cov0" title="0">  return &#34;fail&#34;;</span>`) {
+		t.Fatal(html.String())
+	}
+}
+
+func Test_StackTrace(t *testing.T) {
+	cx := rt.NewContext()
+
+	var caller StackFrame
+	var called bool
+	var trace []StackFrame
+
+	cx.DefineFunction("where", func(f *Func) {
+		caller, called = f.Caller()
+		trace = cx.StackTrace()
+		f.Return(cx.Void())
+	})
+
+	_, err := cx.EvalWith("function outer() {\n  inner();\n}\nfunction inner() {\n  where();\n}\nouter();", EvalOptions{FileName: "trace.js"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !called || caller != (StackFrame{"inner", "trace.js", 5}) {
+		t.Fatal(caller, called)
+	}
+
+	expected := []StackFrame{{"inner", "trace.js", 5}, {"outer", "trace.js", 2}, {"", "trace.js", 7}}
+	if fmt.Sprint(trace) != fmt.Sprint(expected) {
+		t.Fatal(trace)
+	}
+
+	if frames := cx.StackTrace(); frames != nil {
+		t.Fatal(frames)
+	}
+
+	_, err = cx.EvalWith("function fail(s) {\n  throw new Error(s);\n}\nfail('a@b');", EvalOptions{FileName: "fail.js"})
+	r, ok := err.(*ErrorReport)
+	if !ok {
+		t.Fatal(err)
+	}
+
+	// The native frame of the Error constructor is skipped.
+	expected = []StackFrame{{"fail", "fail.js", 2}, {"", "fail.js", 4}}
+	if fmt.Sprint(r.Frames) != fmt.Sprint(expected) {
+		t.Fatal(r.Frames, r.Stack)
+	}
+
+	// The file names and the arguments can have @.
+	pkg := "node_modules/@scope/pkg/index.js"
+	_, err = cx.EvalWith("function fail(s) {\n  throw new Error(s);\n}\nfail(')@x:1');", EvalOptions{FileName: pkg})
+	if r, ok = err.(*ErrorReport); !ok {
+		t.Fatal(err)
+	}
+	expected = []StackFrame{{"fail", pkg, 2}, {"", pkg, 4}}
+	if fmt.Sprint(r.Frames) != fmt.Sprint(expected) {
+		t.Fatal(r.Frames, r.Stack)
+	}
+
+	frames := parseStack("f(\"a\\\")@b\", (void 0))@a@b.js:3\nError(\"x\")@:0\n@a@b.js:5\n")
+	expected = []StackFrame{{"f", "a@b.js", 3}, {"", "a@b.js", 5}}
+	if fmt.Sprint(frames) != fmt.Sprint(expected) {
+		t.Fatal(frames)
+	}
+}
+
+func Test_Sandbox(t *testing.T) {
+	sb, err := rt.NewSandboxContext(SandboxOptions{
+		Remove: []string{"Date"},
+		Replace: map[string]interface{}{
+			"Math.random": func(o *Object, name string, argv []*Value) *Value {
+				return o.Context().Number(0.5)
+			},
+			"VERSION": "1.0",
+		},
+		SoftMaxStringLength: 10,
+		SoftMaxArrayLength:  5,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sb.Dispose()
+
+	// Go can still define globals, the + operator isn't limited.
+	if !sb.InitConsole(nil) || !sb.DefineFunction("host", func(f *Func) {
+		f.Return(sb.Int(1))
+	}) {
+		t.Fatal("can't define globals")
+	}
+
+	for _, code := range []string{
+		"eval('1')",
+		"Function('return 1')()",
+		"(function() {}).constructor('return 1')()",
+		"x = 1",
+		"var y = 1",
+		"function z() {}",
+		"'abcdef'.concat('ghijkl')",
+		"[1, 2, 3].concat([4, 5, 6])",
+		"new Array(6)",
+	} {
+		if _, err := sb.EvalWith(code, EvalOptions{FileName: "untrusted.js"}); err == nil {
+			t.Fatal(code)
+		}
+	}
+
+	v, err := sb.EvalWith("typeof Date + ',' + Math.random() + ',' + VERSION + ',' + host() + ',' + typeof console + ',' + [1, 2].concat([3]).length", EvalOptions{})
+	if err != nil || v.ToString() != "undefined,0.5,1.0,1,object,3" {
+		t.Fatal(v, err)
+	}
+
+	// The soft limits aren't a boundary, the scripts can go around them.
+	for code, expected := range map[string]string{
+		"(function() { var a = []; a.length = 1e9; return a.length; })()": "1000000000",
+		"Array.prototype.slice.call({length: 6}).length":                  "6",
+		"[].map.call({length: 6}, String).length":                         "6",
+	} {
+		if v, err := sb.EvalWith(code, EvalOptions{}); err != nil || v.ToString() != expected {
+			t.Fatal(code, v, err)
+		}
+	}
+
+	// The budgets bound them.
+	grow := "(function() { var a = []; for (var i = 0; ; i++) a[i] = i; })()"
+	if _, err := sb.EvalWith(grow, EvalOptions{Budget: &Budget{Limit: 10000}}); err != ErrBudgetExceeded {
+		t.Fatal(err)
+	}
+
+	if _, err := rt.NewSandboxContext(SandboxOptions{Remove: []string{"Nope.x"}}); err != ErrSandbox {
+		t.Fatal(err)
+	}
+
+	// Allowed features work as usual.
+	sb2, err := rt.NewSandboxContext(SandboxOptions{AllowDynamicCode: true, AllowNewGlobals: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sb2.Dispose()
+
+	if v, err := sb2.EvalWith("var y = eval('1 + 1'); y", EvalOptions{}); err != nil || v.ToString() != "2" {
+		t.Fatal(v, err)
+	}
+}
+
+func Test_InstallRoots(t *testing.T) {
+	rt := NewRuntime(8 * 1024 * 1024)
+	defer rt.Dispose()
+
+	cx := rt.NewContext()
+	roots := rt.LiveRoots()
+
+	if !cx.InitConsole(nil) || !cx.InitRequire(fstest.MapFS{}) || !cx.EnableDeterminism(1, nil) {
+		t.Fatal("can't install")
+	}
+	if n := rt.LiveRoots(); n != roots {
+		t.Fatal(n, roots)
+	}
+
+	sb, err := rt.NewSandboxContext(SandboxOptions{SoftMaxStringLength: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sb.Dispose()
+
+	if n := rt.LiveRoots(); n != roots {
+		t.Fatal(n, roots)
+	}
+}
+
+func Test_Determinism(t *testing.T) {
+	run := func(seed int64) string {
+		cx := rt.NewContext()
+		defer cx.Dispose()
+
+		clock := NewFakeClock(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC))
+		if !cx.EnableDeterminism(seed, clock) {
+			t.Fatal("can't enable determinism")
+		}
+
+		v, err := cx.EvalWith("[Math.random(), Math.random(), Date.now(), new Date().getTime()].join()", EvalOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v.ToString()
+	}
+
+	a, b := run(1), run(1)
+	if a != b || run(2) == a {
+		t.Fatal(a, b)
+	}
+	if !strings.HasSuffix(a, ",1704164645000,1704164645000") {
+		t.Fatal(a)
+	}
+
+	cx := rt.NewContext()
+	defer cx.Dispose()
+	cx.EnableDeterminism(0, nil)
+
+	seed := int64(7)
+	opts := EvalOptions{Seed: &seed, Now: time.Unix(1000, 0)}
+	v1, _ := cx.EvalWith("Math.random() + ',' + Date.now()", opts)
+	v2, _ := cx.EvalWith("Math.random() + ',' + Date.now()", opts)
+	if v1.ToString() != v2.ToString() || !strings.HasSuffix(v1.ToString(), ",1000000") {
+		t.Fatal(v1, v2)
+	}
+
+	// Zero is a seed too.
+	zero := int64(0)
+	v3, _ := cx.EvalWith("Math.random()", EvalOptions{Seed: &zero})
+	v4, _ := cx.EvalWith("Math.random()", EvalOptions{Seed: &zero})
+	if v3.ToString() != v4.ToString() {
+		t.Fatal(v3, v4)
+	}
+
+	// The time of the evaluation is over, the clock is back.
+	if v := cx.Eval("Date.now()"); v.ToString() != "0" {
+		t.Fatal(v)
+	}
+}
+
+func Test_Budget(t *testing.T) {
+	cx := rt.NewContext()
+	defer cx.Dispose()
+
+	code := "var n = 0; for (var i = 0; i < 1000; i++) n += i; n"
+
+	b1 := &Budget{}
+	v, err := cx.EvalWith(code, EvalOptions{Budget: b1})
+	if err != nil || v.ToString() != "499500" || b1.Used < 1000 {
+		t.Fatal(v, err, b1.Used)
+	}
+
+	// The count is the same for the same work.
+	b2 := &Budget{Limit: b1.Used}
+	if _, err := cx.EvalWith(code, EvalOptions{Budget: b2}); err != nil || b2.Used != b1.Used {
+		t.Fatal(err, b1.Used, b2.Used)
+	}
+
+	// The script can't catch it.
+	b3 := &Budget{Limit: 100}
+	if _, err := cx.EvalWith("try { for (;;) {} } catch (e) {}", EvalOptions{Budget: b3}); err != ErrBudgetExceeded || b3.Used != 100 {
+		t.Fatal(err, b3.Used)
+	}
+
+	script, err := cx.CompileWith("1 + 1", EvalOptions{FileName: "budget.js"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b4 := &Budget{Limit: 1000}
+	if v, err := script.RunBudget(b4); err != nil || v.ToString() != "2" || b4.Used == 0 {
+		t.Fatal(v, err, b4.Used)
+	}
+}
+
+func Test_Capabilities(t *testing.T) {
+	caps := NewCapabilities()
+	caps.Register("readFile", func(f *Func) {
+		f.Return(f.Context().String("data"))
+	}, "fs.read")
+	caps.Register("fetch", func(f *Func) {
+		f.Return(f.Context().String("page"))
+	}, "net")
+
+	var events []*AuditEvent
+	caps.SetAudit(func(e *AuditEvent) {
+		events = append(events, e)
+	})
+
+	cx := rt.NewContext()
+	defer cx.Dispose()
+
+	if !cx.InitCapabilities(caps, "fs") {
+		t.Fatal("can't init capabilities")
+	}
+
+	if v, err := cx.EvalWith("readFile('a.txt')", EvalOptions{FileName: "app.js"}); err != nil || v.ToString() != "data" {
+		t.Fatal(v, err)
+	}
+
+	v, err := cx.EvalWith("try { fetch('x') } catch (e) { [e instanceof SecurityError, e instanceof Error, e.name, e.message].join() }", EvalOptions{})
+	if err != nil || v.ToString() != "true,true,SecurityError,fetch() requires the permission net" {
+		t.Fatal(v, err)
+	}
+
+	_, err = cx.EvalWith("\nfetch('x')", EvalOptions{FileName: "app.js"})
+	if r, ok := err.(*ErrorReport); !ok || !strings.Contains(r.Message, "SecurityError") || r.FileName != "app.js" || r.LineNum != 2 {
+		t.Fatal(err)
+	}
+
+	if len(events) != 3 || !events[0].Allowed() || events[1].Allowed() || events[1].Missing[0] != "net" {
+		t.Fatal(events)
+	}
+	if events[0].Function != "readFile" || events[0].Caller != (StackFrame{"", "app.js", 1}) {
+		t.Fatal(events[0])
+	}
+}